@@ -0,0 +1,90 @@
+/*
+Copyright © 2019 blacktop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"github.com/apex/log"
+	"github.com/blacktop/graboid/pkg/bundle"
+	"github.com/blacktop/graboid/pkg/image"
+	"github.com/spf13/cobra"
+)
+
+// applyCmd represents the apply command
+var applyCmd = &cobra.Command{
+	Use:   "apply <bundle>",
+	Short: "Rebuild complete images from an incremental bundle",
+	Long: `Rebuilds the complete images of a bundle created with 'graboid bundle --since' by
+filling in the omitted blobs from existing stores. A store is a previous image archive
+or bundle, or a directory of blobs (i.e. a graboid blob cache).`,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		if Verbose {
+			log.SetLevel(log.DebugLevel)
+		}
+		stores, _ := cmd.Flags().GetStringSlice("store")
+		output, _ := cmd.Flags().GetString("output")
+
+		opts, err := getArchiveOptions(cmd)
+		if err != nil {
+			return err
+		}
+		identities, err := getIdentities(cmd)
+		if err != nil {
+			return err
+		}
+
+		// carry the blob sources over from the transfer manifests of the bundle and stores
+		sources := make(map[string]bundle.Source)
+		for _, path := range append([]string{args[0]}, stores...) {
+			m, _, err := bundle.ReadTransferManifest(bundle.TransferManifestPath(path))
+			if err != nil {
+				continue
+			}
+			for _, blob := range m.Blobs {
+				if _, ok := sources[blob.Digest]; !ok && blob.Pulled != nil {
+					sources[blob.Digest] = bundle.Source{Ref: blob.Source, Pulled: *blob.Pulled}
+				}
+			}
+		}
+
+		if err := createArchive(output, opts, sources, func(w *image.Writer) error {
+			return bundle.Apply(args[0], stores, w, identities...)
+		}); err != nil {
+			return err
+		}
+
+		log.Infof("\033[1mSUCCESS!\033[0m")
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(applyCmd)
+
+	applyCmd.Flags().StringSlice("store", nil, "image archive (or split set) or blob directory with the omitted blobs (can be repeated)")
+	applyCmd.Flags().StringP("output", "o", "", "output file (use - for stdout)")
+	addArchiveFlags(applyCmd)
+	addIdentityFlag(applyCmd)
+	applyCmd.MarkFlagRequired("output")
+}
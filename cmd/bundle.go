@@ -0,0 +1,199 @@
+/*
+Copyright © 2019 blacktop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/blacktop/graboid/pkg/bundle"
+	"github.com/blacktop/graboid/pkg/registry"
+	"github.com/spf13/cobra"
+)
+
+// bundleIndex builds the index of the pulled images and returns the names of
+// the blobs to leave out of the bundle because they are already in since
+func bundleIndex(images []*pulledImage, since *bundle.Index) (*bundle.Index, []string) {
+	var omitted []string
+	index := bundle.NewIndex()
+
+	for _, img := range images {
+		if img.Err != nil {
+			continue
+		}
+		entry := bundle.Image{
+			RepoTags: []string{img.Ref.Name + ":" + img.Ref.Tag},
+			Platform: img.Image.Platform(),
+			Digest:   img.Manifest.Digest,
+		}
+
+		blobs := []bundle.Blob{{
+			Name:      fmt.Sprintf("%s.json", strings.TrimPrefix(img.Manifest.Config.Digest, "sha256:")),
+			Digest:    img.Manifest.Config.Digest,
+			Size:      int64(img.Manifest.Config.Size),
+			MediaType: img.Manifest.Config.MediaType,
+		}}
+		for _, layer := range img.Manifest.Layers {
+			blobs = append(blobs, bundle.Blob{
+				Name:      fmt.Sprintf("%s.tar", strings.TrimPrefix(layer.Digest, "sha256:")),
+				Digest:    layer.Digest,
+				Size:      int64(layer.Size),
+				MediaType: layer.MediaType,
+			})
+		}
+
+		entry.Config = blobs[0].Name
+		for _, blob := range blobs {
+			if blob.Name != entry.Config {
+				entry.Layers = append(entry.Layers, blob.Name)
+			}
+			if since.Has(blob.Digest) {
+				blob.Omitted = true
+				if !index.Has(blob.Digest) {
+					omitted = append(omitted, blob.Name)
+				}
+			}
+			index.AddBlob(blob)
+		}
+		index.AddImage(entry)
+	}
+
+	return index, omitted
+}
+
+// bundleCmd represents the bundle command
+var bundleCmd = &cobra.Command{
+	Use:   "bundle [images...]",
+	Short: "Bundle several images into one archive",
+	Long: `Pulls several images into a single 'docker load' compatible archive storing each shared layer only once.
+
+A bundle index listing the bundle's images and blobs is written next to the archive.
+Pass the index of a previous bundle (or one exported with 'graboid inventory') with
+--since to leave out every blob the target already has, then rebuild the complete
+images on the target with 'graboid apply'.`,
+	Args:         cobra.MinimumNArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		if Verbose {
+			log.SetLevel(log.DebugLevel)
+		}
+		insecure, _ := cmd.Flags().GetBool("insecure")
+		proxy, _ := cmd.Flags().GetString("proxy")
+		platforms, _ := cmd.Flags().GetStringSlice("platform")
+		concurrency, _ := cmd.Flags().GetInt("concurrency")
+		cacheDir, _ := cmd.Flags().GetString("cache")
+		output, _ := cmd.Flags().GetString("output")
+		sinceFiles, _ := cmd.Flags().GetStringSlice("since")
+		indexFile, _ := cmd.Flags().GetString("index-file")
+
+		opts, err := getArchiveOptions(cmd)
+		if err != nil {
+			return err
+		}
+		dopts, err := getDecryptOptions(cmd)
+		if err != nil {
+			return err
+		}
+		convert, err := getConvertLayers(cmd)
+		if err != nil {
+			return err
+		}
+		if len(output) == 0 {
+			output = "bundle.tar" + opts.Ext()
+		}
+
+		var entries []imageListEntry
+		for _, arg := range args {
+			entries = append(entries, imageListEntry{Ref: arg})
+		}
+		jobs, err := pullJobs(entries, platforms)
+		if err != nil {
+			return err
+		}
+
+		cache, err := registry.NewCache(cacheDir)
+		if err != nil {
+			return err
+		}
+
+		since := bundle.NewIndex()
+		for _, path := range sinceFiles {
+			prev, err := bundle.ReadIndex(path)
+			if err != nil {
+				return err
+			}
+			since.Merge(prev)
+		}
+
+		images := pullAll(jobs, concurrency, &pullOptions{
+			Cache:    cache,
+			Proxy:    proxy,
+			Insecure: insecure,
+			Decrypt:  *dopts,
+			Convert:  convert,
+		}, nil)
+
+		index, omitted := bundleIndex(images, since)
+		if len(omitted) > 0 {
+			log.WithField("count", len(omitted)).Info("omitting blobs the target already has")
+		}
+		if err := writeCombined(output, opts, images, omitted...); err != nil {
+			return err
+		}
+
+		if len(indexFile) == 0 && output != "-" {
+			indexFile = output + ".index"
+		}
+		if len(indexFile) > 0 {
+			if err := index.Write(indexFile); err != nil {
+				return err
+			}
+			log.WithField("path", indexFile).Info("wrote bundle index")
+		}
+
+		fmt.Fprintln(os.Stderr)
+		if failed := printPullSummary(os.Stderr, images); failed > 0 {
+			return fmt.Errorf("%d of %d images failed to pull", failed, len(images))
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(bundleCmd)
+
+	bundleCmd.Flags().String("proxy", "", "HTTP/HTTPS proxy")
+	bundleCmd.Flags().Bool("insecure", false, "do not verify ssl certs")
+	bundleCmd.Flags().StringSlice("platform", []string{registry.DefaultPlatform}, "platforms to bundle for each image")
+	bundleCmd.Flags().IntP("concurrency", "j", 4, "number of images to pull at once")
+	bundleCmd.Flags().String("cache", defaultCacheDir(), "shared blob cache directory")
+	bundleCmd.Flags().StringP("output", "o", "", "output file (use - for stdout) (default is bundle.tar[.gz|.zst])")
+	bundleCmd.Flags().StringSlice("since", nil, "bundle index of blobs the target already has (can be repeated)")
+	bundleCmd.Flags().String("index-file", "", "bundle index output file (default is <output>.index)")
+	addArchiveFlags(bundleCmd)
+	addDecryptionFlags(bundleCmd, false)
+	addConvertFlag(bundleCmd)
+}
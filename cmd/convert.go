@@ -0,0 +1,204 @@
+/*
+Copyright © 2019 blacktop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/blacktop/graboid/pkg/compress"
+	"github.com/blacktop/graboid/pkg/ocicrypt"
+	"github.com/blacktop/graboid/pkg/registry"
+	"github.com/spf13/cobra"
+)
+
+// zstdChunkedAnnotationPrefix is the prefix of the zstd:chunked layer annotations
+// that no longer apply once a layer has been recompressed
+const zstdChunkedAnnotationPrefix = "io.github.containers.zstd-chunked."
+
+func addConvertFlag(cmd *cobra.Command) {
+	cmd.Flags().String("convert-layers", "", "recompress zstd layers so older docker engines can load them (gzip)")
+}
+
+func getConvertLayers(cmd *cobra.Command) (compress.Algorithm, error) {
+	convert, _ := cmd.Flags().GetString("convert-layers")
+	switch convert {
+	case "":
+		return "", nil
+	case string(compress.Gzip):
+		return compress.Gzip, nil
+	}
+	return "", fmt.Errorf("bad --convert-layers %q (only gzip is supported)", convert)
+}
+
+// needsConversion returns true if any of the manifest's layers are compressed with something other than algo
+func needsConversion(m *registry.Manifests, algo compress.Algorithm) bool {
+	if len(algo) == 0 {
+		return false
+	}
+	for _, layer := range m.Layers {
+		if c, err := registry.LayerCompression(layer.MediaType); err != nil || (c != algo && c != compress.None) {
+			return true
+		}
+	}
+	return false
+}
+
+// recompress decompresses a layer and compresses it with algo into the cache
+// returning the layer's diff ID and the digest and size of the new blob
+func recompress(r io.Reader, cache *registry.Cache, algo compress.Algorithm) (string, string, int64, error) {
+	h := sha256.New()
+	pr, pw := io.Pipe()
+	go func() {
+		zr, err := compress.NewReader(r)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		defer zr.Close()
+		cw, err := compress.NewWriter(pw, algo, compress.DefaultOptions)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if _, err = io.Copy(cw, io.TeeReader(zr, h)); err == nil {
+			err = cw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	digest, size, err := cache.Add(pr, "")
+	pr.Close()
+	if err != nil {
+		return "", "", 0, err
+	}
+	return fmt.Sprintf("sha256:%x", h.Sum(nil)), digest, size, nil
+}
+
+// convertLayers recompresses the manifest's layers that aren't compressed with algo
+// into the cache and returns the manifest and config of the converted image.
+// The config's diff_ids are checked against the decompressed layers and rewritten
+// if they don't match.
+func convertLayers(m *registry.Manifests, config []byte, fetch blobFetcher, cache *registry.Cache, algo compress.Algorithm) (*registry.Manifests, []byte, error) {
+	if !needsConversion(m, algo) {
+		return m, config, nil
+	}
+
+	var conf map[string]json.RawMessage
+	if err := json.Unmarshal(config, &conf); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse image config: %v", err)
+	}
+	var rootfs map[string]json.RawMessage
+	if err := json.Unmarshal(conf["rootfs"], &rootfs); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse image config rootfs: %v", err)
+	}
+	var diffIDs []string
+	if err := json.Unmarshal(rootfs["diff_ids"], &diffIDs); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse image config diff_ids: %v", err)
+	}
+	if len(diffIDs) != len(m.Layers) {
+		return nil, nil, fmt.Errorf("image config has %d diff_ids for %d layers", len(diffIDs), len(m.Layers))
+	}
+
+	cm := *m
+	cm.Layers = append(cm.Layers[:0:0], m.Layers...)
+	configChanged := false
+	for i, layer := range m.Layers {
+		if ocicrypt.IsEncrypted(layer.MediaType) {
+			return nil, nil, fmt.Errorf("layer %s is encrypted and can't be converted", layer.Digest)
+		}
+		c, err := registry.LayerCompression(layer.MediaType)
+		if err != nil {
+			return nil, nil, fmt.Errorf("layer %s: %v", layer.Digest, err)
+		}
+		if c == algo || c == compress.None {
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"digest": layer.Digest,
+			"from":   c,
+			"to":     algo,
+		}).Debug("converting layer")
+		body, err := fetch(layer.Digest, layer.MediaType, layer.Size)
+		if err != nil {
+			return nil, nil, err
+		}
+		diffID, digest, size, err := recompress(body, cache, algo)
+		body.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("converting layer %s failed: %v", layer.Digest, err)
+		}
+
+		if diffIDs[i] != diffID {
+			log.WithFields(log.Fields{
+				"layer":    layer.Digest,
+				"config":   diffIDs[i],
+				"computed": diffID,
+			}).Warn("image config has the wrong diff_id for layer, rewriting it")
+			diffIDs[i] = diffID
+			configChanged = true
+		}
+
+		cm.Layers[i].Digest = digest
+		cm.Layers[i].Size = int(size)
+		cm.Layers[i].MediaType = registry.LayerMediaType(layer.MediaType, algo)
+		cm.Layers[i].Annotations = nil
+		for key, value := range layer.Annotations {
+			if !strings.HasPrefix(key, zstdChunkedAnnotationPrefix) {
+				if cm.Layers[i].Annotations == nil {
+					cm.Layers[i].Annotations = make(map[string]string)
+				}
+				cm.Layers[i].Annotations[key] = value
+			}
+		}
+	}
+
+	if configChanged {
+		var err error
+		if rootfs["diff_ids"], err = json.Marshal(diffIDs); err != nil {
+			return nil, nil, err
+		}
+		if conf["rootfs"], err = json.Marshal(rootfs); err != nil {
+			return nil, nil, err
+		}
+		if config, err = json.Marshal(conf); err != nil {
+			return nil, nil, err
+		}
+		cm.Config.Digest = fmt.Sprintf("sha256:%x", sha256.Sum256(config))
+		cm.Config.Size = len(config)
+	}
+
+	// the converted image has a new manifest
+	raw, err := json.Marshal(cm)
+	if err != nil {
+		return nil, nil, err
+	}
+	cm.Raw = raw
+	cm.Digest = fmt.Sprintf("sha256:%x", sha256.Sum256(raw))
+
+	return &cm, config, nil
+}
@@ -0,0 +1,164 @@
+/*
+Copyright © 2019 blacktop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/blacktop/graboid/pkg/ocicrypt"
+	"github.com/blacktop/graboid/pkg/registry"
+	"github.com/spf13/cobra"
+)
+
+// decryptOptions are the options for pulling images with ocicrypt encrypted layers
+type decryptOptions struct {
+	Keys *ocicrypt.KeyRing
+	// KeepEncrypted writes encrypted layers as is (OCI layouts only)
+	KeepEncrypted bool
+}
+
+func addDecryptionFlags(cmd *cobra.Command, keep bool) {
+	cmd.Flags().StringSlice("decryption-key", nil, "private key (PEM or JWK, with its certificate for PKCS #7) to decrypt encrypted layers with (can be repeated)")
+	if keep {
+		cmd.Flags().Bool("keep-encrypted", false, "keep encrypted layers encrypted (requires --format oci)")
+	}
+}
+
+func getDecryptOptions(cmd *cobra.Command) (*decryptOptions, error) {
+	keyFiles, _ := cmd.Flags().GetStringSlice("decryption-key")
+	keep, _ := cmd.Flags().GetBool("keep-encrypted")
+
+	keys, err := ocicrypt.LoadKeyRing(keyFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptOptions{Keys: keys, KeepEncrypted: keep}, nil
+}
+
+// hasEncryptedLayers returns true if any of the manifest's layers are encrypted
+func hasEncryptedLayers(m *registry.Manifests) bool {
+	for _, layer := range m.Layers {
+		if ocicrypt.IsEncrypted(layer.MediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// decryptLayers decrypts the manifest's encrypted layers into the cache and returns
+// the manifest of the decrypted image. Each layer's HMAC (and digest when it was
+// recorded) is verified before it is added to the cache.
+func decryptLayers(m *registry.Manifests, fetch blobFetcher, cache *registry.Cache, keys *ocicrypt.KeyRing) (*registry.Manifests, error) {
+	if !hasEncryptedLayers(m) {
+		return m, nil
+	}
+
+	dm := *m
+	dm.Layers = append(dm.Layers[:0:0], m.Layers...)
+	for i, layer := range m.Layers {
+		if !ocicrypt.IsEncrypted(layer.MediaType) {
+			continue
+		}
+		if keys.Empty() {
+			return nil, fmt.Errorf("layer %s is encrypted (use --decryption-key, or --keep-encrypted with --format oci)", layer.Digest)
+		}
+		opts, err := keys.LayerOptions(layer.Annotations)
+		if err != nil {
+			return nil, fmt.Errorf("layer %s: %v", layer.Digest, err)
+		}
+
+		log.WithField("digest", layer.Digest).Debug("decrypting layer")
+		body, err := fetch(layer.Digest, layer.MediaType, layer.Size)
+		if err != nil {
+			return nil, err
+		}
+		r, err := ocicrypt.NewReader(body, opts)
+		if err != nil {
+			body.Close()
+			return nil, err
+		}
+		digest, size, err := cache.Add(r, opts.Digest)
+		if cerr := r.Close(); err == nil {
+			err = cerr
+		}
+		body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("decrypting layer %s failed: %v", layer.Digest, err)
+		}
+
+		dm.Layers[i].Digest = digest
+		dm.Layers[i].Size = int(size)
+		dm.Layers[i].MediaType = ocicrypt.DecryptedMediaType(layer.MediaType)
+		dm.Layers[i].Annotations = nil
+		for key, value := range layer.Annotations {
+			if !strings.HasPrefix(key, ocicrypt.AnnotationPrefix) {
+				if dm.Layers[i].Annotations == nil {
+					dm.Layers[i].Annotations = make(map[string]string)
+				}
+				dm.Layers[i].Annotations[key] = value
+			}
+		}
+	}
+
+	// the decrypted image has a new manifest
+	raw, err := json.Marshal(dm)
+	if err != nil {
+		return nil, err
+	}
+	dm.Raw = raw
+	dm.Digest = fmt.Sprintf("sha256:%x", sha256.Sum256(raw))
+
+	return &dm, nil
+}
+
+// cachedFetcher reads blobs from the cache when they are in it (i.e. decrypted layers) and uses fetch otherwise
+func cachedFetcher(cache *registry.Cache, fetch blobFetcher) blobFetcher {
+	return func(digest, mediaType string, size int) (io.ReadCloser, error) {
+		if f, err := os.Open(cache.Path(digest)); err == nil {
+			return f, nil
+		}
+		return fetch(digest, mediaType, size)
+	}
+}
+
+// tempLayerCache creates a temporary blob cache for decrypted and converted layers. cleanup removes it.
+func tempLayerCache() (*registry.Cache, func(), error) {
+	dir, err := ioutil.TempDir("", "graboid-layers-")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	cache, err := registry.NewCache(dir)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return cache, cleanup, nil
+}
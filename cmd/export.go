@@ -0,0 +1,223 @@
+/*
+Copyright © 2019 blacktop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/apex/log"
+	"github.com/blacktop/graboid/pkg/image"
+	"github.com/blacktop/graboid/pkg/registry"
+	"github.com/spf13/cobra"
+)
+
+// exportCmd represents the export command
+var exportCmd = &cobra.Command{
+	Use:   "export <archive|image>",
+	Short: "Export an image's flattened root filesystem",
+	Long: `Exports the root filesystem a container of the image sees, its layers applied in
+order with their whiteouts and opaque directories, to a directory or a tar (.tar,
+.tar.gz or .tar.zst, or - for a tar to stdout). The image is read from an archive,
+a split set or an OCI image layout, or pulled straight from the registry.
+
+Files keep their mode, modification time, extended attributes and links. Owners
+are set on a directory when run as root (or with --same-owner) and are always
+written to tars; --uid-map and --gid-map remap them, e.g. to a rootless user's
+subordinate ids.`,
+	Example: `  graboid export alpine.tar.gz -o rootfs/
+  graboid export alpine:3.14 -o rootfs.tar
+  graboid export ubuntu:20.04 --platform linux/arm64 -o - | tar -t
+  graboid export image.tar.gz -o rootfs/ --same-owner --uid-map 0:100000:65536 --gid-map 0:100000:65536`,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		if Verbose {
+			log.SetLevel(log.DebugLevel)
+		}
+		output, _ := cmd.Flags().GetString("output")
+		sameOwner, _ := cmd.Flags().GetBool("same-owner")
+
+		uids, err := getIDMaps(cmd, "uid-map")
+		if err != nil {
+			return err
+		}
+		gids, err := getIDMaps(cmd, "gid-map")
+		if err != nil {
+			return err
+		}
+
+		li, cleanup, err := openImage(cmd, args[0])
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		fsys, open, err := li.fs()
+		if err != nil {
+			return err
+		}
+
+		t, err := outputTarget(output)
+		if err != nil {
+			return err
+		}
+		if dir, ok := t.(*image.DirTarget); ok {
+			dir.Chown = sameOwner
+			// absolute symlinks resolve within the root filesystem once it is used as one
+			dir.AbsoluteLinks = true
+		}
+		if len(uids) > 0 || len(gids) > 0 {
+			t = image.RemapTarget(t, uids, gids)
+		}
+
+		log.WithField("image", li.String()).Info("exporting root filesystem")
+		n, err := extractFiles(fsys, open, []string{"/"}, t, li.limits)
+		if err != nil {
+			return err
+		}
+		log.WithField("files", n).Infof(getFmtStr(), "SUCCESS!")
+		return nil
+	},
+}
+
+// getIDMaps parses the container:host:size id maps of a flag
+func getIDMaps(cmd *cobra.Command, flag string) ([]image.IDMap, error) {
+	values, _ := cmd.Flags().GetStringSlice(flag)
+	var maps []image.IDMap
+	for _, v := range values {
+		m, err := image.ParseIDMap(v)
+		if err != nil {
+			return nil, fmt.Errorf("--%s: %v", flag, err)
+		}
+		maps = append(maps, m)
+	}
+	return maps, nil
+}
+
+// openImage loads the image of a local archive or pulls it from the registry
+// when there is no such file. cleanup removes what pulling left behind.
+func openImage(cmd *cobra.Command, arg string) (*localImage, func(), error) {
+	if path := filepath.Clean(arg); isLocal(path) {
+		log.WithField("path", path).Info("reading archive")
+		li, err := loadImage(cmd, path)
+		return li, func() {}, err
+	}
+	return pullImage(cmd, arg)
+}
+
+// pullImage pulls an image into a temporary blob cache and parses it as an
+// OCI image layout. cleanup removes the cache.
+func pullImage(cmd *cobra.Command, ref string) (*localImage, func(), error) {
+	proxy, _ := cmd.Flags().GetString("proxy")
+	insecure, _ := cmd.Flags().GetBool("insecure")
+	platform, _ := cmd.Flags().GetString("platform")
+	if len(platform) == 0 {
+		platform = registry.DefaultPlatform
+	}
+	dopts, err := getDecryptOptions(cmd)
+	if err != nil {
+		return nil, nil, err
+	}
+	limits, err := getLimits(cmd)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cache, cleanup, err := tempLayerCache()
+	if err != nil {
+		return nil, nil, err
+	}
+	job := pullJob{Ref: parseImageRef(ref), Platform: platform}
+	log.WithFields(log.Fields{
+		"image":    job.Ref.String(),
+		"platform": job.Platform,
+	}).Info("pulling")
+	img, err := pullToCache(job, &pullOptions{Cache: cache, Proxy: proxy, Insecure: insecure, Decrypt: *dopts})
+	if err == nil {
+		err = writeLayoutIndex(cache, img.Manifest)
+	}
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+
+	images, err := image.ParseDir(cache.Dir, limits)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	li := &localImage{Tar: images[0], path: cache.Dir, limits: limits, isDir: true}
+	li.Tag = job.Ref.String()
+	li.Manifest.RepoTags = []string{li.Tag}
+	return li, cleanup, nil
+}
+
+// writeLayoutIndex adds the manifest and an index.json pointing to it to a
+// blob cache, making it an OCI image layout of the image
+func writeLayoutIndex(cache *registry.Cache, m *registry.Manifests) error {
+	raw := m.Raw
+	if len(raw) == 0 {
+		var err error
+		if raw, err = json.Marshal(m); err != nil {
+			return err
+		}
+	}
+	digest, size, err := cache.Add(bytes.NewReader(raw), "")
+	if err != nil {
+		return err
+	}
+	mediaType := m.MediaType
+	if len(mediaType) == 0 {
+		mediaType = registry.MediaTypeManifest
+	}
+	index, err := json.Marshal(image.OCIIndex{
+		SchemaVersion: 2,
+		MediaType:     image.MediaTypeOCIIndex,
+		Manifests:     []image.Descriptor{{MediaType: mediaType, Digest: digest, Size: size}},
+	})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(cache.Dir, image.OCIIndexFile), index, 0644)
+}
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+
+	exportCmd.Flags().StringP("output", "o", "", "directory or tar (.tar, .tar.gz or .tar.zst) to export the root filesystem to (use - for a tar to stdout)")
+	exportCmd.Flags().String("ref", "", "image to export from archives with several (repo tag, OCI ref name or image ID)")
+	exportCmd.Flags().String("platform", "", "platform of the image (os/arch[/variant], default is "+registry.DefaultPlatform+" when pulling)")
+	exportCmd.Flags().Bool("same-owner", os.Geteuid() == 0, "set the owner of the exported files in a directory to their uid and gid in the image (default when run as root)")
+	exportCmd.Flags().StringSlice("uid-map", nil, "map uids in the image to the host as container:host:size (can be repeated, unmapped uids become 65534)")
+	exportCmd.Flags().StringSlice("gid-map", nil, "map gids in the image to the host as container:host:size (can be repeated, unmapped gids become 65534)")
+	exportCmd.Flags().String("proxy", "", "HTTP/HTTPS proxy")
+	exportCmd.Flags().Bool("insecure", false, "do not verify ssl certs")
+	addDecryptionFlags(exportCmd, false)
+	addIdentityFlag(exportCmd)
+	addLimitFlags(exportCmd)
+	exportCmd.MarkFlagRequired("output")
+}
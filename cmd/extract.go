@@ -24,12 +24,16 @@ package cmd
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
+	"filippo.io/age"
 	"github.com/apex/log"
+	"github.com/blacktop/graboid/pkg/bundle"
+	"github.com/blacktop/graboid/pkg/compress"
 	"github.com/blacktop/graboid/pkg/image"
 
 	// "github.com/dustin/go-humanize"
@@ -44,8 +48,22 @@ const instructions = "<q> Quit | <enter> Expand/Collapse | <space> Extract"
 var extractCmd = &cobra.Command{
 	Use:   "extract",
 	Short: "Extract files from image",
-	Long:  `Launches an interactive UI to explore and extract files from downloaded image TARs.`,
-	Args:  cobra.MinimumNArgs(1),
+	Long: `Launches an interactive UI to explore and extract files from downloaded image TARs,
+'docker save' archives and OCI image layouts (as a directory or a tar).
+
+With --path the files are extracted without the UI: paths may be globs and
+directories are extracted recursively, from the merged filesystem or from the
+layer picked with --layer, to a directory, a tar or (for a single file) stdout.
+Files keep their full path, mode, modification time and extended attributes, and
+symlinks and hard links are recreated; owners are only set with --same-owner.
+Paths that leave the output directory are rejected, including symlinks to
+absolute paths unless --absolute-links is set (e.g. to extract a root filesystem).`,
+	Example: `  graboid extract alpine.tar
+  graboid extract image.tar.gz --path /etc/ssl --path /usr/bin/foo -o outdir
+  graboid extract image.tar.gz --path '/etc/*.conf' --layer 0 -o conf.tar.gz
+  graboid extract image.tar.gz --path /etc/os-release -o -
+  sudo graboid extract image.tar.gz --path / --same-owner --absolute-links -o rootfs`,
+	Args: cobra.MinimumNArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 
 		if Verbose {
@@ -53,23 +71,25 @@ var extractCmd = &cobra.Command{
 		}
 
 		tarPath := filepath.Clean(args[0])
-
-		if _, err := os.Stat(tarPath); os.IsNotExist(err) {
+		if !isLocal(tarPath) {
 			log.Fatalf("file does not exist: %s", tarPath)
 		}
 
-		fmt.Println()
+		fmt.Fprintln(os.Stderr)
 		log.Infof(getFmtStr(), "[ANALYZING] Please wait...")
 
-		f, err := os.Open(tarPath)
+		li, err := loadImage(cmd, tarPath)
 		if err != nil {
 			return err
 		}
-		defer f.Close()
+		i := li.Tar
 
-		i, err := image.Parse(bufio.NewReader(f))
-		if err != nil {
-			return err
+		if paths, _ := cmd.Flags().GetStringArray("path"); len(paths) > 0 {
+			fsys, open, err := li.fs()
+			if err != nil {
+				return err
+			}
+			return extractPaths(cmd, fsys, open, paths, li.limits)
 		}
 		// for _, layer := range i.Layers {
 		// 	fmt.Printf("LAYER: %s (%s)\n", layer.Tree().Name, humanize.Bytes(layer.Size()))
@@ -87,6 +107,11 @@ var extractCmd = &cobra.Command{
 		// fmt.Println(nodes)
 		// return nil
 
+		nodes, err := i.Nodes()
+		if err != nil {
+			return err
+		}
+
 		if err := ui.Init(); err != nil {
 			log.Fatalf("failed to initialize termui: %v", err)
 		}
@@ -95,7 +120,7 @@ var extractCmd = &cobra.Command{
 		l := widgets.NewTree()
 		l.TextStyle = ui.NewStyle(ui.ColorYellow)
 		l.WrapText = false
-		l.SetNodes(i.Nodes())
+		l.SetNodes(nodes)
 		l.Title = "Layers"
 		l.TitleStyle.Fg = ui.ColorCyan
 		l.PaddingTop = 1
@@ -189,13 +214,29 @@ var extractCmd = &cobra.Command{
 			case "<Home>":
 				l.ScrollTop()
 			case "<Space>":
-				instrns.Text = fmt.Sprintf("Extracting - %s", l.SelectedNode().Value.String())
+				file, ok := l.SelectedNode().Value.(image.FileValue)
+				if !ok {
+					break
+				}
+				instrns.Text = fmt.Sprintf("Extracting - %s", file.Path)
 				ui.Render(grid)
-				f.Seek(0, 0)
-				if err := i.Extract(bufio.NewReader(f), l.SelectedNode().Value.String(), 2); err != nil {
-					return err
+				switch {
+				case li.isDir:
+					err = i.ExtractLayerDir(tarPath, file.Layer, file.Path)
+				case li.indexed:
+					err = i.ExtractLayerIndexed(file.Layer, file.Path)
+				default:
+					var f io.ReadCloser
+					if f, err = bundle.Open(tarPath, li.identities...); err == nil {
+						err = i.ExtractLayer(bufio.NewReader(f), file.Layer, file.Path)
+						f.Close()
+					}
+				}
+				if err != nil {
+					instrns.Text = fmt.Sprintf("ERROR - %v", err)
+				} else {
+					instrns.Text = "DONE!"
 				}
-				instrns.Text = "DONE!"
 				ui.Render(grid)
 				time.Sleep(1 * time.Second)
 				instrns.Text = instructions
@@ -224,6 +265,228 @@ var extractCmd = &cobra.Command{
 	},
 }
 
+// extractPaths extracts the files matched by --path without the UI
+func extractPaths(cmd *cobra.Command, fsys *image.FS, open func() (io.ReadCloser, error), patterns []string, limits image.Limits) error {
+	layer, _ := cmd.Flags().GetInt("layer")
+	output, _ := cmd.Flags().GetString("output")
+	sameOwner, _ := cmd.Flags().GetBool("same-owner")
+	absoluteLinks, _ := cmd.Flags().GetBool("absolute-links")
+
+	if layer >= 0 {
+		var err error
+		if fsys, err = fsys.Layer(layer); err != nil {
+			return err
+		}
+	}
+	paths, err := image.Glob(fsys, patterns...)
+	if err != nil {
+		return err
+	}
+
+	if output == "-" {
+		if len(paths) != 1 {
+			return fmt.Errorf("only a single file can be written to stdout but %d paths matched", len(paths))
+		}
+		f, err := fsys.Open(paths[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if fi, err := f.Stat(); err != nil {
+			return err
+		} else if !fi.Mode().IsRegular() {
+			return fmt.Errorf("/%s is not a regular file", paths[0])
+		}
+		_, err = io.Copy(os.Stdout, f)
+		return err
+	}
+
+	t, err := outputTarget(output)
+	if err != nil {
+		return err
+	}
+	if dir, ok := t.(*image.DirTarget); ok {
+		dir.Chown = sameOwner
+		dir.AbsoluteLinks = absoluteLinks
+	}
+	n, err := extractFiles(fsys, open, paths, t, limits)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("extracted %d files to %s", n, output)
+	return nil
+}
+
+// extractFiles writes the paths in fsys to t and closes it. When open is set
+// the files are read in a single pass over the archive it opens. It is an
+// error for the files to exceed limits.
+func extractFiles(fsys *image.FS, open func() (io.ReadCloser, error), paths []string, t image.Target, limits image.Limits) (int, error) {
+	var (
+		n   int
+		err error
+	)
+	if open == nil {
+		n, err = image.ExtractPaths(fsys, paths, t, limits)
+	} else {
+		var f io.ReadCloser
+		if f, err = open(); err == nil {
+			n, err = image.ExtractPathsFrom(bufio.NewReader(f), fsys, paths, t, limits)
+			f.Close()
+		}
+	}
+	if cerr := t.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+// outputTarget returns the target that writes files to output: a tar (.tar,
+// .tar.gz or .tar.zst), - for a tar to stdout or else a directory.
+// Closing a tar target closes its file too.
+func outputTarget(output string) (image.Target, error) {
+	if output == "-" {
+		return image.NewTarTarget(os.Stdout), nil
+	}
+	algo, ok := tarOutput(output)
+	if !ok {
+		return image.NewDirTarget(output)
+	}
+	f, err := os.Create(output)
+	if err != nil {
+		return nil, err
+	}
+	zw, err := compress.NewWriter(f, algo, compress.DefaultOptions)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &tarFileTarget{TarTarget: image.NewTarTarget(zw), closers: []io.Closer{zw, f}}, nil
+}
+
+// tarFileTarget is a tar target writing to a file
+type tarFileTarget struct {
+	*image.TarTarget
+	closers []io.Closer
+}
+
+// Close finishes the tar and closes its file
+func (t *tarFileTarget) Close() error {
+	err := t.TarTarget.Close()
+	for _, c := range t.closers {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// tarOutput returns the compression of a tar output file from its extension
+func tarOutput(output string) (compress.Algorithm, bool) {
+	switch {
+	case strings.HasSuffix(output, ".tar"):
+		return compress.None, true
+	case strings.HasSuffix(output, ".tar.gz"), strings.HasSuffix(output, ".tgz"):
+		return compress.Gzip, true
+	case strings.HasSuffix(output, ".tar.zst"):
+		return compress.Zstd, true
+	}
+	return "", false
+}
+
+// localImage is an image parsed from an archive, a split set or an OCI image layout directory
+type localImage struct {
+	*image.Tar
+	path       string
+	identities []age.Identity
+	// limits bound reading the archive and extracting from it
+	limits image.Limits
+	// isDir is set for directories and indexed for archives whose files are
+	// read by seeking to them using the index saved next to them
+	isDir, indexed bool
+}
+
+// isLocal returns true if path is an archive, split set or directory rather than an image ref
+func isLocal(path string) bool {
+	if _, ok := bundle.SplitIndexPath(path); ok {
+		return true
+	}
+	_, err := os.Stat(path)
+	return !os.IsNotExist(err)
+}
+
+// loadImage parses the archive at path and selects the image picked by --ref and --platform
+func loadImage(cmd *cobra.Command, path string) (*localImage, error) {
+	identities, err := getIdentities(cmd)
+	if err != nil {
+		return nil, err
+	}
+	limits, err := getLimits(cmd)
+	if err != nil {
+		return nil, err
+	}
+	ref, _ := cmd.Flags().GetString("ref")
+	platform, _ := cmd.Flags().GetString("platform")
+
+	li := &localImage{path: path, identities: identities, limits: limits}
+	if _, ok := bundle.SplitIndexPath(path); !ok {
+		fi, err := os.Stat(path)
+		li.isDir = err == nil && fi.IsDir()
+		li.indexed = err == nil && fi.Mode().IsRegular() && !isEncrypted(path)
+	}
+
+	var images []*image.Tar
+	switch {
+	case li.isDir:
+		images, err = image.ParseDir(path, limits)
+	case li.indexed:
+		images, err = image.ParseIndexed(path, limits)
+	default:
+		var f io.ReadCloser
+		if f, err = bundle.Open(path, identities...); err == nil {
+			images, err = image.Parse(bufio.NewReader(f), limits)
+			f.Close()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if li.Tar, err = image.Select(images, image.Selector{Ref: ref, Platform: platform}); err != nil {
+		return nil, err
+	}
+	return li, nil
+}
+
+// fs returns the image's merged filesystem and, when the archive can only be
+// streamed, a function that opens it to read all the files in one pass
+func (li *localImage) fs() (*image.FS, func() (io.ReadCloser, error), error) {
+	switch {
+	case li.isDir:
+		fsys, err := image.NewDirFS(li.Tar, li.path)
+		return fsys, nil, err
+	case li.indexed:
+		fsys, err := image.NewIndexedFS(li.Tar)
+		return fsys, nil, err
+	}
+	open := func() (io.ReadCloser, error) {
+		return bundle.Open(li.path, li.identities...)
+	}
+	fsys, err := image.NewFS(li.Tar, open)
+	return fsys, open, err
+}
+
+// isEncrypted returns true if the file at path is age encrypted
+func isEncrypted(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	header := make([]byte, 64)
+	n, _ := io.ReadFull(f, header)
+	return bundle.IsEncrypted(header[:n])
+}
+
 func init() {
 	rootCmd.AddCommand(extractCmd)
 
@@ -236,4 +499,13 @@ func init() {
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
 	// extractCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	addIdentityFlag(extractCmd)
+	addLimitFlags(extractCmd)
+	extractCmd.Flags().String("ref", "", "image to browse in archives with several (repo tag, OCI ref name or image ID)")
+	extractCmd.Flags().String("platform", "", "platform of the image to browse in archives with several (os/arch[/variant])")
+	extractCmd.Flags().StringArray("path", nil, "file, directory or glob to extract without the UI (can be repeated)")
+	extractCmd.Flags().Int("layer", -1, "index of the layer to extract --path from (default is the merged filesystem)")
+	extractCmd.Flags().StringP("output", "o", ".", "directory or tar (.tar, .tar.gz or .tar.zst) to extract --path to (use - for a single file to stdout)")
+	extractCmd.Flags().Bool("absolute-links", false, "allow extracting symlinks to absolute paths to a directory, which point outside of it unless it is used as a root")
+	extractCmd.Flags().Bool("same-owner", false, "set the owner of files extracted to a directory to their uid and gid in the image (usually needs root)")
 }
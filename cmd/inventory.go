@@ -0,0 +1,134 @@
+/*
+Copyright © 2019 blacktop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/blacktop/graboid/pkg/bundle"
+	"github.com/blacktop/graboid/pkg/registry"
+	"github.com/spf13/cobra"
+)
+
+// inventoryCmd represents the inventory command
+var inventoryCmd = &cobra.Command{
+	Use:   "inventory [archives...]",
+	Short: "Export a bundle index of the blobs a target already has",
+	Long: `Builds a bundle index from existing image archives and/or the images in a
+registry (--ref) to use with 'graboid bundle --since'.`,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		if Verbose {
+			log.SetLevel(log.DebugLevel)
+		}
+		insecure, _ := cmd.Flags().GetBool("insecure")
+		proxy, _ := cmd.Flags().GetString("proxy")
+		refs, _ := cmd.Flags().GetStringSlice("ref")
+		platform, _ := cmd.Flags().GetString("platform")
+		output, _ := cmd.Flags().GetString("output")
+
+		if len(args) == 0 && len(refs) == 0 {
+			return fmt.Errorf("supply image archives and/or --ref images to inventory")
+		}
+
+		identities, err := getIdentities(cmd)
+		if err != nil {
+			return err
+		}
+		index := bundle.NewIndex()
+
+		for _, path := range args {
+			log.WithField("path", path).Info("inventorying archive")
+			idx, err := bundle.Inventory(path, identities...)
+			if err != nil {
+				return fmt.Errorf("%s: %v", path, err)
+			}
+			index.Merge(idx)
+		}
+
+		for _, r := range refs {
+			ref := parseImageRef(r)
+			log.WithField("image", ref.String()).Info("inventorying registry image")
+			reg, err := newRegistry(ref.Name, proxy, insecure)
+			if err != nil {
+				return err
+			}
+			m, err := reg.ReposManifestsForPlatform(ref.Name, ref.Tag, platform)
+			if err != nil {
+				return err
+			}
+			img := bundle.Image{
+				RepoTags: []string{ref.Name + ":" + ref.Tag},
+				Platform: platform,
+				Digest:   m.Digest,
+				Config:   fmt.Sprintf("%s.json", strings.TrimPrefix(m.Config.Digest, "sha256:")),
+			}
+			index.AddBlob(bundle.Blob{
+				Name:      img.Config,
+				Digest:    m.Config.Digest,
+				Size:      int64(m.Config.Size),
+				MediaType: m.Config.MediaType,
+			})
+			for _, layer := range m.Layers {
+				name := fmt.Sprintf("%s.tar", strings.TrimPrefix(layer.Digest, "sha256:"))
+				img.Layers = append(img.Layers, name)
+				index.AddBlob(bundle.Blob{
+					Name:      name,
+					Digest:    layer.Digest,
+					Size:      int64(layer.Size),
+					MediaType: layer.MediaType,
+				})
+			}
+			index.AddImage(img)
+		}
+
+		if output == "-" {
+			err = index.Encode(os.Stdout)
+		} else {
+			err = index.Write(output)
+		}
+		if err != nil {
+			return err
+		}
+		log.WithFields(log.Fields{
+			"images": len(index.Images),
+			"blobs":  len(index.Blobs),
+		}).Infof(getFmtStr(), "SUCCESS!")
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(inventoryCmd)
+
+	inventoryCmd.Flags().String("proxy", "", "HTTP/HTTPS proxy")
+	inventoryCmd.Flags().Bool("insecure", false, "do not verify ssl certs")
+	inventoryCmd.Flags().StringSlice("ref", nil, "registry image to inventory (can be repeated)")
+	inventoryCmd.Flags().String("platform", registry.DefaultPlatform, "platform of the registry images")
+	inventoryCmd.Flags().StringP("output", "o", "inventory.index", "bundle index output file (use - for stdout)")
+	addIdentityFlag(inventoryCmd)
+}
@@ -0,0 +1,116 @@
+/*
+Copyright © 2019 blacktop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/apex/log"
+	"github.com/blacktop/graboid/pkg/bundle"
+	"github.com/spf13/cobra"
+)
+
+// joinCmd represents the join command
+var joinCmd = &cobra.Command{
+	Use:   "join <archive.split.json>",
+	Short: "Verify and reassemble a split archive",
+	Long: `Verifies the checksums of the volumes of an archive written with --split and
+reassembles them. The index, the first volume or the original archive name can be given.`,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		if Verbose {
+			log.SetLevel(log.DebugLevel)
+		}
+		output, _ := cmd.Flags().GetString("output")
+		verifyOnly, _ := cmd.Flags().GetBool("verify")
+
+		indexPath, ok := bundle.SplitIndexPath(args[0])
+		if !ok {
+			indexPath = args[0]
+		}
+		index, err := bundle.ReadSplitIndex(indexPath)
+		if err != nil {
+			return err
+		}
+
+		var out io.WriteCloser
+		var tmp *os.File
+		switch {
+		case verifyOnly:
+			out = nopCloser{ioutil.Discard}
+		case output == "-":
+			out = nopCloser{os.Stdout}
+		default:
+			if len(output) == 0 {
+				output = filepath.Join(filepath.Dir(indexPath), index.Name)
+			}
+			log.WithField("path", output).Info("reassembling archive")
+			// the archive is only put in place once the checksums match
+			if tmp, err = ioutil.TempFile(filepath.Dir(output), "."+filepath.Base(output)+".*"); err != nil {
+				return err
+			}
+			defer os.Remove(tmp.Name())
+			out = tmp
+		}
+
+		err = bundle.Join(indexPath, out)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		if tmp != nil {
+			if err := os.Chmod(tmp.Name(), 0644); err != nil {
+				return err
+			}
+			if err := os.Rename(tmp.Name(), output); err != nil {
+				return err
+			}
+		}
+
+		log.WithFields(log.Fields{
+			"volumes": len(index.Volumes),
+			"sha256":  index.SHA256,
+		}).Infof(getFmtStr(), "VERIFIED")
+
+		return nil
+	},
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+func init() {
+	rootCmd.AddCommand(joinCmd)
+
+	joinCmd.Flags().StringP("output", "o", "", "output file (use - for stdout) (default is the original archive name)")
+	joinCmd.Flags().Bool("verify", false, "only verify the volumes")
+}
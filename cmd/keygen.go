@@ -0,0 +1,110 @@
+/*
+Copyright © 2019 blacktop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/apex/log"
+	"github.com/blacktop/graboid/pkg/minisign"
+	"github.com/spf13/cobra"
+)
+
+// keyPasswordEnv is the environment variable holding the password of an encrypted secret key
+const keyPasswordEnv = "GRABOID_KEY_PASSWORD"
+
+func readSignKey(path string) (*minisign.PrivateKey, error) {
+	sk, err := minisign.ReadPrivateKey(path, os.Getenv(keyPasswordEnv))
+	if err == minisign.ErrPasswordRequired {
+		return nil, fmt.Errorf("%s: %v (set $%s)", path, err, keyPasswordEnv)
+	}
+	return sk, err
+}
+
+// keygenCmd represents the keygen command
+var keygenCmd = &cobra.Command{
+	Use:   "keygen",
+	Short: "Generate a key pair for signing transfer manifests",
+	Long: `Generates a minisign compatible ed25519 key pair for signing the transfer manifests
+written next to every archive (--sign-key) and verifying them with 'graboid verify-bundle'.
+
+The secret key is encrypted when $` + keyPasswordEnv + ` is set.`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		if Verbose {
+			log.SetLevel(log.DebugLevel)
+		}
+		output, _ := cmd.Flags().GetString("output")
+		force, _ := cmd.Flags().GetBool("force")
+
+		pubPath, keyPath := output+".pub", output+".key"
+		if !force {
+			for _, path := range []string{pubPath, keyPath} {
+				if _, err := os.Stat(path); err == nil {
+					return fmt.Errorf("%s already exists (use --force to overwrite it)", path)
+				}
+			}
+		}
+
+		sk, err := minisign.GenerateKey()
+		if err != nil {
+			return err
+		}
+		password := os.Getenv(keyPasswordEnv)
+		if len(password) == 0 {
+			log.Warnf("$%s is not set, the secret key will not be encrypted", keyPasswordEnv)
+		}
+		skData, err := sk.Marshal(password)
+		if err != nil {
+			return err
+		}
+		pkData, err := sk.Public().MarshalText()
+		if err != nil {
+			return err
+		}
+
+		if err := ioutil.WriteFile(keyPath, skData, 0600); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(pubPath, pkData, 0644); err != nil {
+			return err
+		}
+
+		log.WithFields(log.Fields{
+			"key_id": sk.ID.String(),
+			"secret": keyPath,
+			"public": pubPath,
+		}).Info("generated key pair")
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(keygenCmd)
+
+	keygenCmd.Flags().StringP("output", "o", "graboid", "key pair file name prefix (writes <output>.key and <output>.pub)")
+	keygenCmd.Flags().BoolP("force", "f", false, "overwrite an existing key pair")
+}
@@ -0,0 +1,130 @@
+/*
+Copyright © 2019 blacktop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/apex/log"
+	"github.com/blacktop/graboid/pkg/image"
+	"github.com/blacktop/graboid/pkg/registry"
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+)
+
+// layerInfo is a layer as it is listed by the layers command
+type layerInfo struct {
+	Index     int            `json:"index"`
+	Digest    string         `json:"digest"`
+	DiffID    string         `json:"diff_id"`
+	MediaType string         `json:"media_type"`
+	Size      int64          `json:"size"`
+	CreatedBy string         `json:"created_by,omitempty"`
+	Changes   *image.Changes `json:"changes,omitempty"`
+}
+
+// layersCmd represents the layers command
+var layersCmd = &cobra.Command{
+	Use:   "layers <archive|image>",
+	Short: "List an image's layers and what they change",
+	Long: `Lists the layers of an image read from an archive, a split set or an OCI image layout,
+or pulled straight from the registry. With --changes each layer also lists the files it
+adds, the files it modifies (compared with the lower layers by type, mode, owner, link
+target, size and contents) and the files it removes with whiteouts or opaque directories.`,
+	Example: `  graboid layers alpine.tar.gz
+  graboid layers myapp:1.0 --changes
+  graboid layers image.tar.gz --changes --json | jq '.[].changes.removed'`,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		if Verbose {
+			log.SetLevel(log.DebugLevel)
+		}
+		changes, _ := cmd.Flags().GetBool("changes")
+		asJSON, _ := cmd.Flags().GetBool("json")
+
+		li, cleanup, err := openImage(cmd, args[0])
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+
+		var layers []layerInfo
+		for _, layer := range li.Layers {
+			info := layerInfo{
+				Index:     layer.Index(),
+				Digest:    layer.Digest(),
+				DiffID:    layer.DiffID(),
+				MediaType: layer.MediaType(),
+				Size:      layer.UncompressedSize(),
+				CreatedBy: layer.Command(),
+			}
+			if changes {
+				if info.Changes, err = layer.Changes(); err != nil {
+					return err
+				}
+			}
+			layers = append(layers, info)
+		}
+
+		if asJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(layers)
+		}
+
+		log.WithField("image", li.String()).Infof(getFmtStr(), "Layers")
+		for _, layer := range layers {
+			Indent(log.Info, 1)(fmt.Sprintf("%d: %s %s %s", layer.Index, layer.Digest, humanize.Bytes(uint64(layer.Size)), layer.CreatedBy))
+			if layer.Changes == nil {
+				continue
+			}
+			for _, p := range layer.Changes.Added {
+				Indent(log.Info, 2)("A " + p)
+			}
+			for _, p := range layer.Changes.Modified {
+				Indent(log.Info, 2)("M " + p)
+			}
+			for _, p := range layer.Changes.Removed {
+				Indent(log.Info, 2)("D " + p)
+			}
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(layersCmd)
+
+	layersCmd.Flags().Bool("changes", false, "list the files each layer adds, modifies and removes")
+	layersCmd.Flags().Bool("json", false, "print the layers as JSON")
+	layersCmd.Flags().String("ref", "", "image to list from archives with several (repo tag, OCI ref name or image ID)")
+	layersCmd.Flags().String("platform", "", "platform of the image (os/arch[/variant], default is "+registry.DefaultPlatform+" when pulling)")
+	layersCmd.Flags().String("proxy", "", "HTTP/HTTPS proxy")
+	layersCmd.Flags().Bool("insecure", false, "do not verify ssl certs")
+	addDecryptionFlags(layersCmd, false)
+	addIdentityFlag(layersCmd)
+	addLimitFlags(layersCmd)
+}
@@ -0,0 +1,454 @@
+/*
+Copyright © 2019 blacktop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/blacktop/graboid/pkg/bundle"
+	"github.com/blacktop/graboid/pkg/compress"
+	"github.com/blacktop/graboid/pkg/image"
+	"github.com/blacktop/graboid/pkg/registry"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+)
+
+const pullNameTemplate = `{{.Name}}_{{.Tag}}_{{replace "/" "-" .Platform}}.tar{{.Ext}}`
+
+// pullJob is a single image/platform to pull
+type pullJob struct {
+	Ref      imageRef
+	Platform string
+}
+
+// pulledImage is an image whose blobs have been downloaded to the cache
+type pulledImage struct {
+	pullJob
+	Manifest *registry.Manifests
+	Config   []byte
+	Image    *image.Image
+	Registry string
+	Pulled   time.Time
+	fetch    blobFetcher
+
+	Output string
+	Err    error
+}
+
+// imageList is the YAML image list file format
+type imageList struct {
+	Platforms []string         `yaml:"platforms,omitempty"`
+	Images    []imageListEntry `yaml:"images"`
+}
+
+type imageListEntry struct {
+	Ref       string   `yaml:"ref"`
+	Platforms []string `yaml:"platforms,omitempty"`
+}
+
+// UnmarshalYAML allows image list entries to be a plain ref string
+func (e *imageListEntry) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&e.Ref); err == nil {
+		return nil
+	}
+	type entry imageListEntry
+	return unmarshal((*entry)(e))
+}
+
+// readImageList reads an image list file of `ref [platform,...]` lines or YAML
+func readImageList(path string) ([]imageListEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yml", ".yaml":
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			return nil, err
+		}
+		var list imageList
+		if err := yaml.UnmarshalStrict(data, &list); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+		}
+		for i := range list.Images {
+			if len(list.Images[i].Platforms) == 0 {
+				list.Images[i].Platforms = list.Platforms
+			}
+		}
+		return list.Images, nil
+	}
+
+	var entries []imageListEntry
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := scanner.Text()
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = line[:idx]
+		}
+		fields := strings.Fields(line)
+		switch len(fields) {
+		case 0:
+			continue
+		case 1:
+			entries = append(entries, imageListEntry{Ref: fields[0]})
+		case 2:
+			entries = append(entries, imageListEntry{Ref: fields[0], Platforms: strings.Split(fields[1], ",")})
+		default:
+			return nil, fmt.Errorf("%s:%d: expected `ref [platform,...]`", path, lineNum)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// pullJobs expands image list entries into a job per platform
+func pullJobs(entries []imageListEntry, platforms []string) ([]pullJob, error) {
+	var jobs []pullJob
+	seen := make(map[pullJob]bool)
+	for _, entry := range entries {
+		if len(entry.Ref) == 0 {
+			return nil, fmt.Errorf("image list entry is missing a ref")
+		}
+		plats := entry.Platforms
+		if len(plats) == 0 {
+			plats = platforms
+		}
+		for _, platform := range plats {
+			if _, err := registry.ParsePlatform(platform); err != nil {
+				return nil, fmt.Errorf("%s: %v", entry.Ref, err)
+			}
+			job := pullJob{Ref: parseImageRef(entry.Ref), Platform: platform}
+			if !seen[job] {
+				seen[job] = true
+				jobs = append(jobs, job)
+			}
+		}
+	}
+	return jobs, nil
+}
+
+// pullOptions are the options shared by every pull in a batch
+type pullOptions struct {
+	Cache    *registry.Cache
+	Proxy    string
+	Insecure bool
+	Decrypt  decryptOptions
+	// Convert recompresses layers with this algorithm when set
+	Convert compress.Algorithm
+}
+
+// pullToCache downloads an image's config and layers into the blob cache
+// decrypting any encrypted layers unless they are kept encrypted and
+// converting them when requested
+func pullToCache(job pullJob, opts *pullOptions) (*pulledImage, error) {
+	reg, err := newRegistry(job.Ref.Name, opts.Proxy, opts.Insecure)
+	if err != nil {
+		return nil, err
+	}
+	m, err := reg.ReposManifestsForPlatform(job.Ref.Name, job.Ref.Tag, job.Platform)
+	if err != nil {
+		return nil, err
+	}
+
+	pulled := time.Now()
+	fetch := cacheFetcher(opts.Cache, reg, job.Ref.Name)
+	config, conf, err := getConfig(fetch, m)
+	if err != nil {
+		return nil, err
+	}
+	for _, layer := range m.Layers {
+		body, err := fetch(layer.Digest, layer.MediaType, layer.Size)
+		if err != nil {
+			return nil, err
+		}
+		body.Close()
+	}
+	if !opts.Decrypt.KeepEncrypted {
+		if m, err = decryptLayers(m, fetch, opts.Cache, opts.Decrypt.Keys); err != nil {
+			return nil, err
+		}
+	}
+	if m, config, err = convertLayers(m, config, fetch, opts.Cache, opts.Convert); err != nil {
+		return nil, err
+	}
+
+	return &pulledImage{
+		pullJob:  job,
+		Manifest: m,
+		Config:   config,
+		Image:    conf,
+		Registry: reg.URL.Host,
+		Pulled:   pulled,
+		fetch:    fetch,
+	}, nil
+}
+
+// pullAll pulls the jobs into the cache with up to concurrency pulls at a time
+// and calls done with each image as it finishes
+func pullAll(jobs []pullJob, concurrency int, opts *pullOptions, done func(*pulledImage)) []*pulledImage {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	results := make([]*pulledImage, len(jobs))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	for i, job := range jobs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, job pullJob) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			log.WithFields(log.Fields{
+				"image":    job.Ref.String(),
+				"platform": job.Platform,
+			}).Info("pulling")
+
+			img, err := pullToCache(job, opts)
+			if err != nil {
+				img = &pulledImage{pullJob: job, Err: err}
+				log.WithError(err).WithField("image", job.Ref.String()).Error("pull failed")
+			} else if done != nil {
+				done(img)
+			}
+			results[i] = img
+		}(i, job)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// writeCombined writes all of the successfully pulled images to a single archive
+// leaving out the excluded files
+func writeCombined(output string, opts *archiveOptions, images []*pulledImage, exclude ...string) error {
+	var pulled []*pulledImage
+	sources := make(map[string]bundle.Source)
+	for _, img := range images {
+		if img.Err == nil {
+			pulled = append(pulled, img)
+			blobSources(sources, img.Ref, img.Manifest, img.Pulled)
+		}
+	}
+	if len(pulled) == 0 {
+		return nil
+	}
+
+	if err := createArchive(output, opts, sources, func(w *image.Writer) error {
+		w.Exclude(exclude...)
+		for _, img := range pulled {
+			if err := writeImage(w, img.Ref, img.Manifest, img.Config, img.fetch); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, img := range pulled {
+		img.Output = output
+	}
+	return nil
+}
+
+func printPullSummary(w io.Writer, images []*pulledImage) int {
+	failed := 0
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "IMAGE\tPLATFORM\tSTATUS\tDETAILS")
+	for _, img := range images {
+		if img.Err != nil {
+			failed++
+			fmt.Fprintf(tw, "%s\t%s\tFAILED\t%v\n", img.Ref, img.Platform, img.Err)
+			continue
+		}
+		details := img.Manifest.Digest
+		if len(img.Output) > 0 {
+			details = img.Output
+		}
+		fmt.Fprintf(tw, "%s\t%s\tOK\t%s\n", img.Ref, img.Platform, details)
+	}
+	tw.Flush()
+	return failed
+}
+
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "graboid")
+	}
+	return filepath.Join(dir, "graboid")
+}
+
+// pullCmd represents the pull command
+var pullCmd = &cobra.Command{
+	Use:          "pull [images...]",
+	SilenceUsage: true,
+	Short:        "Pull a batch of images",
+	Long: `Concurrently pulls a list of images into a shared blob cache and writes them
+out as one archive per image or as a single combined archive.
+
+The image list file (-f) has one 'ref [platform,...]' per line, or is YAML:
+
+  platforms: [linux/amd64]
+  images:
+    - alpine:3.14
+    - ref: ubuntu:20.04
+      platforms: [linux/amd64, linux/arm64]`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		if Verbose {
+			log.SetLevel(log.DebugLevel)
+		}
+		insecure, _ := cmd.Flags().GetBool("insecure")
+		proxy, _ := cmd.Flags().GetString("proxy")
+		listFile, _ := cmd.Flags().GetString("file")
+		platforms, _ := cmd.Flags().GetStringSlice("platform")
+		concurrency, _ := cmd.Flags().GetInt("concurrency")
+		cacheDir, _ := cmd.Flags().GetString("cache")
+		combined, _ := cmd.Flags().GetBool("combined")
+		output, _ := cmd.Flags().GetString("output")
+		nameTemplate, _ := cmd.Flags().GetString("name-template")
+
+		opts, err := getArchiveOptions(cmd)
+		if err != nil {
+			return err
+		}
+		dopts, err := getDecryptOptions(cmd)
+		if err != nil {
+			return err
+		}
+		if dopts.KeepEncrypted && opts.Format != image.FormatOCI {
+			return fmt.Errorf("--keep-encrypted requires --format oci")
+		}
+		convert, err := getConvertLayers(cmd)
+		if err != nil {
+			return err
+		}
+
+		var entries []imageListEntry
+		for _, arg := range args {
+			entries = append(entries, imageListEntry{Ref: arg})
+		}
+		if len(listFile) > 0 {
+			list, err := readImageList(listFile)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, list...)
+		}
+		jobs, err := pullJobs(entries, platforms)
+		if err != nil {
+			return err
+		}
+		if len(jobs) == 0 {
+			return fmt.Errorf("no images to pull (supply images as arguments or with --file)")
+		}
+		if combined && len(output) == 0 {
+			output = "images.tar" + opts.Ext()
+		}
+
+		cache, err := registry.NewCache(cacheDir)
+		if err != nil {
+			return err
+		}
+
+		writeOne := func(img *pulledImage) {
+			if combined {
+				return
+			}
+			out, err := outputPath(output, nameTemplate, outputName{
+				Registry: img.Registry,
+				Repo:     img.Ref.Name,
+				Name:     strings.Replace(img.Ref.Name, "/", "_", 1),
+				Tag:      img.Ref.Tag,
+				Digest:   strings.TrimPrefix(img.Manifest.Digest, "sha256:"),
+				Platform: img.Image.Platform(),
+				Ext:      opts.Ext(),
+			})
+			if err == nil {
+				err = createArchive(out, opts, blobSources(nil, img.Ref, img.Manifest, img.Pulled), func(w *image.Writer) error {
+					return writeImage(w, img.Ref, img.Manifest, img.Config, img.fetch)
+				})
+			}
+			if err != nil {
+				img.Err = err
+				return
+			}
+			img.Output = out
+		}
+
+		images := pullAll(jobs, concurrency, &pullOptions{
+			Cache:    cache,
+			Proxy:    proxy,
+			Insecure: insecure,
+			Decrypt:  *dopts,
+			Convert:  convert,
+		}, writeOne)
+
+		if combined {
+			if err := writeCombined(output, opts, images); err != nil {
+				return err
+			}
+		}
+
+		fmt.Fprintln(os.Stderr)
+		if failed := printPullSummary(os.Stderr, images); failed > 0 {
+			return fmt.Errorf("%d of %d images failed to pull", failed, len(images))
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(pullCmd)
+
+	pullCmd.Flags().String("proxy", "", "HTTP/HTTPS proxy")
+	pullCmd.Flags().Bool("insecure", false, "do not verify ssl certs")
+	pullCmd.Flags().StringP("file", "f", "", "image list file (text or YAML)")
+	pullCmd.Flags().StringSlice("platform", []string{registry.DefaultPlatform}, "platforms to pull for images without one in the list")
+	pullCmd.Flags().IntP("concurrency", "j", 4, "number of images to pull at once")
+	pullCmd.Flags().String("cache", defaultCacheDir(), "shared blob cache directory")
+	pullCmd.Flags().Bool("combined", false, "write all images to a single archive")
+	addOutputFlags(pullCmd, pullNameTemplate)
+	addDecryptionFlags(pullCmd, true)
+	addConvertFlag(pullCmd)
+}
@@ -22,9 +22,8 @@ THE SOFTWARE.
 package cmd
 
 import (
-	"archive/tar"
-	"compress/gzip"
-	"encoding/json"
+	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -32,14 +31,23 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"text/template"
+	"time"
 
 	"github.com/spf13/cobra"
 
+	"filippo.io/age"
 	"github.com/apex/log"
 	clihander "github.com/apex/log/handlers/cli"
+	"github.com/blacktop/graboid/pkg/bundle"
+	"github.com/blacktop/graboid/pkg/compress"
 	"github.com/blacktop/graboid/pkg/image"
+	"github.com/blacktop/graboid/pkg/minisign"
+	"github.com/blacktop/graboid/pkg/registry"
+	"github.com/dustin/go-humanize"
 	homedir "github.com/mitchellh/go-homedir"
 	"github.com/spf13/viper"
+	pb "gopkg.in/cheggaaa/pb.v1"
 )
 
 var (
@@ -63,74 +71,489 @@ func getFmtStr() string {
 	return "\033[1m%s\033[0m"
 }
 
-func createManifest(tempDir, confFile string, layerFiles []string) (string, error) {
-	var manifestArray []image.Manifest
-	// Create the file
-	tmpfn := filepath.Join(tempDir, "manifest.json")
-	out, err := os.Create(tmpfn)
+const defaultNameTemplate = "{{.Name}}_{{.Tag}}.tar{{.Ext}}"
+
+// outputName is the data available to the --name-template
+type outputName struct {
+	Registry string
+	Repo     string
+	Name     string
+	Tag      string
+	Digest   string
+	Platform string
+	Ext      string
+}
+
+func outputPath(output, nameTemplate string, data outputName) (string, error) {
+	if output == "-" {
+		return output, nil
+	}
+
+	tmpl, err := template.New("name").Funcs(template.FuncMap{
+		"replace": func(old, new, s string) string {
+			return strings.ReplaceAll(s, old, new)
+		},
+		"trunc": func(n int, s string) string {
+			if len(s) > n {
+				return s[:n]
+			}
+			return s
+		},
+	}).Parse(nameTemplate)
 	if err != nil {
-		log.WithError(err).Error("create manifest JSON failed")
+		return "", fmt.Errorf("bad name template: %v", err)
+	}
+	var name strings.Builder
+	if err := tmpl.Execute(&name, data); err != nil {
+		return "", fmt.Errorf("bad name template: %v", err)
 	}
-	defer out.Close()
 
-	m := image.Manifest{
-		Config:   confFile,
-		Layers:   layerFiles,
-		RepoTags: []string{ImageName + ":" + ImageTag},
+	if len(output) == 0 {
+		return name.String(), nil
 	}
-	manifestArray = append(manifestArray, m)
-	mJSON, err := json.Marshal(manifestArray)
-	if err != nil {
-		log.WithError(err).Error("marshalling manifest JSON failed")
+	if fi, err := os.Stat(output); (err == nil && fi.IsDir()) || strings.HasSuffix(output, string(os.PathSeparator)) {
+		return filepath.Join(output, name.String()), nil
 	}
-	// Write the body to JSON file
-	_, err = out.Write(mJSON)
+	return output, nil
+}
+
+func compressOptions(cmd *cobra.Command) (compress.Options, error) {
+	level, _ := cmd.Flags().GetInt("level")
+	blockSize, _ := cmd.Flags().GetString("block-size")
+	workers, _ := cmd.Flags().GetInt("workers")
+
+	bs, err := humanize.ParseBytes(blockSize)
 	if err != nil {
-		log.WithError(err).Error("writing manifest JSON failed")
+		return compress.Options{}, fmt.Errorf("bad block size: %v", err)
 	}
 
-	return tmpfn, nil
+	return compress.Options{
+		Level:     level,
+		BlockSize: int(bs),
+		Workers:   workers,
+	}, nil
 }
 
-func tarFiles(srcDir, tarName string) error {
-	tarfile, err := os.Create(tarName)
+// imageRef is a parsed docker image reference
+type imageRef struct {
+	Name string
+	Tag  string
+}
+
+func parseImageRef(ref string) imageRef {
+	var r imageRef
+	if idx := strings.Index(ref, "@"); idx > 0 {
+		r.Name, r.Tag = ref[:idx], ref[idx+1:]
+	} else if idx := strings.LastIndex(ref, ":"); idx > strings.LastIndex(ref, "/") {
+		r.Name, r.Tag = ref[:idx], ref[idx+1:]
+	} else {
+		r.Name, r.Tag = ref, "latest"
+	}
+	// test for official image name
+	if !strings.Contains(r.Name, "/") {
+		r.Name = "library/" + r.Name
+	}
+	return r
+}
+
+func (r imageRef) String() string {
+	if strings.HasPrefix(r.Tag, "sha256:") {
+		return r.Name + "@" + r.Tag
+	}
+	return r.Name + ":" + r.Tag
+}
+
+// blobFetcher returns a reader for an image blob
+type blobFetcher func(digest, mediaType string, size int) (io.ReadCloser, error)
+
+type progressReadCloser struct {
+	io.Reader
+	body io.Closer
+	bar  *pb.ProgressBar
+}
+
+func (p *progressReadCloser) Close() error {
+	p.bar.Finish()
+	return p.body.Close()
+}
+
+// registryFetcher streams blobs straight from the registry
+func registryFetcher(reg *registry.Registry, repo string, progress bool) blobFetcher {
+	return func(digest, mediaType string, size int) (io.ReadCloser, error) {
+		body, err := reg.RepoGetBlob(repo, digest, mediaType)
+		if err != nil {
+			return nil, err
+		}
+		if !progress {
+			return body, nil
+		}
+		bar := registry.NewProgressBar(size)
+		bar.Start()
+		return &progressReadCloser{Reader: bar.NewProxyReader(body), body: body, bar: bar}, nil
+	}
+}
+
+// cacheFetcher reads blobs from the cache, downloading them from the registry when missing
+func cacheFetcher(cache *registry.Cache, reg *registry.Registry, repo string) blobFetcher {
+	return func(digest, mediaType string, size int) (io.ReadCloser, error) {
+		path, err := cache.Get(digest, int64(size), func() (io.ReadCloser, error) {
+			log.WithField("digest", digest).Debug("downloading blob")
+			return reg.RepoGetBlob(repo, digest, mediaType)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return os.Open(path)
+	}
+}
+
+func getConfig(fetch blobFetcher, manifest *registry.Manifests) ([]byte, *image.Image, error) {
+	body, err := fetch(manifest.Config.Digest, manifest.Config.MediaType, manifest.Config.Size)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	defer tarfile.Close()
+	defer body.Close()
 
-	gw := gzip.NewWriter(tarfile)
-	defer gw.Close()
-	tarball := tar.NewWriter(gw)
-	defer tarball.Close()
+	rawJSON, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	conf, err := image.NewFromJSON(rawJSON)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rawJSON, conf, nil
+}
 
-	return filepath.Walk(srcDir,
-		func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
+func writeImage(w *image.Writer, ref imageRef, manifest *registry.Manifests, config []byte, fetch blobFetcher) error {
+	if w.Format() == image.FormatOCI {
+		return writeOCIImage(w, ref, manifest, config, fetch)
+	}
+
+	confFile := fmt.Sprintf("%s.json", strings.TrimPrefix(manifest.Config.Digest, "sha256:"))
+	if err := w.WriteFile(confFile, int64(len(config)), bytes.NewReader(config)); err != nil {
+		return fmt.Errorf("writing config failed: %v", err)
+	}
+
+	var layerFiles []string
+	for _, layer := range manifest.Layers {
+		layerFile := fmt.Sprintf("%s.tar", strings.TrimPrefix(layer.Digest, "sha256:"))
+		layerFiles = append(layerFiles, layerFile)
+		if w.Has(layerFile) {
+			continue
+		}
+		body, err := fetch(layer.Digest, layer.MediaType, layer.Size)
+		if err != nil {
+			return err
+		}
+		err = w.WriteFile(layerFile, int64(layer.Size), body)
+		body.Close()
+		if err != nil {
+			return fmt.Errorf("writing layer %s failed: %v", layer.Digest, err)
+		}
+	}
+
+	w.AddManifest(image.Manifest{
+		Config:   confFile,
+		Layers:   layerFiles,
+		RepoTags: []string{ref.Name + ":" + ref.Tag},
+	})
+
+	return nil
+}
+
+// writeOCIImage writes an image's manifest, config and layers as is to an OCI image layout
+func writeOCIImage(w *image.Writer, ref imageRef, manifest *registry.Manifests, config []byte, fetch blobFetcher) error {
+	if err := w.WriteFile(image.BlobPath(manifest.Config.Digest), int64(len(config)), bytes.NewReader(config)); err != nil {
+		return fmt.Errorf("writing config failed: %v", err)
+	}
+
+	for _, layer := range manifest.Layers {
+		layerFile := image.BlobPath(layer.Digest)
+		if w.Has(layerFile) {
+			continue
+		}
+		body, err := fetch(layer.Digest, layer.MediaType, layer.Size)
+		if err != nil {
+			return err
+		}
+		err = w.WriteFile(layerFile, int64(layer.Size), body)
+		body.Close()
+		if err != nil {
+			return fmt.Errorf("writing layer %s failed: %v", layer.Digest, err)
+		}
+	}
+
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(manifest.Raw))
+	if err := w.WriteFile(image.BlobPath(digest), int64(len(manifest.Raw)), bytes.NewReader(manifest.Raw)); err != nil {
+		return fmt.Errorf("writing manifest failed: %v", err)
+	}
+
+	desc := image.Descriptor{
+		MediaType: manifest.MediaType,
+		Digest:    digest,
+		Size:      int64(len(manifest.Raw)),
+		Annotations: map[string]string{
+			image.AnnotationImageName: ref.String(),
+		},
+	}
+	if len(desc.MediaType) == 0 {
+		desc.MediaType = registry.MediaTypeOCIManifest
+	}
+	if !strings.HasPrefix(ref.Tag, "sha256:") {
+		desc.Annotations[image.AnnotationRefName] = ref.Tag
+	}
+	if conf, err := image.NewFromJSON(config); err == nil {
+		desc.Platform = &image.OCIPlatform{
+			Architecture: conf.Architecture,
+			OS:           conf.OS,
+			Variant:      conf.Variant,
+		}
+	}
+	w.AddIndexManifest(desc)
+
+	return nil
+}
+
+// archiveOptions are the options for writing image archives
+type archiveOptions struct {
+	Format    image.Format
+	Algorithm compress.Algorithm
+	Compress  compress.Options
+	// Split is the maximum volume size when greater than zero
+	Split int64
+	// SignKey signs the archive's transfer manifest when set
+	SignKey *minisign.PrivateKey
+	// Recipients the archive is encrypted to
+	Recipients []age.Recipient
+}
+
+// Ext returns the archive's file extension after .tar
+func (o *archiveOptions) Ext() string {
+	if len(o.Recipients) > 0 {
+		return o.Algorithm.Ext() + bundle.EncryptedExt
+	}
+	return o.Algorithm.Ext()
+}
+
+func getArchiveOptions(cmd *cobra.Command) (*archiveOptions, error) {
+	format, _ := cmd.Flags().GetString("format")
+	compression, _ := cmd.Flags().GetString("compression")
+	signKey, _ := cmd.Flags().GetString("sign-key")
+	recipients, _ := cmd.Flags().GetStringSlice("recipient")
+	recipientFiles, _ := cmd.Flags().GetStringSlice("recipients-file")
+
+	var opts archiveOptions
+	var err error
+	if opts.Format, err = image.ParseFormat(format); err != nil {
+		return nil, err
+	}
+	if opts.Algorithm, err = compress.ParseAlgorithm(compression); err != nil {
+		return nil, err
+	}
+	if opts.Compress, err = compressOptions(cmd); err != nil {
+		return nil, err
+	}
+	if opts.Split, err = splitSize(cmd); err != nil {
+		return nil, err
+	}
+	if len(signKey) > 0 {
+		if opts.SignKey, err = readSignKey(signKey); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Recipients, err = bundle.ParseRecipients(recipients, recipientFiles); err != nil {
+		return nil, err
+	}
+	return &opts, nil
+}
+
+func getIdentities(cmd *cobra.Command) ([]age.Identity, error) {
+	files, _ := cmd.Flags().GetStringSlice("identity")
+	return bundle.ReadIdentities(files)
+}
+
+// blobSources adds where each of an image's blobs was pulled from to sources (keyed by digest)
+func blobSources(sources map[string]bundle.Source, ref imageRef, manifest *registry.Manifests, pulled time.Time) map[string]bundle.Source {
+	if sources == nil {
+		sources = make(map[string]bundle.Source)
+	}
+	src := bundle.Source{Ref: ref.String(), Pulled: pulled}
+	digests := []string{manifest.Digest, manifest.Config.Digest}
+	for _, layer := range manifest.Layers {
+		digests = append(digests, layer.Digest)
+	}
+	for _, digest := range digests {
+		if _, ok := sources[digest]; !ok {
+			sources[digest] = src
+		}
+	}
+	return sources
+}
 
-			header, err := tar.FileInfoHeader(info, info.Name())
+// createArchive creates an image archive at output (or stdout) and writes images to it with write.
+// A (signed) transfer manifest listing every file in the archive and its source is written next to it.
+func createArchive(output string, opts *archiveOptions, sources map[string]bundle.Source, write func(w *image.Writer) error) error {
+	var out io.WriteCloser
+	if output == "-" {
+		if opts.Split > 0 {
+			return fmt.Errorf("cannot split an archive written to stdout")
+		}
+		if opts.SignKey != nil {
+			return fmt.Errorf("cannot sign an archive written to stdout")
+		}
+		out = os.Stdout
+	} else {
+		if runtime.GOOS == "windows" {
+			log.Infof("%s: %s", "CREATE docker image tarball", output)
+		} else {
+			log.Infof("\033[1m%s:\033[0m \033[34m%s\033[0m", "CREATE docker image tarball", output)
+		}
+		if err := os.MkdirAll(filepath.Dir(output), 0755); err != nil {
+			return err
+		}
+		if opts.Split > 0 {
+			sw, err := bundle.NewSplitWriter(output, opts.Split)
 			if err != nil {
 				return err
 			}
-			if err = tarball.WriteHeader(header); err != nil {
+			out = sw
+		} else {
+			f, err := os.Create(output)
+			if err != nil {
 				return err
 			}
+			out = f
+		}
+	}
 
-			if info.IsDir() {
-				return nil
-			}
-
-			log.WithField("path", path).Debug("taring file")
-			file, err := os.Open(path)
-			if err != nil {
+	total := sha256.New()
+	var size byteCounter
+	var files []image.File
+	err := func() error {
+		var ew io.WriteCloser = nopCloser{io.MultiWriter(out, total, &size)}
+		if len(opts.Recipients) > 0 {
+			var err error
+			if ew, err = bundle.NewEncryptWriter(ew, opts.Recipients...); err != nil {
 				return err
 			}
-			defer file.Close()
-			_, err = io.Copy(tarball, file)
+		}
+		cw, err := compress.NewWriter(ew, opts.Algorithm, opts.Compress)
+		if err != nil {
 			return err
-		})
+		}
+		w := image.NewFormatWriter(cw, opts.Format)
+		if err := write(w); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		files = w.Files()
+		if err := cw.Close(); err != nil {
+			return err
+		}
+		return ew.Close()
+	}()
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && output != "-" {
+		manifest := bundle.NewTransferManifest(output, files, sources)
+		manifest.Size = int64(size)
+		manifest.SHA256 = fmt.Sprintf("%x", total.Sum(nil))
+		err = manifest.Write(output+bundle.TransferManifestExt, opts.SignKey)
+	}
+	if err != nil && output != "-" {
+		os.Remove(output)
+		os.Remove(output + bundle.TransferManifestExt)
+		os.Remove(output + bundle.TransferManifestExt + bundle.SignatureExt)
+		if opts.Split > 0 {
+			volumes, _ := filepath.Glob(output + ".[0-9][0-9][0-9]")
+			for _, volume := range volumes {
+				os.Remove(volume)
+			}
+			os.Remove(output + bundle.SplitIndexExt)
+		}
+	}
+	return err
+}
+
+// byteCounter counts the bytes written to it
+type byteCounter int64
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+func splitSize(cmd *cobra.Command) (int64, error) {
+	split, _ := cmd.Flags().GetString("split")
+	if len(split) == 0 {
+		return 0, nil
+	}
+	size, err := humanize.ParseBytes(split)
+	if err != nil {
+		return 0, fmt.Errorf("bad split size: %v", err)
+	}
+	return int64(size), nil
+}
+
+func addCompressionFlags(cmd *cobra.Command) {
+	cmd.Flags().StringP("compression", "c", "gzip", "output compression (none, gzip or zstd)")
+	cmd.Flags().Int("level", -1, "output compression level (-1 is the default for the algorithm)")
+	cmd.Flags().String("block-size", "1MiB", "gzip block size compressed by each worker")
+	cmd.Flags().Int("workers", 0, "number of compression workers (default is one per CPU)")
+}
+
+// addArchiveFlags adds the flags read by getArchiveOptions
+func addArchiveFlags(cmd *cobra.Command) {
+	addCompressionFlags(cmd)
+	cmd.Flags().String("split", "", "split the output into numbered volumes of at most this size (i.e. 4G)")
+	cmd.Flags().StringSliceP("recipient", "r", nil, "encrypt the output to an age X25519 recipient (age1...) (can be repeated)")
+	cmd.Flags().StringSliceP("recipients-file", "R", nil, "encrypt the output to the age recipients listed in a file (can be repeated)")
+	cmd.Flags().String("sign-key", "", "minisign or PEM ed25519 secret key to sign the transfer manifest with (password in $"+keyPasswordEnv+")")
+}
+
+// addIdentityFlag adds the flag read by getIdentities
+func addIdentityFlag(cmd *cobra.Command) {
+	cmd.Flags().StringSliceP("identity", "i", nil, "age identity file to decrypt encrypted archives with (can be repeated)")
+}
+
+// addLimitFlags adds the flags read by getLimits
+func addLimitFlags(cmd *cobra.Command) {
+	limits := image.DefaultLimits()
+	cmd.Flags().String("max-size", humanize.IBytes(uint64(limits.MaxBytes)), "most bytes decompressed from the archive or one of its layers, or extracted (0 is unlimited)")
+	cmd.Flags().Int("max-entries", limits.MaxEntries, "most entries in the archive or one of its layers, or files extracted (0 is unlimited)")
+	cmd.Flags().Int("max-depth", limits.MaxDepth, "most path elements of a file in a layer (0 is unlimited)")
+	cmd.Flags().String("max-json-size", humanize.IBytes(uint64(limits.MaxJSONSize)), "largest manifest, index or config read (0 is unlimited)")
+}
+
+// getLimits returns the limits of reading untrusted archives set by the flags added by addLimitFlags
+func getLimits(cmd *cobra.Command) (image.Limits, error) {
+	maxSize, _ := cmd.Flags().GetString("max-size")
+	maxJSONSize, _ := cmd.Flags().GetString("max-json-size")
+
+	var limits image.Limits
+	limits.MaxEntries, _ = cmd.Flags().GetInt("max-entries")
+	limits.MaxDepth, _ = cmd.Flags().GetInt("max-depth")
+	size, err := humanize.ParseBytes(maxSize)
+	if err != nil {
+		return image.Limits{}, fmt.Errorf("bad max size: %v", err)
+	}
+	limits.MaxBytes = int64(size)
+	if size, err = humanize.ParseBytes(maxJSONSize); err != nil {
+		return image.Limits{}, fmt.Errorf("bad max JSON size: %v", err)
+	}
+	limits.MaxJSONSize = int64(size)
+	return limits, nil
+}
+
+func addOutputFlags(cmd *cobra.Command, nameTemplate string) {
+	cmd.Flags().StringP("output", "o", "", "output file or directory (use - for stdout)")
+	cmd.Flags().String("format", string(image.FormatDocker), "output archive format (docker for 'docker load' or oci for an OCI image layout)")
+	addArchiveFlags(cmd)
+	cmd.Flags().String("name-template", nameTemplate, "output file name template (fields: .Registry .Repo .Name .Tag .Digest .Platform .Ext)")
 }
 
 // rootCmd represents the base command when called without any subcommands
@@ -145,62 +568,92 @@ var rootCmd = &cobra.Command{
 		}
 		insecure, _ := cmd.Flags().GetBool("insecure")
 		proxy, _ := cmd.Flags().GetString("proxy")
+		output, _ := cmd.Flags().GetString("output")
+		nameTemplate, _ := cmd.Flags().GetString("name-template")
+		platform, _ := cmd.Flags().GetString("platform")
 
-		if strings.Contains(args[0], ":") {
-			imageParts := strings.Split(args[0], ":")
-			ImageName = imageParts[0]
-			ImageTag = imageParts[1]
-		} else {
-			ImageName = args[0]
-			ImageTag = "latest"
+		opts, err := getArchiveOptions(cmd)
+		if err != nil {
+			return err
+		}
+		dopts, err := getDecryptOptions(cmd)
+		if err != nil {
+			return err
+		}
+		if dopts.KeepEncrypted && opts.Format != image.FormatOCI {
+			return fmt.Errorf("--keep-encrypted requires --format oci")
 		}
-		// test for official image name
-		if !strings.Contains(ImageName, "/") {
-			ImageName = "library/" + ImageName
+		convert, err := getConvertLayers(cmd)
+		if err != nil {
+			return err
 		}
 
+		ref := parseImageRef(args[0])
+		ImageName = ref.Name
+		ImageTag = ref.Tag
+
 		// Get image manifest
 		log.WithFields(log.Fields{
 			"image": ImageName,
 		}).Infof(getFmtStr(), "Querying Registry")
 		registry := initRegistry(ImageName, proxy, insecure)
 
-		mF, err := registry.ReposManifests(ImageName, ImageTag)
+		pulled := time.Now()
+		mF, err := registry.ReposManifestsForPlatform(ImageName, ImageTag, platform)
 		if err != nil {
 			log.Fatal(err.Error())
 		}
 
-		dir, err := ioutil.TempDir("", "graboid")
-		if err != nil {
-			log.Fatal(err.Error())
-		}
-		defer os.RemoveAll(dir) // clean up
-
 		log.Infof(getFmtStr(), "GET CONFIG")
-		cfile, err := registry.RepoGetConfig(dir, ImageName, mF)
+		fetch := registryFetcher(registry, ImageName, true)
+		config, conf, err := getConfig(fetch, mF)
 		if err != nil {
 			log.Fatal(err.Error())
 		}
 
-		log.Infof(getFmtStr(), "GET LAYERS")
-		lfiles, err := registry.RepoGetLayers(dir, ImageName, mF)
-		if err != nil {
-			log.Fatal(err.Error())
+		cleanup := func() {}
+		decrypt := hasEncryptedLayers(mF) && !dopts.KeepEncrypted
+		if decrypt || needsConversion(mF, convert) {
+			cache, removeCache, err := tempLayerCache()
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			cleanup = removeCache
+			fetch = cachedFetcher(cache, fetch)
+			if decrypt {
+				log.Infof(getFmtStr(), "DECRYPT LAYERS")
+				if mF, err = decryptLayers(mF, fetch, cache, dopts.Keys); err != nil {
+					cleanup()
+					log.Fatal(err.Error())
+				}
+			}
+			if needsConversion(mF, convert) {
+				log.Infof(getFmtStr(), "CONVERT LAYERS")
+				if mF, config, err = convertLayers(mF, config, fetch, cache, convert); err != nil {
+					cleanup()
+					log.Fatal(err.Error())
+				}
+			}
 		}
 
-		log.Infof(getFmtStr(), "CREATE manifest.json")
-		_, err = createManifest(dir, cfile, lfiles)
+		output, err = outputPath(output, nameTemplate, outputName{
+			Registry: registry.URL.Host,
+			Repo:     ImageName,
+			Name:     strings.Replace(ImageName, "/", "_", 1),
+			Tag:      ImageTag,
+			Digest:   strings.TrimPrefix(mF.Digest, "sha256:"),
+			Platform: conf.Platform(),
+			Ext:      opts.Ext(),
+		})
 		if err != nil {
-			log.Fatal(err.Error())
+			return err
 		}
 
-		tarFile := fmt.Sprintf("%s_%s.tar.gz", strings.Replace(ImageName, "/", "_", 1), ImageTag)
-		if runtime.GOOS == "windows" {
-			log.Infof("%s: %s", "CREATE docker image tarball", tarFile)
-		} else {
-			log.Infof("\033[1m%s:\033[0m \033[34m%s\033[0m", "CREATE docker image tarball", tarFile)
-		}
-		err = tarFiles(dir, tarFile)
+		err = createArchive(output, opts, blobSources(nil, ref, mF, pulled), func(w *image.Writer) error {
+			log.Infof(getFmtStr(), "GET LAYERS")
+			return writeImage(w, ref, mF, config, fetch)
+		})
+		cleanup()
 		if err != nil {
 			log.Fatal(err.Error())
 		}
@@ -237,6 +690,10 @@ func init() {
 	// rootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 	rootCmd.Flags().String("proxy", "", "HTTP/HTTPS proxy")
 	rootCmd.Flags().Bool("insecure", false, "do not verify ssl certs")
+	rootCmd.Flags().String("platform", registry.DefaultPlatform, "platform to pull from multi-platform images (os/arch[/variant])")
+	addOutputFlags(rootCmd, defaultNameTemplate)
+	addDecryptionFlags(rootCmd, true)
+	addConvertFlag(rootCmd)
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -261,6 +718,6 @@ func initConfig() {
 
 	// If a config file is found, read it in.
 	if err := viper.ReadInConfig(); err == nil {
-		fmt.Println("Using config file:", viper.ConfigFileUsed())
+		fmt.Fprintln(os.Stderr, "Using config file:", viper.ConfigFileUsed())
 	}
 }
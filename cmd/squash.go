@@ -0,0 +1,198 @@
+/*
+Copyright © 2019 blacktop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/apex/log"
+	"github.com/blacktop/graboid/pkg/image"
+	"github.com/blacktop/graboid/pkg/registry"
+	"github.com/spf13/cobra"
+)
+
+// squashCmd represents the squash command
+var squashCmd = &cobra.Command{
+	Use:   "squash <archive|image>",
+	Short: "Squash an image's layers into a single layer",
+	Long: `Squashes all of an image's layers, or the layers from --from up, into a single layer
+and writes the new image as an archive. The squashed layer holds the files a container
+sees that come from those layers and whiteouts for the files of the lower layers they
+delete, so files deleted by a later layer (i.e. secrets) are left out. The config gets
+the new diff_ids and keeps the squashed layers' history entries as empty layers, so the
+image has a new ID.
+
+The image is read from an archive, a split set or an OCI image layout, or pulled
+straight from the registry. Layers are written uncompressed like 'docker save' does,
+the archive as a whole is compressed with --compression.`,
+	Example: `  graboid squash alpine.tar.gz -o alpine-squashed.tar.gz
+  graboid squash myapp:1.0 --from 3 --tag myapp:1.0-squashed -o myapp.tar.gz
+  graboid squash image.tar.gz --format oci -o - | skopeo copy oci-archive:/dev/stdin docker://registry/myapp:1.0`,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		if Verbose {
+			log.SetLevel(log.DebugLevel)
+		}
+		from, _ := cmd.Flags().GetInt("from")
+		tag, _ := cmd.Flags().GetString("tag")
+		output, _ := cmd.Flags().GetString("output")
+
+		opts, err := getArchiveOptions(cmd)
+		if err != nil {
+			return err
+		}
+
+		li, cleanup, err := openImage(cmd, args[0])
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		if from < 0 || from >= len(li.Layers) {
+			return fmt.Errorf("--from %d: image %s has %d layers", from, li, len(li.Layers))
+		}
+		if len(tag) == 0 {
+			if len(li.Manifest.RepoTags) == 0 {
+				return fmt.Errorf("image %s is untagged, name the squashed image with --tag", li)
+			}
+			tag = li.Manifest.RepoTags[0]
+		}
+		fsys, _, err := li.fs()
+		if err != nil {
+			return err
+		}
+
+		cache, cleanupCache, err := tempLayerCache()
+		if err != nil {
+			return err
+		}
+		defer cleanupCache()
+
+		log.WithFields(log.Fields{
+			"image":  li.String(),
+			"layers": fmt.Sprintf("%d-%d", from, len(li.Layers)-1),
+		}).Info("squashing layers")
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(image.SquashLayer(fsys, from, pw))
+		}()
+		diffID, size, err := cache.Add(pr, "")
+		pr.Close()
+		if err != nil {
+			return err
+		}
+
+		config, err := li.SquashConfig(from, diffID, fmt.Sprintf("graboid squash --from %d", from))
+		if err != nil {
+			return err
+		}
+		manifest, err := squashedManifest(li.Layers[:from], config, diffID, size)
+		if err != nil {
+			return err
+		}
+
+		// the lower layers are written uncompressed so their digests are their diff_ids
+		fetch := func(digest, mediaType string, size int) (io.ReadCloser, error) {
+			if digest == diffID {
+				return os.Open(cache.Path(digest))
+			}
+			for idx, layer := range li.Layers[:from] {
+				if layer.DiffID() == digest {
+					return fsys.OpenLayer(idx)
+				}
+			}
+			return nil, fmt.Errorf("layer %s not found in image", digest)
+		}
+		if err := createArchive(output, opts, nil, func(w *image.Writer) error {
+			return writeImage(w, parseImageRef(tag), manifest, config, fetch)
+		}); err != nil {
+			return err
+		}
+
+		log.WithFields(log.Fields{
+			"id":     fmt.Sprintf("%x", sha256.Sum256(config))[:12],
+			"layers": len(manifest.Layers),
+		}).Infof(getFmtStr(), "SUCCESS!")
+		return nil
+	},
+}
+
+// squashedManifest returns the OCI manifest of a squashed image: its config,
+// the uncompressed lower layers and the squashed layer
+func squashedManifest(lower []image.Layer, config []byte, diffID string, size int64) (*registry.Manifests, error) {
+	m := image.OCIManifest{
+		SchemaVersion: 2,
+		MediaType:     registry.MediaTypeOCIManifest,
+		Config: image.Descriptor{
+			MediaType: image.MediaTypeOCIConfig,
+			Digest:    fmt.Sprintf("sha256:%x", sha256.Sum256(config)),
+			Size:      int64(len(config)),
+		},
+	}
+	for _, layer := range lower {
+		m.Layers = append(m.Layers, image.Descriptor{
+			MediaType: registry.MediaTypeOCILayer,
+			Digest:    layer.DiffID(),
+			Size:      layer.UncompressedSize(),
+		})
+	}
+	m.Layers = append(m.Layers, image.Descriptor{
+		MediaType: registry.MediaTypeOCILayer,
+		Digest:    diffID,
+		Size:      size,
+	})
+
+	raw, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	var manifest registry.Manifests
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return nil, err
+	}
+	manifest.Raw = raw
+	manifest.Digest = fmt.Sprintf("sha256:%x", sha256.Sum256(raw))
+	return &manifest, nil
+}
+
+func init() {
+	rootCmd.AddCommand(squashCmd)
+
+	squashCmd.Flags().Int("from", 0, "index of the first layer to squash (default squashes every layer)")
+	squashCmd.Flags().String("tag", "", "repo tag of the squashed image (default is the image's tag)")
+	squashCmd.Flags().StringP("output", "o", "", "output file (use - for stdout)")
+	squashCmd.Flags().String("format", string(image.FormatDocker), "output archive format (docker for 'docker load' or oci for an OCI image layout)")
+	squashCmd.Flags().String("ref", "", "image to squash from archives with several (repo tag, OCI ref name or image ID)")
+	squashCmd.Flags().String("platform", "", "platform of the image (os/arch[/variant], default is "+registry.DefaultPlatform+" when pulling)")
+	squashCmd.Flags().String("proxy", "", "HTTP/HTTPS proxy")
+	squashCmd.Flags().Bool("insecure", false, "do not verify ssl certs")
+	addArchiveFlags(squashCmd)
+	addDecryptionFlags(squashCmd, false)
+	addIdentityFlag(squashCmd)
+	addLimitFlags(squashCmd)
+	squashCmd.MarkFlagRequired("output")
+}
@@ -41,7 +41,7 @@ func Indent(f func(s string), level int) func(string) {
 	}
 }
 
-func initRegistry(reposName, proxy string, insecure bool) *registry.Registry {
+func newRegistry(reposName, proxy string, insecure bool) (*registry.Registry, error) {
 	config := registry.Config{
 		Endpoint:       IndexDomain,
 		RegistryDomain: RegistryDomain,
@@ -55,10 +55,17 @@ func initRegistry(reposName, proxy string, insecure bool) *registry.Registry {
 	}
 	registry, err := registry.New(config)
 	if err != nil {
-		log.Fatal(err.Error())
+		return nil, err
 	}
 	log.Debug("getting auth token")
-	err = registry.GetToken()
+	if err := registry.GetToken(); err != nil {
+		return nil, err
+	}
+	return registry, nil
+}
+
+func initRegistry(reposName, proxy string, insecure bool) *registry.Registry {
+	registry, err := newRegistry(reposName, proxy, insecure)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
@@ -0,0 +1,119 @@
+/*
+Copyright © 2019 blacktop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/apex/log"
+	"github.com/blacktop/graboid/pkg/bundle"
+	"github.com/blacktop/graboid/pkg/minisign"
+	"github.com/spf13/cobra"
+)
+
+// verifyBundleCmd represents the verify-bundle command
+var verifyBundleCmd = &cobra.Command{
+	Use:   "verify-bundle <archive>",
+	Short: "Verify an archive against its signed transfer manifest",
+	Long: `Checks the signature of the transfer manifest written next to an archive
+(<archive>.manifest.json and <archive>.manifest.json.minisig) and then verifies the
+archive's checksum and the size and digest of every file in it against the manifest.
+Encrypted archives are decrypted (with --identity) as they are read.
+
+The manifest signature can also be checked with minisign:
+
+  minisign -Vm <archive>.manifest.json -p graboid.pub`,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		if Verbose {
+			log.SetLevel(log.DebugLevel)
+		}
+		pubKey, _ := cmd.Flags().GetString("pub")
+		manifestPath, _ := cmd.Flags().GetString("manifest")
+		sigPath, _ := cmd.Flags().GetString("signature")
+
+		if len(manifestPath) == 0 {
+			manifestPath = bundle.TransferManifestPath(args[0])
+		}
+		if len(sigPath) == 0 {
+			sigPath = manifestPath + bundle.SignatureExt
+		}
+
+		identities, err := getIdentities(cmd)
+		if err != nil {
+			return err
+		}
+		pk, err := minisign.ReadPublicKey(pubKey)
+		if err != nil {
+			return err
+		}
+		manifest, data, err := bundle.ReadTransferManifest(manifestPath)
+		if err != nil {
+			return err
+		}
+		sig, err := ioutil.ReadFile(sigPath)
+		if err != nil {
+			return fmt.Errorf("transfer manifest is not signed: %v", err)
+		}
+		trusted, err := pk.Verify(bytes.NewReader(data), sig)
+		if err != nil {
+			return fmt.Errorf("%s: %v", manifestPath, err)
+		}
+		log.WithFields(log.Fields{
+			"key_id":  pk.ID.String(),
+			"comment": trusted,
+		}).Info("transfer manifest signature is valid")
+
+		if name := filepath.Base(args[0]); name != manifest.Archive && !bundle.IsSplitIndex(name) {
+			log.Warnf("archive was renamed from %s to %s", manifest.Archive, name)
+		}
+
+		log.WithField("blobs", len(manifest.Blobs)).Info("verifying archive")
+		if err := manifest.Verify(args[0], identities...); err != nil {
+			if verr, ok := err.(*bundle.VerifyError); ok {
+				for _, problem := range verr.Problems {
+					log.Error(problem)
+				}
+				return fmt.Errorf("%s does not match its transfer manifest", args[0])
+			}
+			return err
+		}
+
+		log.Infof("\033[1mVERIFIED!\033[0m")
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(verifyBundleCmd)
+
+	verifyBundleCmd.Flags().StringP("pub", "p", "", "minisign or PEM ed25519 public key to verify the transfer manifest with")
+	verifyBundleCmd.Flags().String("manifest", "", "transfer manifest (default is <archive>.manifest.json)")
+	verifyBundleCmd.Flags().String("signature", "", "transfer manifest signature (default is <manifest>.minisig)")
+	addIdentityFlag(verifyBundleCmd)
+	verifyBundleCmd.MarkFlagRequired("pub")
+}
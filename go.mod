@@ -1,14 +1,18 @@
 module github.com/blacktop/graboid
 
-go 1.17
+go 1.18
 
 require (
+	filippo.io/age v1.0.0
 	github.com/apex/log v1.9.0
+	github.com/cespare/xxhash v1.1.0
 	github.com/docker/docker v20.10.7+incompatible
 	github.com/dustin/go-humanize v1.0.0
 	github.com/fatih/color v1.12.0 // indirect
 	github.com/gizak/termui/v3 v3.1.0
 	github.com/google/uuid v1.2.0 // indirect
+	github.com/klauspost/compress v1.13.6
+	github.com/klauspost/pgzip v1.2.5
 	github.com/kr/pretty v0.2.1 // indirect
 	github.com/mattn/go-runewidth v0.0.13 // indirect
 	github.com/mitchellh/go-homedir v1.1.0
@@ -18,13 +22,18 @@ require (
 	github.com/spf13/cobra v1.2.1
 	github.com/spf13/viper v1.9.0
 	github.com/wagoodman/dive v0.10.0
+	go.mozilla.org/pkcs7 v0.0.0-20200128120323-432b2356ecb1
+	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
 	golang.org/x/net v0.0.0-20211005215030-d2e5035098b3
-	golang.org/x/sys v0.0.0-20210823070655-63515b42dcdf // indirect
+	golang.org/x/sys v0.0.0-20210903071746-97244b99971b
 	gopkg.in/cheggaaa/pb.v1 v1.0.28
+	gopkg.in/square/go-jose.v2 v2.6.0
+	gopkg.in/yaml.v2 v2.4.0
 )
 
+require github.com/klauspost/pgzip v1.2.5
+
 require (
-	github.com/cespare/xxhash v1.1.0 // indirect
 	github.com/docker/go-connections v0.4.0 // indirect
 	github.com/docker/go-units v0.4.0 // indirect
 	github.com/fsnotify/fsnotify v1.5.1 // indirect
@@ -46,5 +55,4 @@ require (
 	github.com/subosito/gotenv v1.2.0 // indirect
 	golang.org/x/text v0.3.6 // indirect
 	gopkg.in/ini.v1 v1.63.2 // indirect
-	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
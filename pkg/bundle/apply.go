@@ -0,0 +1,226 @@
+package bundle
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/apex/log"
+	"github.com/blacktop/graboid/pkg/compress"
+	"github.com/blacktop/graboid/pkg/image"
+)
+
+// walkArchive calls fn for every regular file in the (optionally compressed) image archive at path
+func walkArchive(path string, identities []age.Identity, fn func(hdr *tar.Header, r io.Reader) error) error {
+	f, err := Open(path, identities...)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := compress.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := fn(hdr, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// checkName returns an error for a blob name (from an untrusted manifest.json)
+// that isn't a relative path inside the archive
+func checkName(name string) error {
+	if !fs.ValidPath(name) || name == "." || strings.Contains(name, "..") {
+		return fmt.Errorf("invalid blob name %q", name)
+	}
+	return nil
+}
+
+// copyBlob copies a blob into w verifying its digest when the name is digest based
+func copyBlob(w *image.Writer, name string, size int64, r io.Reader) error {
+	if len(DigestFromName(name)) == 0 {
+		return w.WriteFile(name, size, r)
+	}
+	return copyVerified(w, name, size, r)
+}
+
+// copyVerified copies a blob into w, failing if its name isn't its digest
+func copyVerified(w *image.Writer, name string, size int64, r io.Reader) error {
+	digest := DigestFromName(name)
+	if len(digest) == 0 {
+		return fmt.Errorf("%s is not named by its digest so it can't be verified", name)
+	}
+	h := sha256.New()
+	if err := w.WriteFile(name, size, io.TeeReader(r, h)); err != nil {
+		return err
+	}
+	if got := fmt.Sprintf("sha256:%x", h.Sum(nil)); got != digest {
+		return fmt.Errorf("digest mismatch for %s: got %s", name, got)
+	}
+	return nil
+}
+
+// Apply rebuilds the complete images of the (delta) bundle at path into w by
+// copying the blobs that were omitted from it out of stores. A store is either
+// an image archive or a directory containing the blobs (i.e. a blob cache).
+// Only blobs named by their digest are taken from a store, and only once their
+// digest is verified. Encrypted archives are decrypted with one of the identities.
+func Apply(path string, stores []string, w *image.Writer, identities ...age.Identity) error {
+	var manifests []image.Manifest
+	present := make(map[string]bool)
+
+	if err := walkArchive(path, identities, func(hdr *tar.Header, r io.Reader) error {
+		if hdr.Name == "manifest.json" {
+			if err := json.NewDecoder(r).Decode(&manifests); err != nil {
+				return fmt.Errorf("failed to parse manifest.json: %v", err)
+			}
+			return nil
+		}
+		if err := checkName(hdr.Name); err != nil {
+			return err
+		}
+		present[hdr.Name] = true
+		return nil
+	}); err != nil {
+		return err
+	}
+	if len(manifests) == 0 {
+		return fmt.Errorf("%s does not contain any images", path)
+	}
+
+	missing := make(map[string]bool)
+	for _, m := range manifests {
+		for _, name := range append([]string{m.Config}, m.Layers...) {
+			if err := checkName(name); err != nil {
+				return err
+			}
+			if present[name] {
+				continue
+			}
+			if len(DigestFromName(name)) == 0 {
+				return fmt.Errorf("%s is missing from the bundle and is not named by its digest, so it can't be taken from a store", name)
+			}
+			missing[name] = true
+		}
+	}
+	log.WithFields(log.Fields{
+		"present": len(present),
+		"missing": len(missing),
+	}).Debug("applying bundle")
+
+	// copy everything that shipped in the bundle
+	if err := walkArchive(path, identities, func(hdr *tar.Header, r io.Reader) error {
+		if hdr.Name == "manifest.json" {
+			return nil
+		}
+		return copyBlob(w, hdr.Name, hdr.Size, r)
+	}); err != nil {
+		return err
+	}
+
+	// fill in the missing blobs from the stores
+	for _, store := range stores {
+		if len(missing) == 0 {
+			break
+		}
+		fi, err := os.Stat(store)
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			for name := range missing {
+				found, err := copyFromDir(w, store, name)
+				if err != nil {
+					return err
+				}
+				if found {
+					delete(missing, name)
+				}
+			}
+			continue
+		}
+		if err := walkArchive(store, identities, func(hdr *tar.Header, r io.Reader) error {
+			if !missing[hdr.Name] {
+				return nil
+			}
+			if err := copyVerified(w, hdr.Name, hdr.Size, r); err != nil {
+				return fmt.Errorf("%s: %v", store, err)
+			}
+			delete(missing, hdr.Name)
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	if len(missing) > 0 {
+		var names []string
+		for name := range missing {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("blobs not found in any store: %s", strings.Join(names, ", "))
+	}
+
+	for _, m := range manifests {
+		w.AddManifest(m)
+	}
+
+	return nil
+}
+
+// copyFromDir copies blob name, which must be named by its digest, from a
+// directory of blobs laid out either flat (<dir>/<name>) or content addressed
+// (<dir>/blobs/sha256/<hex>)
+func copyFromDir(w *image.Writer, dir, name string) (bool, error) {
+	digest := DigestFromName(name)
+	if len(digest) == 0 {
+		return false, fmt.Errorf("%s is not named by its digest so it can't be verified", name)
+	}
+	candidates := []string{
+		filepath.Join(dir, filepath.FromSlash(name)),
+		filepath.Join(dir, "blobs", "sha256", strings.TrimPrefix(digest, "sha256:")),
+	}
+	for _, candidate := range candidates {
+		f, err := os.Open(candidate)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			return false, err
+		}
+		if err := copyVerified(w, name, fi.Size(), f); err != nil {
+			return false, fmt.Errorf("%s: %v", candidate, err)
+		}
+		return true, nil
+	}
+	return false, nil
+}
@@ -0,0 +1,101 @@
+package bundle
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// EncryptedExt is the file extension of an encrypted archive
+const EncryptedExt = ".age"
+
+// ageHeader is the first line of an age encrypted file
+const ageHeader = "age-encryption.org/v1\n"
+
+// ErrEncrypted is returned when opening an encrypted archive without any identities
+var ErrEncrypted = errors.New("archive is encrypted and requires an identity to decrypt it")
+
+// NewEncryptWriter returns a writer that encrypts to the recipients in
+// 64KiB chunks as it streams. Close must be called to flush the last chunk.
+func NewEncryptWriter(w io.Writer, recipients ...age.Recipient) (io.WriteCloser, error) {
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("no recipients to encrypt to")
+	}
+	return age.Encrypt(w, recipients...)
+}
+
+// IsEncrypted returns true if header is the start of an age encrypted file
+func IsEncrypted(header []byte) bool {
+	return bytes.HasPrefix(header, []byte(ageHeader))
+}
+
+// Decrypt returns a reader that decrypts r with one of the identities when it
+// is age encrypted, otherwise r is read as is
+func Decrypt(r io.Reader, identities ...age.Identity) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(len(ageHeader))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if !IsEncrypted(header) {
+		return br, nil
+	}
+	if len(identities) == 0 {
+		return nil, ErrEncrypted
+	}
+	dr, err := age.Decrypt(br, identities...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt archive: %v", err)
+	}
+	return dr, nil
+}
+
+// ParseRecipients parses age X25519 recipients (age1...) and the recipients
+// listed in files (one per line, # comments allowed)
+func ParseRecipients(recipients []string, files []string) ([]age.Recipient, error) {
+	var parsed []age.Recipient
+	for _, s := range recipients {
+		r, err := age.ParseX25519Recipient(strings.TrimSpace(s))
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, r)
+	}
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		rs, err := age.ParseRecipients(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		parsed = append(parsed, rs...)
+	}
+	return parsed, nil
+}
+
+// ReadIdentities reads the age identities (AGE-SECRET-KEY-1...) in files
+func ReadIdentities(files []string) ([]age.Identity, error) {
+	var identities []age.Identity
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		ids, err := age.ParseIdentities(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		identities = append(identities, ids...)
+	}
+	return identities, nil
+}
@@ -0,0 +1,191 @@
+package bundle
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"github.com/blacktop/graboid/pkg/compress"
+	"github.com/blacktop/graboid/pkg/image"
+)
+
+// IndexVersion is the current bundle index format version
+const IndexVersion = 1
+
+// Index is the inventory of the images and blobs in a bundle
+type Index struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	Images  []Image   `json:"images,omitempty"`
+	Blobs   []Blob    `json:"blobs,omitempty"`
+}
+
+// Image is an image in a bundle
+type Image struct {
+	RepoTags []string `json:"repo_tags,omitempty"`
+	Platform string   `json:"platform,omitempty"`
+	Digest   string   `json:"digest,omitempty"`
+	Config   string   `json:"config"`
+	Layers   []string `json:"layers"`
+}
+
+// Blob is a config or layer blob in a bundle
+type Blob struct {
+	// Name is the blob's file name in the archive
+	Name      string `json:"name"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+	MediaType string `json:"media_type,omitempty"`
+	// Omitted is true if the blob was left out of the archive because the target already has it
+	Omitted bool `json:"omitted,omitempty"`
+}
+
+// NewIndex creates a new empty Index
+func NewIndex() *Index {
+	return &Index{
+		Version: IndexVersion,
+		Created: time.Now().UTC(),
+	}
+}
+
+// ReadIndex reads a bundle index file
+func ReadIndex(path string) (*Index, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	idx := new(Index)
+	if err := json.Unmarshal(data, idx); err != nil {
+		return nil, fmt.Errorf("failed to parse bundle index %s: %v", path, err)
+	}
+	if idx.Version > IndexVersion {
+		return nil, fmt.Errorf("unsupported bundle index version %d in %s", idx.Version, path)
+	}
+	return idx, nil
+}
+
+// Encode writes the index as JSON to w
+func (idx *Index) Encode(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(idx)
+}
+
+// Write writes the index to path
+func (idx *Index) Write(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := idx.Encode(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Has returns true if the index contains a blob with digest
+func (idx *Index) Has(digest string) bool {
+	for _, blob := range idx.Blobs {
+		if blob.Digest == digest {
+			return true
+		}
+	}
+	return false
+}
+
+// AddBlob adds a blob to the index if it isn't already in it
+func (idx *Index) AddBlob(blob Blob) {
+	if !idx.Has(blob.Digest) {
+		idx.Blobs = append(idx.Blobs, blob)
+	}
+}
+
+// AddImage adds an image to the index
+func (idx *Index) AddImage(img Image) {
+	idx.Images = append(idx.Images, img)
+}
+
+// Merge adds all of other's images and blobs to the index
+func (idx *Index) Merge(other *Index) {
+	idx.Images = append(idx.Images, other.Images...)
+	for _, blob := range other.Blobs {
+		idx.AddBlob(blob)
+	}
+}
+
+// DigestFromName returns the digest of a blob named <hex>.tar or <hex>.json
+// as written by graboid, or an empty string if the name isn't digest based
+func DigestFromName(name string) string {
+	hex := strings.TrimSuffix(strings.TrimSuffix(path.Base(name), ".tar"), ".json")
+	if len(hex) != 64 || strings.Trim(hex, "0123456789abcdef") != "" {
+		return ""
+	}
+	return "sha256:" + hex
+}
+
+// Inventory builds an index from the image archive at path
+func Inventory(path string, identities ...age.Identity) (*Index, error) {
+	f, err := Open(path, identities...)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r, err := compress.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	idx := NewIndex()
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		if hdr.Name == "manifest.json" {
+			var manifests []image.Manifest
+			if err := json.NewDecoder(tr).Decode(&manifests); err != nil {
+				return nil, fmt.Errorf("failed to parse manifest.json: %v", err)
+			}
+			for _, m := range manifests {
+				idx.AddImage(Image{
+					RepoTags: m.RepoTags,
+					Config:   m.Config,
+					Layers:   m.Layers,
+				})
+			}
+			continue
+		}
+
+		h := sha256.New()
+		n, err := io.Copy(h, tr)
+		if err != nil {
+			return nil, err
+		}
+		idx.AddBlob(Blob{
+			Name:   hdr.Name,
+			Digest: fmt.Sprintf("sha256:%x", h.Sum(nil)),
+			Size:   n,
+		})
+	}
+
+	return idx, nil
+}
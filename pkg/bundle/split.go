@@ -0,0 +1,330 @@
+package bundle
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// SplitIndexExt is the file extension of a split set's index
+const SplitIndexExt = ".split.json"
+
+// SplitIndex is the checksummed index of a set of volumes
+type SplitIndex struct {
+	Version int `json:"version"`
+	// Name is the file name of the reassembled archive
+	Name       string   `json:"name"`
+	Size       int64    `json:"size"`
+	SHA256     string   `json:"sha256"`
+	VolumeSize int64    `json:"volume_size"`
+	Volumes    []Volume `json:"volumes"`
+}
+
+// Volume is one part of a split archive
+type Volume struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// SplitWriter writes a stream as numbered volumes of at most VolumeSize bytes
+// (<path>.001, <path>.002, ...) followed by a <path>.split.json index
+type SplitWriter struct {
+	path  string
+	index SplitIndex
+	total hash.Hash
+
+	cur     *os.File
+	curHash hash.Hash
+	curSize int64
+}
+
+// NewSplitWriter creates a new SplitWriter for path
+func NewSplitWriter(path string, volumeSize int64) (*SplitWriter, error) {
+	if volumeSize <= 0 {
+		return nil, fmt.Errorf("invalid volume size: %d", volumeSize)
+	}
+	return &SplitWriter{
+		path: path,
+		index: SplitIndex{
+			Version:    1,
+			Name:       filepath.Base(path),
+			VolumeSize: volumeSize,
+		},
+		total: sha256.New(),
+	}, nil
+}
+
+// IsSplitIndex returns true if path is a split set index
+func IsSplitIndex(path string) bool {
+	return strings.HasSuffix(path, SplitIndexExt)
+}
+
+// SplitIndexPath returns the split index of the archive at path if it was split
+// into volumes. path can be the index, the first volume or the reassembled name.
+func SplitIndexPath(path string) (string, bool) {
+	if IsSplitIndex(path) {
+		return path, true
+	}
+	base := path
+	if strings.HasSuffix(path, ".001") {
+		base = strings.TrimSuffix(path, ".001")
+	} else if _, err := os.Stat(path); err == nil {
+		return "", false
+	}
+	if _, err := os.Stat(base + SplitIndexExt); err == nil {
+		return base + SplitIndexExt, true
+	}
+	return "", false
+}
+
+func (s *SplitWriter) finishVolume() error {
+	if s.cur == nil {
+		return nil
+	}
+	if err := s.cur.Close(); err != nil {
+		return err
+	}
+	s.index.Volumes = append(s.index.Volumes, Volume{
+		Name:   filepath.Base(s.cur.Name()),
+		Size:   s.curSize,
+		SHA256: hex.EncodeToString(s.curHash.Sum(nil)),
+	})
+	s.cur = nil
+	return nil
+}
+
+func (s *SplitWriter) nextVolume() error {
+	if err := s.finishVolume(); err != nil {
+		return err
+	}
+	f, err := os.Create(filepath.Join(filepath.Dir(s.path), volumeName(s.index.Name, len(s.index.Volumes)+1)))
+	if err != nil {
+		return err
+	}
+	s.cur = f
+	s.curHash = sha256.New()
+	s.curSize = 0
+	return nil
+}
+
+// Write writes p across as many volumes as needed
+func (s *SplitWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if s.cur == nil || s.curSize == s.index.VolumeSize {
+			if err := s.nextVolume(); err != nil {
+				return written, err
+			}
+		}
+		chunk := p
+		if free := s.index.VolumeSize - s.curSize; int64(len(chunk)) > free {
+			chunk = chunk[:free]
+		}
+		n, err := s.cur.Write(chunk)
+		s.curHash.Write(chunk[:n])
+		s.total.Write(chunk[:n])
+		s.curSize += int64(n)
+		s.index.Size += int64(n)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close finishes the last volume and writes the split index
+func (s *SplitWriter) Close() error {
+	if s.cur == nil && len(s.index.Volumes) == 0 {
+		if err := s.nextVolume(); err != nil {
+			return err
+		}
+	}
+	if err := s.finishVolume(); err != nil {
+		return err
+	}
+	s.index.SHA256 = hex.EncodeToString(s.total.Sum(nil))
+	data, err := json.MarshalIndent(s.index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.path+SplitIndexExt, data, 0644)
+}
+
+// ReadSplitIndex reads a split set index
+func ReadSplitIndex(path string) (*SplitIndex, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	idx := new(SplitIndex)
+	if err := json.Unmarshal(data, idx); err != nil {
+		return nil, fmt.Errorf("failed to parse split index %s: %v", path, err)
+	}
+	if len(idx.Volumes) == 0 {
+		return nil, fmt.Errorf("split index %s has no volumes", path)
+	}
+	// the names are joined to the index's directory so they must not lead out of it
+	if !isBaseName(idx.Name) {
+		return nil, fmt.Errorf("split index %s: invalid archive name %q", path, idx.Name)
+	}
+	for n, vol := range idx.Volumes {
+		if !isBaseName(vol.Name) || vol.Name != volumeName(idx.Name, n+1) {
+			return nil, fmt.Errorf("split index %s: invalid volume name %q (expected %s)", path, vol.Name, volumeName(idx.Name, n+1))
+		}
+	}
+	return idx, nil
+}
+
+// volumeName returns the file name of volume n of the archive name
+func volumeName(name string, n int) string {
+	return fmt.Sprintf("%s.%03d", name, n)
+}
+
+// isBaseName returns true if name is a file name without any directory
+func isBaseName(name string) bool {
+	return len(name) > 0 && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
+
+// splitReader reads the volumes of a split set in order verifying each one's checksum
+type splitReader struct {
+	dir   string
+	index *SplitIndex
+	total hash.Hash
+	read  int64
+
+	next    int
+	cur     *os.File
+	curHash hash.Hash
+	curSize int64
+}
+
+// OpenSplit opens the split set described by the index at path as a single
+// stream. Every volume's checksum (and the total) is verified as it is read
+// and a mismatch is returned as a read error.
+func OpenSplit(path string) (io.ReadCloser, error) {
+	idx, err := ReadSplitIndex(path)
+	if err != nil {
+		return nil, err
+	}
+	return &splitReader{
+		dir:   filepath.Dir(path),
+		index: idx,
+		total: sha256.New(),
+	}, nil
+}
+
+func (r *splitReader) openNext() error {
+	vol := r.index.Volumes[r.next]
+	f, err := os.Open(filepath.Join(r.dir, vol.Name))
+	if err != nil {
+		return err
+	}
+	r.cur = f
+	r.curHash = sha256.New()
+	r.curSize = 0
+	r.next++
+	return nil
+}
+
+func (r *splitReader) finishVolume() error {
+	vol := r.index.Volumes[r.next-1]
+	r.cur.Close()
+	r.cur = nil
+	if r.curSize != vol.Size {
+		return fmt.Errorf("volume %s is %d bytes, expected %d", vol.Name, r.curSize, vol.Size)
+	}
+	if sum := hex.EncodeToString(r.curHash.Sum(nil)); sum != vol.SHA256 {
+		return fmt.Errorf("volume %s checksum mismatch: got %s, expected %s", vol.Name, sum, vol.SHA256)
+	}
+	return nil
+}
+
+func (r *splitReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if r.next == len(r.index.Volumes) {
+				if r.read != r.index.Size {
+					return 0, fmt.Errorf("split set is %d bytes, expected %d", r.read, r.index.Size)
+				}
+				if sum := hex.EncodeToString(r.total.Sum(nil)); sum != r.index.SHA256 {
+					return 0, fmt.Errorf("split set checksum mismatch: got %s, expected %s", sum, r.index.SHA256)
+				}
+				return 0, io.EOF
+			}
+			if err := r.openNext(); err != nil {
+				return 0, err
+			}
+		}
+		n, err := r.cur.Read(p)
+		r.curHash.Write(p[:n])
+		r.total.Write(p[:n])
+		r.curSize += int64(n)
+		r.read += int64(n)
+		if err == io.EOF {
+			if ferr := r.finishVolume(); ferr != nil {
+				return n, ferr
+			}
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (r *splitReader) Close() error {
+	if r.cur != nil {
+		return r.cur.Close()
+	}
+	return nil
+}
+
+// openRaw opens an archive file or split set as it is stored
+func openRaw(path string) (io.ReadCloser, error) {
+	if idx, ok := SplitIndexPath(path); ok {
+		return OpenSplit(idx)
+	}
+	return os.Open(path)
+}
+
+// Open opens an image archive that may have been split into volumes and
+// decrypts it with one of the identities if it was encrypted
+func Open(path string, identities ...age.Identity) (io.ReadCloser, error) {
+	f, err := openRaw(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := Decrypt(f, identities...)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, f}, nil
+}
+
+// Join verifies and reassembles the split set described by the index at path into w
+func Join(path string, w io.Writer) error {
+	r, err := OpenSplit(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(w, r)
+	return err
+}
@@ -0,0 +1,103 @@
+package bundle
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeSplit splits data into volumes of volumeSize bytes under dir and returns the index path
+func writeSplit(t *testing.T, dir string, data []byte, volumeSize int64) string {
+	t.Helper()
+	s, err := NewSplitWriter(filepath.Join(dir, "a.tar"), volumeSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "a.tar"+SplitIndexExt)
+}
+
+func TestSplit(t *testing.T) {
+	data := make([]byte, 2500)
+	rand.New(rand.NewSource(1)).Read(data)
+	dir := t.TempDir()
+	path := writeSplit(t, dir, data, 1000)
+
+	idx, err := ReadSplitIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.Volumes) != 3 || idx.Volumes[2].Name != "a.tar.003" || idx.Volumes[2].Size != 500 {
+		t.Fatalf("unexpected volumes: %+v", idx.Volumes)
+	}
+	var buf bytes.Buffer
+	if err := Join(path, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatal("joined volumes differ from the data written")
+	}
+
+	// a corrupt volume fails the join
+	if err := ioutil.WriteFile(filepath.Join(dir, "a.tar.002"), make([]byte, 1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Join(path, ioutil.Discard); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("expected a checksum mismatch, got %v", err)
+	}
+}
+
+func TestReadSplitIndexNames(t *testing.T) {
+	dir := t.TempDir()
+	path := writeSplit(t, dir, []byte("data"), 1000)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(idx *SplitIndex)
+	}{
+		{"parent archive", func(idx *SplitIndex) { idx.Name = "../../.bashrc" }},
+		{"absolute archive", func(idx *SplitIndex) { idx.Name = "/etc/passwd" }},
+		{"empty archive", func(idx *SplitIndex) { idx.Name = "" }},
+		{"dot dot archive", func(idx *SplitIndex) { idx.Name = ".." }},
+		{"parent volume", func(idx *SplitIndex) { idx.Volumes[0].Name = "../a.tar.001" }},
+		{"absolute volume", func(idx *SplitIndex) { idx.Volumes[0].Name = "/etc/shadow" }},
+		{"other volume", func(idx *SplitIndex) { idx.Volumes[0].Name = "secret" }},
+		{"misnumbered volume", func(idx *SplitIndex) { idx.Volumes[0].Name = "a.tar.002" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var idx SplitIndex
+			if err := json.Unmarshal(data, &idx); err != nil {
+				t.Fatal(err)
+			}
+			tt.modify(&idx)
+			bad, err := json.Marshal(idx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := filepath.Join(dir, "bad"+SplitIndexExt)
+			if err := ioutil.WriteFile(p, bad, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ReadSplitIndex(p); err == nil {
+				t.Fatal("expected the index to be rejected")
+			}
+			if _, err := OpenSplit(p); err == nil {
+				t.Fatal("expected the split set to be rejected")
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"github.com/blacktop/graboid/pkg/compress"
+	"github.com/blacktop/graboid/pkg/image"
+	"github.com/blacktop/graboid/pkg/minisign"
+)
+
+const (
+	// TransferManifestExt is the file extension of an archive's transfer manifest
+	TransferManifestExt = ".manifest.json"
+	// SignatureExt is the file extension of a transfer manifest's minisign signature
+	SignatureExt = ".minisig"
+	// TransferManifestVersion is the current transfer manifest format version
+	TransferManifestVersion = 1
+)
+
+// TransferManifest is the sidecar manifest of an archive that lists every
+// file in it so the archive can be verified after it has been moved
+type TransferManifest struct {
+	Version int       `json:"version"`
+	Archive string    `json:"archive"`
+	Created time.Time `json:"created"`
+	// Size and SHA256 are of the archive as written (i.e. compressed or reassembled from its volumes)
+	Size   int64          `json:"size"`
+	SHA256 string         `json:"sha256"`
+	Blobs  []TransferBlob `json:"blobs"`
+}
+
+// TransferBlob is a file in an archive and where it came from
+type TransferBlob struct {
+	Name   string     `json:"name"`
+	Digest string     `json:"digest"`
+	Size   int64      `json:"size"`
+	Source string     `json:"source,omitempty"`
+	Pulled *time.Time `json:"pulled,omitempty"`
+}
+
+// Source is where a blob was pulled from
+type Source struct {
+	Ref    string
+	Pulled time.Time
+}
+
+// NewTransferManifest creates the transfer manifest of the archive at path from
+// the files written to it. sources maps blob digests to where they were pulled from.
+func NewTransferManifest(path string, files []image.File, sources map[string]Source) *TransferManifest {
+	m := &TransferManifest{
+		Version: TransferManifestVersion,
+		Archive: filepath.Base(path),
+		Created: time.Now().UTC(),
+	}
+	for _, f := range files {
+		blob := TransferBlob{
+			Name:   f.Name,
+			Digest: f.Digest,
+			Size:   f.Size,
+		}
+		if src, ok := sources[f.Digest]; ok {
+			pulled := src.Pulled.UTC()
+			blob.Source = src.Ref
+			blob.Pulled = &pulled
+		}
+		m.Blobs = append(m.Blobs, blob)
+	}
+	return m
+}
+
+// TransferManifestPath returns the path of the transfer manifest of the archive at path
+func TransferManifestPath(path string) string {
+	if idx, ok := SplitIndexPath(path); ok {
+		path = strings.TrimSuffix(idx, SplitIndexExt)
+	}
+	return path + TransferManifestExt
+}
+
+// ReadTransferManifest reads a transfer manifest file
+func ReadTransferManifest(path string) (*TransferManifest, []byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	m := new(TransferManifest)
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse transfer manifest %s: %v", path, err)
+	}
+	if m.Version > TransferManifestVersion {
+		return nil, nil, fmt.Errorf("unsupported transfer manifest version %d in %s", m.Version, path)
+	}
+	return m, data, nil
+}
+
+// Write writes the manifest to path and, when sk is not nil, signs it into path.minisig
+func (m *TransferManifest) Write(path string, sk *minisign.PrivateKey) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return err
+	}
+	if sk == nil {
+		return nil
+	}
+	sig, err := sk.Sign(bytes.NewReader(data), fmt.Sprintf("timestamp:%d\tfile:%s\thashed", m.Created.Unix(), filepath.Base(path)))
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path+SignatureExt, sig, 0644)
+}
+
+// VerifyError lists every problem found while verifying an archive
+type VerifyError struct {
+	Problems []string
+}
+
+func (e *VerifyError) Error() string {
+	if len(e.Problems) == 1 {
+		return e.Problems[0]
+	}
+	return fmt.Sprintf("%d problems found:\n  %s", len(e.Problems), strings.Join(e.Problems, "\n  "))
+}
+
+// Verify checks that the archive at path (or its split set) matches the
+// manifest: the archive's checksum, every listed file's size and digest and
+// that it contains no unlisted files. A mismatch is returned as a *VerifyError.
+// Encrypted archives are decrypted with one of the identities as they are read.
+func (m *TransferManifest) Verify(path string, identities ...age.Identity) error {
+	f, err := openRaw(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	total := sha256.New()
+	var size countingWriter
+	raw := io.TeeReader(f, io.MultiWriter(total, &size))
+	var problems []string
+
+	expected := make(map[string]TransferBlob)
+	for _, blob := range m.Blobs {
+		expected[blob.Name] = blob
+	}
+	seen := make(map[string]bool)
+
+	dr, err := Decrypt(raw, identities...)
+	if err != nil {
+		return err
+	}
+
+	// readEntries returns an error if the archive can't be read
+	readEntries := func() error {
+		r, err := compress.NewReader(dr)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		tr := tar.NewReader(r)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if hdr.Typeflag != tar.TypeReg {
+				problems = append(problems, fmt.Sprintf("%s: unexpected entry type %q", hdr.Name, hdr.Typeflag))
+				continue
+			}
+			blob, ok := expected[hdr.Name]
+			if !ok {
+				problems = append(problems, fmt.Sprintf("%s: not listed in the manifest", hdr.Name))
+				continue
+			}
+			if seen[hdr.Name] {
+				problems = append(problems, fmt.Sprintf("%s: duplicate entry", hdr.Name))
+			}
+			seen[hdr.Name] = true
+			h := sha256.New()
+			n, err := io.Copy(h, tr)
+			if err != nil {
+				return err
+			}
+			if n != blob.Size {
+				problems = append(problems, fmt.Sprintf("%s: size is %d, expected %d", hdr.Name, n, blob.Size))
+			}
+			if got := fmt.Sprintf("sha256:%x", h.Sum(nil)); got != blob.Digest {
+				problems = append(problems, fmt.Sprintf("%s: digest is %s, expected %s", hdr.Name, got, blob.Digest))
+			}
+		}
+	}
+	corrupt := readEntries()
+	if corrupt != nil {
+		problems = append(problems, fmt.Sprintf("archive is corrupt: %v", corrupt))
+	}
+
+	// hash whatever trails the tar stream (padding, compression trailers)
+	if _, err := io.Copy(ioutil.Discard, raw); err != nil {
+		return err
+	}
+
+	var missing []string
+	for name := range expected {
+		if !seen[name] && corrupt == nil {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	for _, name := range missing {
+		problems = append(problems, fmt.Sprintf("%s: missing from the archive", name))
+	}
+
+	if int64(size) != m.Size {
+		problems = append(problems, fmt.Sprintf("archive is %d bytes, expected %d", size, m.Size))
+	}
+	if got := fmt.Sprintf("%x", total.Sum(nil)); got != m.SHA256 {
+		problems = append(problems, fmt.Sprintf("archive checksum is %s, expected %s", got, m.SHA256))
+	}
+
+	if len(problems) > 0 {
+		return &VerifyError{Problems: problems}
+	}
+	return nil
+}
+
+// countingWriter counts the bytes written to it
+type countingWriter int64
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	*c += countingWriter(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,151 @@
+package compress
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Algorithm is an archive compression algorithm
+type Algorithm string
+
+const (
+	// None writes an uncompressed tarball
+	None Algorithm = "none"
+	// Gzip compresses with gzip
+	Gzip Algorithm = "gzip"
+	// Zstd compresses with zstandard
+	Zstd Algorithm = "zstd"
+	// Bzip2 is only supported for reading
+	Bzip2 Algorithm = "bzip2"
+)
+
+// ParseAlgorithm parses a compression algorithm name
+func ParseAlgorithm(name string) (Algorithm, error) {
+	switch Algorithm(strings.ToLower(name)) {
+	case None, "":
+		return None, nil
+	case Gzip, "gz":
+		return Gzip, nil
+	case Zstd, "zst":
+		return Zstd, nil
+	}
+	return "", fmt.Errorf("unsupported compression: %s (must be one of none, gzip or zstd)", name)
+}
+
+// Ext returns the file extension for the algorithm
+func (a Algorithm) Ext() string {
+	switch a {
+	case Gzip:
+		return ".gz"
+	case Zstd:
+		return ".zst"
+	case Bzip2:
+		return ".bz2"
+	}
+	return ""
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// Options are the compression writer options
+type Options struct {
+	// Level is the compression level (-1 selects the algorithm's default)
+	Level int
+	// BlockSize is the amount of input each gzip worker compresses at a time
+	BlockSize int
+	// Workers is the number of concurrent compression workers (0 is one per CPU)
+	Workers int
+}
+
+// DefaultOptions are the default compression writer options
+var DefaultOptions = Options{Level: -1}
+
+// NewWriter returns a writer that compresses to w with the given algorithm.
+// Closing the returned writer does NOT close w.
+func NewWriter(w io.Writer, algo Algorithm, opts Options) (io.WriteCloser, error) {
+	switch algo {
+	case None:
+		return nopWriteCloser{w}, nil
+	case Gzip:
+		if opts.Workers == 1 {
+			return gzip.NewWriterLevel(w, opts.Level)
+		}
+		return NewParallelGzipWriter(w, opts.Level, opts.BlockSize, opts.Workers)
+	case Zstd:
+		zopts := []zstd.EOption{}
+		if opts.Level > 0 {
+			zopts = append(zopts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(opts.Level)))
+		}
+		if opts.Workers > 0 {
+			zopts = append(zopts, zstd.WithEncoderConcurrency(opts.Workers))
+		}
+		return zstd.NewWriter(w, zopts...)
+	}
+	return nil, fmt.Errorf("unsupported compression: %s", algo)
+}
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	// bzip2Magic is followed by the block size digit (1-9)
+	bzip2Magic = []byte("BZh")
+)
+
+// Detect returns the compression algorithm of a stream from its first bytes
+func Detect(header []byte) Algorithm {
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		return Gzip
+	case bytes.HasPrefix(header, zstdMagic):
+		return Zstd
+	case bytes.HasPrefix(header, bzip2Magic) && len(header) > 3 && header[3] >= '1' && header[3] <= '9':
+		return Bzip2
+	}
+	return None
+}
+
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (r readCloser) Close() error { return r.close() }
+
+// NewReader returns a reader that transparently decompresses r.
+// Closing the returned reader does NOT close r.
+func NewReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(4)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	switch Detect(header) {
+	case Gzip:
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return gz, nil
+	case Zstd:
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return readCloser{Reader: zr, close: func() error { zr.Close(); return nil }}, nil
+	case Bzip2:
+		return ioutil.NopCloser(bzip2.NewReader(br)), nil
+	}
+	return ioutil.NopCloser(br), nil
+}
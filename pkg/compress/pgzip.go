@@ -0,0 +1,221 @@
+package compress
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"runtime"
+	"sync"
+
+	"github.com/klauspost/compress/flate"
+)
+
+const (
+	// DefaultBlockSize is the default amount of input compressed by each worker
+	DefaultBlockSize = 1 << 20
+	// MinBlockSize is the smallest allowed block size
+	MinBlockSize = 64 << 10
+	// dictSize is the size of the deflate window primed from the previous block
+	dictSize = 32 << 10
+)
+
+type blockResult struct {
+	buf *bytes.Buffer
+	err error
+}
+
+// ParallelGzipWriter is a gzip writer that compresses blocks of its input in parallel (like pigz).
+//
+// Each block is deflated independently using the last 32KB of the previous block as its
+// dictionary and ends on a sync flush, so the blocks concatenate into a single gzip member
+// that any standard gzip reader can decompress.
+type ParallelGzipWriter struct {
+	w         io.Writer
+	level     int
+	blockSize int
+
+	block []byte
+	dict  []byte
+	crc   uint32
+	size  uint32
+
+	sem     chan struct{}
+	results chan chan blockResult
+	done    chan struct{}
+	bufPool sync.Pool
+
+	mu     sync.Mutex
+	err    error
+	closed bool
+}
+
+// NewParallelGzipWriter creates a new ParallelGzipWriter.
+// A blockSize or workers of 0 selects the defaults (1MB blocks and one worker per CPU).
+func NewParallelGzipWriter(w io.Writer, level, blockSize, workers int) (*ParallelGzipWriter, error) {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return nil, fmt.Errorf("invalid gzip compression level: %d", level)
+	}
+	if blockSize == 0 {
+		blockSize = DefaultBlockSize
+	}
+	if blockSize < MinBlockSize {
+		return nil, fmt.Errorf("gzip block size must be at least %d bytes", MinBlockSize)
+	}
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	z := &ParallelGzipWriter{
+		w:         w,
+		level:     level,
+		blockSize: blockSize,
+		block:     make([]byte, 0, blockSize),
+		sem:       make(chan struct{}, workers),
+		results:   make(chan chan blockResult, workers),
+		done:      make(chan struct{}),
+	}
+	z.bufPool.New = func() interface{} { return new(bytes.Buffer) }
+
+	if err := z.writeHeader(); err != nil {
+		return nil, err
+	}
+
+	go z.writeLoop()
+
+	return z, nil
+}
+
+func (z *ParallelGzipWriter) writeHeader() error {
+	hdr := [10]byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 255}
+	switch z.level {
+	case flate.BestCompression:
+		hdr[8] = 2
+	case flate.BestSpeed, flate.HuffmanOnly:
+		hdr[8] = 4
+	}
+	_, err := z.w.Write(hdr[:])
+	return err
+}
+
+// writeLoop writes the compressed blocks to the underlying writer in order
+func (z *ParallelGzipWriter) writeLoop() {
+	defer close(z.done)
+	for ch := range z.results {
+		res := <-ch
+		if res.err == nil && z.getErr() == nil {
+			_, res.err = z.w.Write(res.buf.Bytes())
+		}
+		if res.err != nil {
+			z.setErr(res.err)
+		}
+		res.buf.Reset()
+		z.bufPool.Put(res.buf)
+		<-z.sem
+	}
+}
+
+func (z *ParallelGzipWriter) getErr() error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.err
+}
+
+func (z *ParallelGzipWriter) setErr(err error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if z.err == nil {
+		z.err = err
+	}
+}
+
+// dispatch hands the current block off to a compression worker
+func (z *ParallelGzipWriter) dispatch(last bool) {
+	data := z.block
+	dict := z.dict
+
+	// prime the next block's window with the tail of everything written so far
+	if len(data) >= dictSize {
+		z.dict = append([]byte(nil), data[len(data)-dictSize:]...)
+	} else {
+		next := append(append([]byte(nil), dict...), data...)
+		if len(next) > dictSize {
+			next = next[len(next)-dictSize:]
+		}
+		z.dict = next
+	}
+	z.block = make([]byte, 0, z.blockSize)
+
+	ch := make(chan blockResult, 1)
+	z.sem <- struct{}{}
+	z.results <- ch
+	go func() {
+		buf := z.bufPool.Get().(*bytes.Buffer)
+		ch <- blockResult{buf: buf, err: z.compressBlock(buf, dict, data, last)}
+	}()
+}
+
+func (z *ParallelGzipWriter) compressBlock(buf *bytes.Buffer, dict, data []byte, last bool) error {
+	fw, err := flate.NewWriterDict(buf, z.level, dict)
+	if err != nil {
+		return err
+	}
+	if _, err := fw.Write(data); err != nil {
+		return err
+	}
+	if last {
+		return fw.Close()
+	}
+	return fw.Flush()
+}
+
+// Write compresses p
+func (z *ParallelGzipWriter) Write(p []byte) (int, error) {
+	if z.closed {
+		return 0, fmt.Errorf("write to closed gzip writer")
+	}
+	if err := z.getErr(); err != nil {
+		return 0, err
+	}
+
+	z.crc = crc32.Update(z.crc, crc32.IEEETable, p)
+	z.size += uint32(len(p))
+
+	n := len(p)
+	for len(p) > 0 {
+		free := z.blockSize - len(z.block)
+		if len(p) < free {
+			z.block = append(z.block, p...)
+			break
+		}
+		z.block = append(z.block, p[:free]...)
+		p = p[free:]
+		z.dispatch(false)
+	}
+
+	return n, nil
+}
+
+// Close flushes the remaining data and writes the gzip footer.
+// It does not close the underlying writer.
+func (z *ParallelGzipWriter) Close() error {
+	if z.closed {
+		return z.getErr()
+	}
+	z.closed = true
+
+	z.dispatch(true)
+	close(z.results)
+	<-z.done
+
+	if err := z.getErr(); err != nil {
+		return err
+	}
+
+	var trailer [8]byte
+	binary.LittleEndian.PutUint32(trailer[:4], z.crc)
+	binary.LittleEndian.PutUint32(trailer[4:], z.size)
+	_, err := z.w.Write(trailer[:])
+	return err
+}
@@ -0,0 +1,215 @@
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"runtime"
+	"testing"
+
+	"github.com/dustin/go-humanize"
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/pgzip"
+)
+
+var benchSize = flag.String("pgzip.size", "2GiB", "size of the generated input of the gzip benchmarks")
+
+// testData returns n bytes of text-like data that repeats across blocks so
+// back-references into the previous block's dictionary are exercised
+func testData(seed int64, n int) []byte {
+	rnd := rand.New(rand.NewSource(seed))
+	words := make([][]byte, 512)
+	for idx := range words {
+		word := make([]byte, 2+rnd.Intn(10))
+		for j := range word {
+			word[j] = byte('a' + rnd.Intn(26))
+		}
+		words[idx] = word
+	}
+	data := make([]byte, 0, n+16)
+	for len(data) < n {
+		switch rnd.Intn(16) {
+		case 0:
+			// incompressible runs
+			run := make([]byte, rnd.Intn(256))
+			rnd.Read(run)
+			data = append(data, run...)
+		default:
+			data = append(data, words[rnd.Intn(len(words))]...)
+			data = append(data, ' ')
+		}
+	}
+	return data[:n]
+}
+
+// gunzip decompresses a single gzip member, which checks its CRC and size trailer
+func gunzip(t *testing.T, compressed []byte) []byte {
+	t.Helper()
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr.Multistream(false)
+	data, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := zr.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// the blocks must concatenate into one member ending at the trailer
+	if _, err := zr.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected a single gzip member, got %v", err)
+	}
+	return data
+}
+
+func TestParallelGzipWriter(t *testing.T) {
+	sizes := []int{0, 1, MinBlockSize - 1, MinBlockSize, MinBlockSize + 1, 3*MinBlockSize + dictSize/2, 10 * MinBlockSize}
+	for level := flate.HuffmanOnly; level <= flate.BestCompression; level++ {
+		for _, size := range sizes {
+			for _, workers := range []int{1, 4} {
+				t.Run(fmt.Sprintf("level=%d/size=%d/workers=%d", level, size, workers), func(t *testing.T) {
+					data := testData(int64(size), size)
+					var buf bytes.Buffer
+					z, err := NewParallelGzipWriter(&buf, level, MinBlockSize, workers)
+					if err != nil {
+						t.Fatal(err)
+					}
+					// odd write sizes cross block boundaries mid-write
+					for p := data; len(p) > 0; {
+						n := 1 + rand.Intn(3*MinBlockSize/2)
+						if n > len(p) {
+							n = len(p)
+						}
+						if _, err := z.Write(p[:n]); err != nil {
+							t.Fatal(err)
+						}
+						p = p[n:]
+					}
+					if err := z.Close(); err != nil {
+						t.Fatal(err)
+					}
+					if got := gunzip(t, buf.Bytes()); !bytes.Equal(got, data) {
+						t.Fatalf("decompressed %d bytes that differ from the %d written", len(got), len(data))
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestParallelGzipWriterOptions(t *testing.T) {
+	if _, err := NewParallelGzipWriter(ioutil.Discard, 10, 0, 0); err == nil {
+		t.Error("expected an error for level 10")
+	}
+	if _, err := NewParallelGzipWriter(ioutil.Discard, gzip.DefaultCompression, MinBlockSize-1, 0); err == nil {
+		t.Error("expected an error for a block size below the minimum")
+	}
+
+	z, err := NewParallelGzipWriter(ioutil.Discard, gzip.DefaultCompression, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := z.Write([]byte("x")); err == nil {
+		t.Error("expected an error writing to a closed writer")
+	}
+}
+
+// failWriter fails every write after the first n
+type failWriter struct{ n int }
+
+func (w *failWriter) Write(p []byte) (int, error) {
+	if w.n == 0 {
+		return 0, io.ErrClosedPipe
+	}
+	w.n--
+	return len(p), nil
+}
+
+func TestParallelGzipWriterError(t *testing.T) {
+	z, err := NewParallelGzipWriter(&failWriter{n: 1}, gzip.DefaultCompression, MinBlockSize, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := testData(1, 8*MinBlockSize)
+	for idx := 0; idx < len(data); idx += MinBlockSize {
+		if _, err := z.Write(data[idx : idx+MinBlockSize]); err != nil {
+			break
+		}
+	}
+	if err := z.Close(); err != io.ErrClosedPipe {
+		t.Fatalf("expected the underlying writer's error, got %v", err)
+	}
+}
+
+// benchInput streams size bytes of generated data to w in chunks
+func benchInput(b *testing.B, w io.Writer, chunk []byte, size int64) {
+	for n := int64(0); n < size; n += int64(len(chunk)) {
+		p := chunk
+		if rest := size - n; rest < int64(len(p)) {
+			p = p[:rest]
+		}
+		if _, err := w.Write(p); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParallelGzipWriter(b *testing.B) {
+	size, err := humanize.ParseBytes(*benchSize)
+	if err != nil {
+		b.Fatal(err)
+	}
+	// the chunk is larger than a deflate window so repeating it doesn't help compression
+	chunk := testData(42, 8<<20)
+
+	run := func(name string, newWriter func(w io.Writer) (io.WriteCloser, error)) {
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(size))
+			for n := 0; n < b.N; n++ {
+				zw, err := newWriter(ioutil.Discard)
+				if err != nil {
+					b.Fatal(err)
+				}
+				benchInput(b, zw, chunk, int64(size))
+				if err := zw.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+
+	for _, level := range []int{gzip.BestSpeed, gzip.DefaultCompression, gzip.BestCompression} {
+		level := level
+		run(fmt.Sprintf("gzip/level=%d", level), func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriterLevel(w, level)
+		})
+		for _, blockSize := range []int{MinBlockSize, DefaultBlockSize, 4 << 20} {
+			for _, workers := range []int{2, 4, 0} {
+				blockSize, workers := blockSize, workers
+				run(fmt.Sprintf("parallel/level=%d/block=%s/workers=%d", level, humanize.IBytes(uint64(blockSize)), workers), func(w io.Writer) (io.WriteCloser, error) {
+					return NewParallelGzipWriter(w, level, blockSize, workers)
+				})
+				run(fmt.Sprintf("pgzip/level=%d/block=%s/workers=%d", level, humanize.IBytes(uint64(blockSize)), workers), func(w io.Writer) (io.WriteCloser, error) {
+					zw, err := pgzip.NewWriterLevel(w, level)
+					if err != nil {
+						return nil, err
+					}
+					n := workers
+					if n <= 0 {
+						n = runtime.NumCPU()
+					}
+					return zw, zw.SetConcurrency(blockSize, n)
+				})
+			}
+		}
+	}
+}
@@ -0,0 +1,280 @@
+// Package gzran reads gzip streams from arbitrary offsets of their decompressed
+// data. While a stream is read sequentially it records checkpoints, the
+// decompressor's state at the start of a deflate block; later a read can
+// resume from the nearest checkpoint instead of decompressing from the start,
+// like zlib's zran example.
+//
+// The decompressor (inflate.go and dict_decoder.go) is forked from the
+// compress/flate package of Go 1.17 and keeps its BSD license, see LICENSE.
+package gzran
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"sort"
+)
+
+// DefaultSpan is the default distance between checkpoints in decompressed bytes
+const DefaultSpan = 4 << 20
+
+const (
+	gzipID1     = 0x1f
+	gzipID2     = 0x8b
+	gzipDeflate = 8
+	flagText    = 1 << 0
+	flagHdrCrc  = 1 << 1
+	flagExtra   = 1 << 2
+	flagName    = 1 << 3
+	flagComment = 1 << 4
+)
+
+var (
+	// ErrHeader is returned when a gzip member has an invalid header
+	ErrHeader = errors.New("gzran: invalid header")
+	// ErrChecksum is returned when a gzip member fails its checksum
+	ErrChecksum = errors.New("gzran: invalid checksum")
+)
+
+// Checkpoint is the state of the decompressor at the start of a deflate block
+type Checkpoint struct {
+	// In is the offset of the next byte to read in the compressed stream
+	In int64 `json:"in"`
+	// Out is the offset in the decompressed stream
+	Out int64 `json:"out"`
+	// Bits and NBits are the input bits already read from before In
+	Bits  uint32 `json:"bits"`
+	NBits uint   `json:"nbits"`
+	// Window is the last 32KiB of decompressed data that later blocks can refer back to
+	Window []byte `json:"window"`
+}
+
+// Index is the checkpoints recorded for a gzip stream, in order
+type Index struct {
+	Span        int64        `json:"span"`
+	Checkpoints []Checkpoint `json:"checkpoints"`
+}
+
+// Reader decompresses a gzip stream, possibly recording an index of it
+type Reader struct {
+	r     *countingReader
+	f     decompressor
+	index *Index
+
+	// out is the number of bytes decompressed before the current deflate stream
+	out    int64
+	digest uint32
+	size   uint32
+	// verify is unset when a member was resumed from a checkpoint and can't be checksummed
+	verify bool
+	err    error
+}
+
+// NewReader returns a reader decompressing the gzip stream r that records a
+// checkpoint about every span bytes, for a span <= 0 DefaultSpan
+func NewReader(r io.Reader, span int64) (*Reader, error) {
+	if span <= 0 {
+		span = DefaultSpan
+	}
+	z := &Reader{
+		r:     &countingReader{r: bufio.NewReader(r)},
+		index: &Index{Span: span},
+	}
+	z.f.onBlock = z.checkpoint
+	if err := z.readHeader(); err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+// Index returns the checkpoints recorded so far, complete once the reader reached EOF
+func (z *Reader) Index() *Index {
+	return z.index
+}
+
+// Read implements io.Reader
+func (z *Reader) Read(p []byte) (n int, err error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+
+	for n == 0 {
+		n, z.err = z.f.Read(p)
+		z.digest = crc32.Update(z.digest, crc32.IEEETable, p[:n])
+		z.size += uint32(n)
+		if z.err != io.EOF {
+			return n, z.err
+		}
+
+		// end of the member's deflate stream
+		if z.err = z.readTrailer(); z.err != nil {
+			return n, z.err
+		}
+		if _, err := z.r.r.Peek(1); err == io.EOF {
+			z.err = io.EOF
+			return n, z.err
+		}
+		z.out += z.f.dict.flushed
+		if z.err = z.readHeader(); z.err != nil {
+			return n, z.err
+		}
+	}
+	return n, nil
+}
+
+// Close implements io.Closer, it does not close the underlying reader
+func (z *Reader) Close() error {
+	return z.f.Close()
+}
+
+// checkpoint records the decompressor's state once the output went span bytes
+// past the previous checkpoint
+func (z *Reader) checkpoint() {
+	if z.index == nil {
+		return
+	}
+	out := z.out + z.f.dict.flushed + int64(z.f.dict.availRead())
+	last := int64(0)
+	if n := len(z.index.Checkpoints); n > 0 {
+		last = z.index.Checkpoints[n-1].Out
+	}
+	if out-last < z.index.Span {
+		return
+	}
+	z.index.Checkpoints = append(z.index.Checkpoints, Checkpoint{
+		In:     z.r.off,
+		Out:    out,
+		Bits:   z.f.b,
+		NBits:  z.f.nb,
+		Window: z.f.dict.window(),
+	})
+}
+
+// readHeader reads a gzip member header and starts decompressing its deflate stream
+func (z *Reader) readHeader() error {
+	var buf [10]byte
+	if _, err := io.ReadFull(z.r, buf[:]); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if buf[0] != gzipID1 || buf[1] != gzipID2 || buf[2] != gzipDeflate {
+		return ErrHeader
+	}
+	flags := buf[3]
+	if flags&flagExtra != 0 {
+		if _, err := io.ReadFull(z.r, buf[:2]); err != nil {
+			return noEOF(err)
+		}
+		if _, err := io.CopyN(ioutil.Discard, z.r, int64(binary.LittleEndian.Uint16(buf[:2]))); err != nil {
+			return noEOF(err)
+		}
+	}
+	for _, flag := range []byte{flagName, flagComment} {
+		if flags&flag == 0 {
+			continue
+		}
+		for {
+			c, err := z.r.ReadByte()
+			if err != nil {
+				return noEOF(err)
+			}
+			if c == 0 {
+				break
+			}
+		}
+	}
+	if flags&flagHdrCrc != 0 {
+		if _, err := io.ReadFull(z.r, buf[:2]); err != nil {
+			return noEOF(err)
+		}
+	}
+
+	z.digest, z.size, z.verify = 0, 0, true
+	z.f.reset(z.r, nil)
+	return nil
+}
+
+// readTrailer reads and checks a gzip member's CRC-32 and size
+func (z *Reader) readTrailer() error {
+	var buf [8]byte
+	if _, err := io.ReadFull(z.r, buf[:]); err != nil {
+		return noEOF(err)
+	}
+	if !z.verify {
+		return nil
+	}
+	if binary.LittleEndian.Uint32(buf[:4]) != z.digest || binary.LittleEndian.Uint32(buf[4:]) != z.size {
+		return ErrChecksum
+	}
+	return nil
+}
+
+// Open returns the gzip stream decompressed from off. open returns the
+// compressed stream from an offset; the read starts at the closest checkpoint
+// before off and discards up to it
+func (idx *Index) Open(open func(off int64) (io.ReadCloser, error), off int64) (io.ReadCloser, error) {
+	i := sort.Search(len(idx.Checkpoints), func(i int) bool {
+		return idx.Checkpoints[i].Out > off
+	}) - 1
+
+	var (
+		rc  io.ReadCloser
+		z   *Reader
+		err error
+	)
+	if i < 0 {
+		if rc, err = open(0); err != nil {
+			return nil, err
+		}
+		z = &Reader{r: &countingReader{r: bufio.NewReader(rc)}}
+		if err = z.readHeader(); err != nil {
+			rc.Close()
+			return nil, err
+		}
+	} else {
+		cp := idx.Checkpoints[i]
+		if rc, err = open(cp.In); err != nil {
+			return nil, err
+		}
+		z = &Reader{r: &countingReader{r: bufio.NewReader(rc), off: cp.In}, out: cp.Out}
+		z.f.reset(z.r, cp.Window)
+		z.f.b, z.f.nb = cp.Bits, cp.NBits
+		off -= cp.Out
+	}
+
+	if _, err := io.CopyN(ioutil.Discard, z, off); err != nil {
+		rc.Close()
+		return nil, noEOF(err)
+	}
+	return &readCloser{Reader: z, Closer: rc}, nil
+}
+
+// countingReader keeps track of the offset in the compressed stream
+type countingReader struct {
+	r   *bufio.Reader
+	off int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.off += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.off++
+	}
+	return b, err
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
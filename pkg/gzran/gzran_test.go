@@ -0,0 +1,236 @@
+package gzran
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/blacktop/graboid/pkg/compress"
+)
+
+// testSpan is the distance between checkpoints in the tests, small enough for most blocks to get one
+const testSpan = 16 << 10
+
+// textData returns n bytes of text-like data that compresses into dynamic Huffman blocks
+func textData(seed int64, n int) []byte {
+	rnd := rand.New(rand.NewSource(seed))
+	words := make([]string, 256)
+	for idx := range words {
+		word := make([]byte, 2+rnd.Intn(8))
+		for j := range word {
+			word[j] = byte('a' + rnd.Intn(26))
+		}
+		words[idx] = string(word)
+	}
+	var buf bytes.Buffer
+	for buf.Len() < n {
+		buf.WriteString(words[rnd.Intn(len(words))])
+		buf.WriteByte(" \n"[rnd.Intn(2)])
+	}
+	return buf.Bytes()[:n]
+}
+
+func gzipData(t *testing.T, level int, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// firstBlockType returns the BTYPE of the first deflate block of a gzip member without optional header fields
+func firstBlockType(compressed []byte) int {
+	return int(compressed[10]>>1) & 3
+}
+
+// readIndexed decompresses a gzip stream recording its checkpoints
+func readIndexed(t *testing.T, compressed []byte) ([]byte, *Index) {
+	t.Helper()
+	z, err := NewReader(bytes.NewReader(compressed), testSpan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(z)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return data, z.Index()
+}
+
+// checkOpen checks that reading from off through idx matches data
+func checkOpen(t *testing.T, idx *Index, compressed, data []byte, off int64) {
+	t.Helper()
+	opens := 0
+	rc, err := idx.Open(func(in int64) (io.ReadCloser, error) {
+		opens++
+		return ioutil.NopCloser(bytes.NewReader(compressed[in:])), nil
+	}, off)
+	if err != nil {
+		t.Fatalf("open at %d: %v", off, err)
+	}
+	defer rc.Close()
+	got, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("read from %d: %v", off, err)
+	}
+	if !bytes.Equal(got, data[off:]) {
+		t.Fatalf("read %d bytes from %d that differ from the %d expected", len(got), off, len(data)-int(off))
+	}
+	if opens != 1 {
+		t.Fatalf("opened the stream %d times", opens)
+	}
+}
+
+// checkIndex checks the reader decompresses compressed to data and that
+// reading from its checkpoints and from random offsets matches it
+func checkIndex(t *testing.T, compressed, data []byte) {
+	t.Helper()
+	got, idx := readIndexed(t, compressed)
+	if !bytes.Equal(got, data) {
+		t.Fatalf("decompressed %d bytes that differ from the %d expected", len(got), len(data))
+	}
+
+	// the index is saved as JSON in a .gidx
+	b, err := json.Marshal(idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx = new(Index)
+	if err := json.Unmarshal(b, idx); err != nil {
+		t.Fatal(err)
+	}
+	if idx.Span != testSpan {
+		t.Fatalf("span is %d after a JSON round trip", idx.Span)
+	}
+
+	if len(data) > 4*testSpan && len(idx.Checkpoints) == 0 {
+		t.Fatal("no checkpoints were recorded")
+	}
+	var last int64
+	for _, cp := range idx.Checkpoints {
+		if cp.Out-last < testSpan || cp.In <= 0 || cp.In > int64(len(compressed)) || len(cp.Window) > maxMatchOffset {
+			t.Fatalf("bad checkpoint in=%d out=%d window=%d after %d", cp.In, cp.Out, len(cp.Window), last)
+		}
+		last = cp.Out
+		// checkpoints are at the start of a block so reading resumes exactly there
+		checkOpen(t, idx, compressed, data, cp.Out)
+	}
+
+	rnd := rand.New(rand.NewSource(int64(len(data))))
+	offsets := []int64{0, int64(len(data))}
+	for n := 0; n < 20 && len(data) > 0; n++ {
+		offsets = append(offsets, rnd.Int63n(int64(len(data))))
+	}
+	for _, off := range offsets {
+		checkOpen(t, idx, compressed, data, off)
+	}
+}
+
+func TestReader(t *testing.T) {
+	tests := []struct {
+		name      string
+		level     int
+		data      []byte
+		blockType int
+	}{
+		{"empty", gzip.DefaultCompression, nil, 1},
+		{"stored", gzip.NoCompression, textData(1, 300<<10), 0},
+		{"fixed", gzip.DefaultCompression, bytes.Repeat([]byte("hello, world "), 50), 1},
+		{"level 1", gzip.BestSpeed, textData(2, 1<<20), 2},
+		{"level 6", gzip.DefaultCompression, textData(3, 1<<20), 2},
+		{"level 9", gzip.BestCompression, textData(4, 1<<20), 2},
+		{"huffman only", gzip.HuffmanOnly, textData(5, 512<<10), 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			compressed := gzipData(t, tt.level, tt.data)
+			if got := firstBlockType(compressed); got != tt.blockType {
+				t.Fatalf("the stream starts with a block of type %d, not %d", got, tt.blockType)
+			}
+			checkIndex(t, compressed, tt.data)
+		})
+	}
+}
+
+func TestReaderMultiMember(t *testing.T) {
+	// members with a mix of block types, like concatenated gzip files
+	var compressed, data []byte
+	for idx, level := range []int{gzip.BestCompression, gzip.NoCompression, gzip.BestSpeed} {
+		member := textData(int64(idx), (100+idx*50)<<10)
+		compressed = append(compressed, gzipData(t, level, member)...)
+		data = append(data, member...)
+	}
+	compressed = append(compressed, gzipData(t, gzip.DefaultCompression, nil)...)
+	checkIndex(t, compressed, data)
+}
+
+func TestReaderParallelGzipWriter(t *testing.T) {
+	// the parallel writer's blocks end with sync flushes and refer back across block boundaries
+	data := textData(6, 10*compress.MinBlockSize+123)
+	for _, level := range []int{gzip.BestSpeed, gzip.DefaultCompression, gzip.BestCompression} {
+		t.Run(fmt.Sprintf("level=%d", level), func(t *testing.T) {
+			var buf bytes.Buffer
+			zw, err := compress.NewParallelGzipWriter(&buf, level, compress.MinBlockSize, 4)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := zw.Write(data); err != nil {
+				t.Fatal(err)
+			}
+			if err := zw.Close(); err != nil {
+				t.Fatal(err)
+			}
+			checkIndex(t, buf.Bytes(), data)
+		})
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	data := textData(7, 64<<10)
+	compressed := gzipData(t, gzip.DefaultCompression, data)
+
+	if _, err := NewReader(bytes.NewReader(data), 0); err != ErrHeader {
+		t.Fatalf("expected a header error for plain data, got %v", err)
+	}
+
+	corrupt := append([]byte{}, compressed...)
+	corrupt[len(corrupt)-5] ^= 1 // the CRC-32
+	z, err := NewReader(bytes.NewReader(corrupt), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(z); err != ErrChecksum {
+		t.Fatalf("expected a checksum error, got %v", err)
+	}
+
+	z, err = NewReader(bytes.NewReader(compressed[:len(compressed)/2]), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(z); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected an unexpected EOF for a truncated stream, got %v", err)
+	}
+
+	_, idx := readIndexed(t, compressed)
+	if _, err := idx.Open(func(in int64) (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(compressed[in:])), nil
+	}, int64(len(data))+1); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected an unexpected EOF opening past the end, got %v", err)
+	}
+}
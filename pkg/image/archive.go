@@ -0,0 +1,384 @@
+package image
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/blacktop/graboid/pkg/compress"
+	"github.com/blacktop/graboid/pkg/gzran"
+)
+
+// Selector picks an image from an archive with several images
+type Selector struct {
+	// Ref matches a repo tag or an OCI ref name or image name annotation
+	Ref string
+	// Platform matches the image's os/arch[/variant]
+	Platform string
+}
+
+// matchPlatform returns true if platform (os/arch[/variant]) is selected
+func (sel Selector) matchPlatform(os, arch, variant string) bool {
+	if len(sel.Platform) == 0 {
+		return true
+	}
+	parts := strings.Split(sel.Platform, "/")
+	if len(parts) < 2 || parts[0] != os || parts[1] != arch {
+		return false
+	}
+	return len(parts) < 3 || parts[2] == variant
+}
+
+// archive is the contents of an image archive that images are loaded from
+type archive interface {
+	// readFile returns the contents of a config, manifest or index
+	readFile(name string) ([]byte, error)
+	// layer returns a layer tar's file tree and digests
+	layer(name string) (*layerBlob, error)
+}
+
+// streamArchive is an image archive that has been read as a tar stream
+type streamArchive struct {
+	files  map[string][]byte
+	layers map[string]*layerBlob
+	links  map[string]string
+
+	// path is the archive's file, if it was parsed with ParseIndexed
+	path        string
+	compression compress.Algorithm
+	// checkpoints let a gzip archive be decompressed from the middle
+	checkpoints *gzran.Index
+	limits      Limits
+}
+
+func (a *streamArchive) readFile(name string) ([]byte, error) {
+	data, ok := a.files[resolveLink(a.links, archiveName(name))]
+	if !ok {
+		return nil, fmt.Errorf("%s not found in archive: %w", name, os.ErrNotExist)
+	}
+	if data == nil {
+		return nil, a.limits.errTooLarge(name)
+	}
+	return data, nil
+}
+
+func (a *streamArchive) layer(name string) (*layerBlob, error) {
+	layer, ok := a.layers[resolveLink(a.links, archiveName(name))]
+	if !ok {
+		return nil, fmt.Errorf("layer %s not found in archive", name)
+	}
+	return layer, nil
+}
+
+// dirArchive is an image archive that has been extracted to a directory (i.e. an OCI image layout)
+type dirArchive struct {
+	dir    string
+	layers map[string]*layerBlob
+	limits Limits
+}
+
+func (a *dirArchive) path(name string) (string, error) {
+	name = archiveName(name)
+	if escapes(name) {
+		return "", fmt.Errorf("%s is outside of the image directory", name)
+	}
+	return filepath.Join(a.dir, filepath.FromSlash(name)), nil
+}
+
+func (a *dirArchive) readFile(name string) ([]byte, error) {
+	p, err := a.path(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return a.limits.readJSON(name, f)
+}
+
+func (a *dirArchive) layer(name string) (*layerBlob, error) {
+	if layer, ok := a.layers[archiveName(name)]; ok {
+		return layer, nil
+	}
+	p, err := a.path(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	// NewDirFS seeks to files in gzip layers from their checkpoints
+	layer, _, err := readArchiveFile(name, fi.Size(), f, gzran.DefaultSpan, a.limits)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if layer == nil {
+		return nil, fmt.Errorf("layer %s is not a tar", name)
+	}
+	if a.layers == nil {
+		a.layers = make(map[string]*layerBlob)
+	}
+	a.layers[archiveName(name)] = layer
+	return layer, nil
+}
+
+// ParseDir parses every image in an image archive that has been extracted to dir,
+// such as an OCI image layout written by buildkit or jib, within limits like Parse
+func ParseDir(dir string, limits Limits) ([]*Tar, error) {
+	return load(&dirArchive{dir: dir, limits: limits}, limits)
+}
+
+// Select returns the image in images that matches sel. It is an error for
+// several images to match, unless the archive only has one image.
+func Select(images []*Tar, sel Selector) (*Tar, error) {
+	var matches []*Tar
+	for _, i := range images {
+		if i.Match(sel) {
+			matches = append(matches, i)
+		}
+	}
+	switch {
+	case len(images) == 0:
+		return nil, fmt.Errorf("archive has no images")
+	case len(matches) == 0:
+		return nil, fmt.Errorf("no image in the archive matches %s", sel)
+	case len(matches) > 1:
+		var names []string
+		for _, i := range matches {
+			names = append(names, i.String())
+		}
+		return nil, fmt.Errorf("archive has %d images, select one by ref or platform: %s", len(matches), strings.Join(names, ", "))
+	}
+	return matches[0], nil
+}
+
+// load loads every image in a docker (manifest.json) or OCI (index.json) archive
+// whose files are read within limits
+func load(a archive, limits Limits) ([]*Tar, error) {
+	images, err := loadImages(a)
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range images {
+		i.limits = limits
+	}
+	return images, nil
+}
+
+func loadImages(a archive) ([]*Tar, error) {
+	data, err := a.readFile("manifest.json")
+	if err == nil {
+		return loadDocker(a, data)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	data, err = a.readFile(OCIIndexFile)
+	if err == nil {
+		return loadOCI(a, data)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	if _, err := a.readFile("repositories"); err == nil {
+		return nil, fmt.Errorf("archive has no manifest.json (docker save archives from before docker 1.10 are not supported)")
+	}
+	return nil, fmt.Errorf("archive has neither a manifest.json nor an OCI %s", OCIIndexFile)
+}
+
+// loadDocker loads every image listed in a docker manifest.json
+func loadDocker(a archive, data []byte) ([]*Tar, error) {
+	var manifests []Manifest
+	if err := json.Unmarshal(data, &manifests); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest.json: %v", err)
+	}
+
+	var repositories []byte
+	if len(manifests) == 1 {
+		// the repositories file can only be matched to an image when there is just one
+		repositories, _ = a.readFile("repositories")
+	}
+
+	var images []*Tar
+	for _, m := range manifests {
+		rawJSON, err := a.readFile(m.Config)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("image config %s not found in archive", m.Config)
+		} else if err != nil {
+			return nil, err
+		}
+		config, err := NewFromJSON(rawJSON)
+		if err != nil {
+			return nil, err
+		}
+		i := &Tar{
+			Manifest: m,
+			Config:   config,
+		}
+		i.Tag = imageTag(m, repositories)
+		if len(i.Tag) == 0 {
+			i.Tag = untagged(i.ID())
+		}
+		if err := i.loadLayers(a, nil); err != nil {
+			return nil, err
+		}
+		images = append(images, i)
+	}
+	return images, nil
+}
+
+// untagged is the name shown for an untagged image
+func untagged(id string) string {
+	if len(id) > 12 {
+		id = id[:12]
+	}
+	return "<untagged> " + id
+}
+
+// ID returns the image's ID (the hex digest of its config)
+func (i *Tar) ID() string {
+	return fmt.Sprintf("%x", sha256.Sum256(i.Config.RawJSON()))
+}
+
+// Match returns true if the image is selected by sel. Refs match the image's repo
+// tags (or OCI ref names) or a prefix of its ID.
+func (i *Tar) Match(sel Selector) bool {
+	if len(sel.Ref) > 0 && !contains(i.Manifest.RepoTags, sel.Ref) {
+		id := strings.TrimPrefix(sel.Ref, "sha256:")
+		if len(id) < 4 || !strings.HasPrefix(i.ID(), id) {
+			return false
+		}
+	}
+	return sel.matchPlatform(i.Config.OS, i.Config.Architecture, i.Config.Variant)
+}
+
+func (i *Tar) String() string {
+	return fmt.Sprintf("%s (%s)", i.Tag, i.Config.Platform())
+}
+
+// loadLayers loads the manifest's layers in the order of the config's rootfs
+// diff_ids and matches them to the history entries that created them.
+// mediaTypes maps layer paths to their media types, if the archive has them.
+func (i *Tar) loadLayers(a archive, mediaTypes map[string]string) error {
+	var blobs []*layerBlob
+	var paths []string
+	byDiffID := make(map[string]int)
+	for _, layerPath := range i.Manifest.Layers {
+		blob, err := a.layer(layerPath)
+		if err != nil {
+			return err
+		}
+		byDiffID[blob.diffID] = len(blobs)
+		blobs = append(blobs, blob)
+		paths = append(paths, layerPath)
+	}
+
+	if diffIDs := i.Config.RootFS.DiffIDs; len(diffIDs) > 0 {
+		var ordered []*layerBlob
+		var orderedPaths []string
+		for _, id := range diffIDs {
+			idx, ok := byDiffID[string(id)]
+			if !ok {
+				return fmt.Errorf("image %s: no layer in the archive has diff_id %s", i.Tag, id)
+			}
+			ordered = append(ordered, blobs[idx])
+			orderedPaths = append(orderedPaths, paths[idx])
+		}
+		if len(ordered) != len(blobs) {
+			log.Warnf("image %s: the manifest has %d layers but the config only lists %d", i.Tag, len(blobs), len(ordered))
+		}
+		blobs, paths = ordered, orderedPaths
+		i.Manifest.Layers = paths
+	}
+
+	var history []imageHistory
+	for _, h := range i.Config.History {
+		if !h.EmptyLayer {
+			history = append(history, h)
+		}
+	}
+
+	i.Layers = make([]Layer, len(blobs))
+	i.RefTrees = nil
+	i.blobs = blobs
+	i.merged = nil
+	i.changes = nil
+	for idx, blob := range blobs {
+		var h imageHistory
+		if idx < len(history) {
+			h = history[idx]
+		}
+		h.Size = blob.tree.FileSize
+		i.Layers[idx] = &dockerLayer{
+			image:     i,
+			history:   h,
+			index:     idx,
+			tree:      blob.tree,
+			tarPath:   paths[idx],
+			blob:      blob,
+			mediaType: mediaTypes[paths[idx]],
+		}
+		i.RefTrees = append(i.RefTrees, blob.tree)
+	}
+
+	return nil
+}
+
+func (sel Selector) String() string {
+	var parts []string
+	if len(sel.Ref) > 0 {
+		parts = append(parts, "ref "+sel.Ref)
+	}
+	if len(sel.Platform) > 0 {
+		parts = append(parts, "platform "+sel.Platform)
+	}
+	return strings.Join(parts, " and ")
+}
+
+// resolveLink follows the links to a file in an image archive
+func resolveLink(links map[string]string, name string) string {
+	for n := 0; n < 16; n++ {
+		target, ok := links[name]
+		if !ok {
+			break
+		}
+		name = target
+	}
+	return name
+}
+
+// imageTag returns the image's first repo tag, falling back to the docker save
+// repositories file, or an empty string for untagged images
+func imageTag(m Manifest, repositories []byte) string {
+	if len(m.RepoTags) > 0 {
+		return m.RepoTags[0]
+	}
+	var repos map[string]map[string]string
+	if err := json.Unmarshal(repositories, &repos); err == nil {
+		var tags []string
+		for repo, ids := range repos {
+			for tag := range ids {
+				tags = append(tags, repo+":"+tag)
+			}
+		}
+		if len(tags) > 0 {
+			sort.Strings(tags)
+			return tags[0]
+		}
+	}
+	return ""
+}
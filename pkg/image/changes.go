@@ -0,0 +1,124 @@
+package image
+
+import (
+	"path"
+	"sort"
+
+	"github.com/wagoodman/dive/dive/filetree"
+)
+
+// Changes are the paths a layer adds, modifies or removes compared with the
+// filesystem of the layers under it
+type Changes struct {
+	// Added are the files that aren't in the lower layers
+	Added []string `json:"added"`
+	// Modified are the files whose type, mode, owner, link target, size or
+	// contents differ from the lower layers'
+	Modified []string `json:"modified"`
+	// Removed are the files of the lower layers the layer deletes with
+	// whiteouts or hides under opaque directories
+	Removed []string `json:"removed"`
+}
+
+// layerChanges returns the changes of every layer, which are found by
+// stacking the layers one at a time
+func (i *Tar) layerChanges() ([]*Changes, error) {
+	if i.changes != nil {
+		return i.changes, nil
+	}
+	m := newMerged()
+	changes := make([]*Changes, len(i.blobs))
+	for idx, blob := range i.blobs {
+		var err error
+		if changes[idx], err = i.diff(m, blob); err != nil {
+			return nil, err
+		}
+		if err := m.add(idx, blob); err != nil {
+			return nil, err
+		}
+	}
+	i.changes = changes
+	return changes, nil
+}
+
+// diff compares a layer with the merged filesystem of the layers under it
+func (i *Tar) diff(lower *Merged, blob *layerBlob) (*Changes, error) {
+	c := &Changes{Added: []string{}, Modified: []string{}, Removed: []string{}}
+	removed := make(map[string]bool)
+
+	for _, dir := range blob.opaque {
+		node, err := lower.Tree.GetNode(dir)
+		if err != nil {
+			continue
+		}
+		// the files under an opaque directory that the layer doesn't add again are removed
+		err = node.VisitDepthParentFirst(func(n *filetree.FileNode) error {
+			p := n.Path()
+			if n == node || removed[p] {
+				return nil
+			}
+			if _, err := blob.tree.GetNode(p); err != nil {
+				removed[p] = true
+				c.Removed = append(c.Removed, p)
+			}
+			return nil
+		}, func(n *filetree.FileNode) bool {
+			return !removed[path.Dir(n.Path())]
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := blob.tree.VisitDepthParentFirst(func(node *filetree.FileNode) error {
+		p := node.Path()
+		info := node.Data.FileInfo
+		switch {
+		case node.IsWhiteout():
+			if _, err := lower.Tree.GetNode(p); err == nil && !removed[p] {
+				removed[p] = true
+				c.Removed = append(c.Removed, p)
+			}
+		case len(info.Path) == 0:
+			// a parent directory that isn't in the layer tar
+		default:
+			if _, err := lower.Tree.GetNode(p); err != nil {
+				c.Added = append(c.Added, p)
+			} else if i.modifies(lower, p, blob.files[p]) {
+				c.Modified = append(c.Modified, p)
+			}
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(c.Added)
+	sort.Strings(c.Modified)
+	sort.Strings(c.Removed)
+	return c, nil
+}
+
+// modifies returns true if a layer's entry for p changes the lower layers'
+// file. The type, mode and owner are compared with dive's comparison, whose
+// hash of the contents is the same for every file as getFileList reads them
+// first (and isn't kept in an index), so the link targets, sizes and content
+// hashes are compared too.
+func (i *Tar) modifies(lower *Merged, p string, upper *layerEntry) bool {
+	if upper == nil {
+		return false
+	}
+	var entry *layerEntry
+	if idx, ok := lower.Layer(p); ok {
+		entry = i.blobs[idx].files[p]
+	}
+	if entry == nil {
+		// a directory only implied by the paths under it
+		return !upper.IsDir
+	}
+	return entry.FileInfo.Compare(upper.FileInfo) == filetree.Modified ||
+		entry.Linkname != upper.Linkname ||
+		entry.Size != upper.Size ||
+		entry.Hash != upper.Hash
+}
@@ -0,0 +1,106 @@
+package image
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestChanges(t *testing.T) {
+	chmod := func(e testEntry, mode int64) testEntry {
+		e.hdr.Mode = mode
+		return e
+	}
+	tests := []struct {
+		name   string
+		layers [][]testEntry
+		// want are the changes of the top layer
+		want Changes
+	}{
+		{
+			name: "added, modified and removed",
+			layers: [][]testEntry{
+				{dir("etc/"), file("etc/a", "a"), file("etc/b", "b")},
+				{dir("etc/"), file("etc/a", "changed"), file("etc/.wh.b", ""), file("etc/c", "c")},
+			},
+			want: Changes{Added: []string{"/etc/c"}, Modified: []string{"/etc/a"}, Removed: []string{"/etc/b"}},
+		},
+		{
+			name: "identical re-add",
+			layers: [][]testEntry{
+				{dir("etc/"), file("etc/a", "a"), symlink("etc/l", "a")},
+				{dir("etc/"), file("etc/a", "a"), symlink("etc/l", "a")},
+			},
+			want: Changes{Added: []string{}, Modified: []string{}, Removed: []string{}},
+		},
+		{
+			name: "same size contents",
+			layers: [][]testEntry{
+				{file("a", "aaaa"), file("b", "bbbb")},
+				{file("a", "abcd"), file("b", "bbbb")},
+			},
+			want: Changes{Added: []string{}, Modified: []string{"/a"}, Removed: []string{}},
+		},
+		{
+			name: "mode and link target",
+			layers: [][]testEntry{
+				{file("run", "x"), symlink("l", "t1")},
+				{chmod(file("run", "x"), 0755), symlink("l", "t2")},
+			},
+			want: Changes{Added: []string{}, Modified: []string{"/l", "/run"}, Removed: []string{}},
+		},
+		{
+			name: "whiteout of a file that was never there",
+			layers: [][]testEntry{
+				{dir("etc/"), file("etc/a", "a")},
+				{file("etc/.wh.b", "")},
+			},
+			want: Changes{Added: []string{}, Modified: []string{}, Removed: []string{}},
+		},
+		{
+			name: "whiteout of a directory",
+			layers: [][]testEntry{
+				{dir("var/"), dir("var/cache/"), file("var/cache/a", "a")},
+				{file("var/.wh.cache", "")},
+			},
+			want: Changes{Added: []string{}, Modified: []string{}, Removed: []string{"/var/cache"}},
+		},
+		{
+			name: "opaque directory re-adding a file",
+			layers: [][]testEntry{
+				{dir("app/"), file("app/a", "a"), file("app/b", "b"), dir("app/lib/"), file("app/lib/x.so", "x")},
+				{dir("app/"), file("app/.wh..wh..opq", ""), file("app/a", "a"), file("app/new", "new")},
+			},
+			want: Changes{Added: []string{"/app/new"}, Modified: []string{}, Removed: []string{"/app/b", "/app/lib"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var layers [][]byte
+			for _, entries := range tt.layers {
+				layers = append(layers, layerTar(t, entries...))
+			}
+
+			// files read from an index are compared by their contents too
+			indexed, err := parseIndexed(t, writeArchive(t, t.TempDir(), layers...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, i := range []*Tar{parseImage(t, layers...), indexed} {
+				base, err := i.Layers[0].Changes()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(base.Modified) != 0 || len(base.Removed) != 0 || len(base.Added) == 0 {
+					t.Fatalf("the base layer has changes %+v", base)
+				}
+				c, err := i.Layers[len(i.Layers)-1].Changes()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(*c, tt.want) {
+					t.Fatalf("changes are %+v, expected %+v", *c, tt.want)
+				}
+			}
+		})
+	}
+}
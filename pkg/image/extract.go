@@ -0,0 +1,659 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/blacktop/graboid/pkg/compress"
+)
+
+// Target is where the files extracted from an image are written
+type Target interface {
+	// Dir creates a directory
+	Dir(name string, fi fs.FileInfo) error
+	// File writes a regular file
+	File(name string, fi fs.FileInfo, r io.Reader) error
+	// Symlink creates a symbolic link
+	Symlink(name, target string, fi fs.FileInfo) error
+	// Link creates a hard link to a file that has already been written
+	Link(name, target string, fi fs.FileInfo) error
+	// Close finishes the extraction
+	Close() error
+}
+
+// fsPath converts an absolute or relative path in an image to an io/fs path
+func fsPath(name string) string {
+	p := strings.TrimPrefix(path.Clean("/"+name), "/")
+	if len(p) == 0 {
+		return "."
+	}
+	return p
+}
+
+// Glob returns the sorted paths in fsys matched by the patterns, which are
+// absolute or relative to the image's root and may use path.Match wildcards.
+// It is an error for a pattern to match nothing.
+func Glob(fsys fs.FS, patterns ...string) ([]string, error) {
+	seen := make(map[string]bool)
+	var paths []string
+	for _, pattern := range patterns {
+		matches, err := fs.Glob(fsys, fsPath(pattern))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", pattern, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no file in the image matches %s", pattern)
+		}
+		for _, m := range matches {
+			if !seen[m] {
+				seen[m] = true
+				paths = append(paths, m)
+			}
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// extractItem is a file to extract
+type extractItem struct {
+	name string
+	fi   fs.FileInfo
+	// link is the extracted file a hard link links to
+	link string
+}
+
+// walkPaths lists the files to extract for paths, including everything under
+// the ones that are directories. Hard links whose target is extracted too are
+// extracted as links, after every other file.
+func walkPaths(fsys fs.FS, paths []string) ([]extractItem, []extractItem, error) {
+	seen := make(map[string]bool)
+	var items, links []extractItem
+	var files []extractItem
+	for _, root := range paths {
+		err := fs.WalkDir(fsys, fsPath(root), func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if seen[p] {
+				if d.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			seen[p] = true
+
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			switch {
+			case fi.IsDir(), fi.Mode()&fs.ModeSymlink != 0:
+				items = append(items, extractItem{name: p, fi: fi})
+			case fi.Mode().IsRegular():
+				files = append(files, extractItem{name: p, fi: fi})
+			default:
+				log.Debugf("skipping %s (%s)", p, fi.Mode().Type())
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// a hard link is extracted as a link to the first file with the same contents (which may be a link too)
+	for idx, f := range files {
+		if !isHardLink(f.fi) {
+			continue
+		}
+		for _, other := range files {
+			if other.name != f.name && len(other.link) == 0 && sameFile(f.fi, other.fi) {
+				files[idx].link = other.name
+				break
+			}
+		}
+	}
+	for _, f := range files {
+		if len(f.link) > 0 {
+			links = append(links, f)
+		} else {
+			items = append(items, f)
+		}
+	}
+	return items, links, nil
+}
+
+// isHardLink returns true if the file is a hard link in its layer
+func isHardLink(fi fs.FileInfo) bool {
+	hdr, ok := fi.Sys().(*tar.Header)
+	return ok && hdr.Typeflag == tar.TypeLink
+}
+
+// writeItem writes a file to t, opening its contents from fsys
+func writeItem(fsys fs.FS, t Target, item extractItem) error {
+	var err error
+	switch {
+	case len(item.link) > 0:
+		err = t.Link(item.name, item.link, item.fi)
+	case item.fi.IsDir():
+		err = t.Dir(item.name, item.fi)
+	case item.fi.Mode()&fs.ModeSymlink != 0:
+		var target string
+		if target, err = fs.ReadLink(fsys, item.name); err == nil {
+			err = t.Symlink(item.name, target, item.fi)
+		}
+	default:
+		var f fs.File
+		if f, err = fsys.Open(item.name); err == nil {
+			err = t.File(item.name, item.fi, f)
+			f.Close()
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", item.name, err)
+	}
+	return nil
+}
+
+// ExtractPaths writes the paths in fsys to t, along with everything under the
+// ones that are directories, and returns the number of files written. Files
+// keep their mode, owner, modification time and extended attributes, symlinks
+// are recreated and hard links are too when the file they link to is extracted.
+// Devices, fifos and sockets are skipped. t is not closed. It is an error for
+// the files to exceed limits.
+func ExtractPaths(fsys fs.FS, paths []string, t Target, limits Limits) (int, error) {
+	items, links, err := walkPaths(fsys, paths)
+	if err != nil {
+		return 0, err
+	}
+	if err := limits.checkExtract(items, links); err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, item := range append(items, links...) {
+		if err := writeItem(fsys, t, item); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// ExtractPathsFrom is ExtractPaths for an image parsed with Parse that reads
+// the files' contents in a single pass over the image archive read from r,
+// rather than reading the archive for every file
+func ExtractPathsFrom(r io.Reader, fsys *FS, paths []string, t Target, limits Limits) (int, error) {
+	items, links, err := walkPaths(fsys, paths)
+	if err != nil {
+		return 0, err
+	}
+	if err := limits.checkExtract(items, links); err != nil {
+		return 0, err
+	}
+
+	// the regular files are written as their layers are read
+	wanted := make(map[string]map[int64][]extractItem)
+	count := 0
+	for _, item := range items {
+		fi, ok := item.fi.(fileInfo)
+		if !item.fi.Mode().IsRegular() || !ok {
+			if err := writeItem(fsys, t, item); err != nil {
+				return count, err
+			}
+			count++
+			continue
+		}
+		blob := fsys.i.blobs[fi.layer]
+		entry, ok := blob.files[fi.src]
+		if !ok {
+			return count, fmt.Errorf("%s: not found in layer %s", item.name, blob.path)
+		}
+		if wanted[blob.path] == nil {
+			wanted[blob.path] = make(map[int64][]extractItem)
+		}
+		// several paths have the same contents when they are symlinks to the same file
+		wanted[blob.path][entry.Offset] = append(wanted[blob.path][entry.Offset], item)
+	}
+
+	if len(wanted) > 0 {
+		n, err := extractLayerFiles(r, wanted, t, limits)
+		count += n
+		if err != nil {
+			return count, err
+		}
+	}
+
+	for _, item := range links {
+		if err := writeItem(fsys, t, item); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// extractLayerFiles writes the files wanted from each layer (by the offset of
+// their entry in the layer tar) as the image archive is read from r, both of
+// which are decompressed within limits
+func extractLayerFiles(r io.Reader, wanted map[string]map[int64][]extractItem, t Target, limits Limits) (int, error) {
+	zr, err := compress.NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	defer zr.Close()
+
+	count := 0
+	tr := tar.NewReader(limits.reader(zr, "the archive"))
+	for len(wanted) > 0 {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+		files, ok := wanted[archiveName(hdr.Name)]
+		if hdr.Typeflag != tar.TypeReg || !ok {
+			continue
+		}
+		delete(wanted, archiveName(hdr.Name))
+
+		lr, err := compress.NewReader(tr)
+		if err != nil {
+			return count, err
+		}
+		cr := &countingReader{r: limits.reader(lr, archiveName(hdr.Name))}
+		ltr := tar.NewReader(cr)
+		for len(files) > 0 {
+			if _, err := ltr.Next(); err != nil {
+				lr.Close()
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return count, err
+			}
+			items, ok := files[cr.n]
+			if !ok {
+				continue
+			}
+			delete(files, cr.n)
+			if len(items) > 1 {
+				// the contents can only be read once
+				data, err := ioutil.ReadAll(ltr)
+				if err != nil {
+					lr.Close()
+					return count, err
+				}
+				for _, item := range items {
+					if err := t.File(item.name, item.fi, bytes.NewReader(data)); err != nil {
+						lr.Close()
+						return count, fmt.Errorf("%s: %w", item.name, err)
+					}
+					count++
+				}
+				continue
+			}
+			if err := t.File(items[0].name, items[0].fi, ltr); err != nil {
+				lr.Close()
+				return count, fmt.Errorf("%s: %w", items[0].name, err)
+			}
+			count++
+		}
+		lr.Close()
+	}
+
+	for name := range wanted {
+		return count, fmt.Errorf("layer %s not found in archive", name)
+	}
+	return count, nil
+}
+
+// maxLinkHops is the most symlinks followed resolving a symlink, like Linux
+const maxLinkHops = 40
+
+// DirTarget extracts files under a directory. It refuses to write through
+// symlinks it (or anything else) created in the directory, and to create
+// symlinks that point outside of it.
+type DirTarget struct {
+	root string
+	// Chown sets the owner of the extracted files to their uid and gid in the
+	// image, which usually requires root
+	Chown bool
+	// AbsoluteLinks allows symlinks to absolute paths, which only stay in the
+	// directory when it is used as a root filesystem (e.g. with chroot). A
+	// symlink's .. at the root then stays at the root, as it does in a chroot.
+	AbsoluteLinks bool
+	// dirs get their mode and modification time once their contents are extracted
+	dirs []extractItem
+	// symlinks are checked again once everything they may go through is extracted
+	symlinks []string
+}
+
+// NewDirTarget returns a target that extracts files under root
+func NewDirTarget(root string) (*DirTarget, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	return &DirTarget{root: root}, nil
+}
+
+// path returns where name is extracted to, creating its parent directories
+func (t *DirTarget) path(name string) (string, error) {
+	if err := checkPath(name); err != nil {
+		return "", err
+	}
+	if name == "." {
+		return t.root, nil
+	}
+	dir := t.root
+	elems := strings.Split(name, "/")
+	for _, elem := range elems[:len(elems)-1] {
+		dir = filepath.Join(dir, elem)
+		fi, err := os.Lstat(dir)
+		switch {
+		case os.IsNotExist(err):
+			if err := os.Mkdir(dir, 0755); err != nil {
+				return "", err
+			}
+		case err != nil:
+			return "", err
+		case fi.Mode()&os.ModeSymlink != 0:
+			return "", fmt.Errorf("refusing to write through the symlink %s", dir)
+		case !fi.IsDir():
+			return "", fmt.Errorf("%s is not a directory", dir)
+		}
+	}
+	return filepath.Join(dir, elems[len(elems)-1]), nil
+}
+
+// replace removes whatever but a directory is at p so it is replaced rather than written through
+func replace(p string) error {
+	if fi, err := os.Lstat(p); err == nil && !fi.IsDir() {
+		return os.Remove(p)
+	}
+	return nil
+}
+
+func (t *DirTarget) Dir(name string, fi fs.FileInfo) error {
+	p, err := t.path(name)
+	if err != nil {
+		return err
+	}
+	if err := replace(p); err != nil {
+		return err
+	}
+	// the directory stays writable until its contents are extracted
+	if err := os.Mkdir(p, 0700); err != nil && !os.IsExist(err) {
+		return err
+	}
+	if p != t.root {
+		t.dirs = append(t.dirs, extractItem{name: p, fi: fi})
+	}
+	return nil
+}
+
+func (t *DirTarget) File(name string, fi fs.FileInfo, r io.Reader) error {
+	p, err := t.path(name)
+	if err != nil {
+		return err
+	}
+	if err := replace(p); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return t.setMetadata(p, fi)
+}
+
+func (t *DirTarget) Symlink(name, target string, fi fs.FileInfo) error {
+	p, err := t.path(name)
+	if err != nil {
+		return err
+	}
+	if t.escapes(name, target) {
+		return fmt.Errorf("%w: symlink %s -> %s points outside of %s", ErrUnsafePath, name, target, t.root)
+	}
+	if err := replace(p); err != nil {
+		return err
+	}
+	if err := os.Symlink(target, p); err != nil {
+		return err
+	}
+	t.symlinks = append(t.symlinks, name)
+	return t.setMetadata(p, fi)
+}
+
+// escapes returns true if the symlink name to target leaves the directory,
+// following the symlinks already extracted that it goes through
+func (t *DirTarget) escapes(name, target string) bool {
+	var dir []string
+	if d := path.Dir(name); d != "." {
+		dir = strings.Split(d, "/")
+	}
+	elems := strings.Split(target, "/")
+	if path.IsAbs(target) {
+		return !t.AbsoluteLinks
+	}
+
+	for hops := 0; len(elems) > 0; {
+		elem := elems[0]
+		elems = elems[1:]
+		switch elem {
+		case "", ".":
+			continue
+		case "..":
+			if len(dir) == 0 {
+				if t.AbsoluteLinks {
+					continue
+				}
+				return true
+			}
+			dir = dir[:len(dir)-1]
+			continue
+		}
+
+		p := filepath.Join(t.root, filepath.FromSlash(path.Join(path.Join(dir...), elem)))
+		fi, err := os.Lstat(p)
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			// what doesn't exist (yet) is resolved as it is
+			dir = append(dir, elem)
+			continue
+		}
+		// a symlink loop doesn't resolve to anything
+		if hops++; hops > maxLinkHops {
+			return false
+		}
+		link, err := os.Readlink(p)
+		if err != nil {
+			return true
+		}
+		link = filepath.ToSlash(link)
+		if path.IsAbs(link) {
+			return !t.AbsoluteLinks
+		}
+		elems = append(strings.Split(link, "/"), elems...)
+	}
+	return false
+}
+
+func (t *DirTarget) Link(name, target string, fi fs.FileInfo) error {
+	p, err := t.path(name)
+	if err != nil {
+		return err
+	}
+	src, err := t.path(target)
+	if err != nil {
+		return err
+	}
+	if sfi, err := os.Lstat(src); err != nil {
+		return err
+	} else if !sfi.Mode().IsRegular() {
+		return fmt.Errorf("hard link target %s is not a regular file", target)
+	}
+	if err := replace(p); err != nil {
+		return err
+	}
+	return os.Link(src, p)
+}
+
+// Close removes the extracted symlinks that point outside of the directory
+// through symlinks extracted after them, and sets the mode and modification
+// time of the extracted directories, deepest first
+func (t *DirTarget) Close() error {
+	var unsafe error
+	for _, name := range t.symlinks {
+		p := filepath.Join(t.root, filepath.FromSlash(name))
+		target, err := os.Readlink(p)
+		if err != nil {
+			// it was replaced since
+			continue
+		}
+		if t.escapes(name, filepath.ToSlash(target)) {
+			if err := os.Remove(p); err != nil {
+				return err
+			}
+			if unsafe == nil {
+				unsafe = fmt.Errorf("%w: symlink %s -> %s points outside of %s", ErrUnsafePath, name, target, t.root)
+			}
+		}
+	}
+	t.symlinks = nil
+
+	for idx := len(t.dirs) - 1; idx >= 0; idx-- {
+		if err := t.setMetadata(t.dirs[idx].name, t.dirs[idx].fi); err != nil {
+			return err
+		}
+	}
+	t.dirs = nil
+	return unsafe
+}
+
+// setMetadata sets the owner, mode, extended attributes and modification time
+// of an extracted file (symlinks keep their mode)
+func (t *DirTarget) setMetadata(p string, fi fs.FileInfo) error {
+	hdr, _ := fi.Sys().(*tar.Header)
+	symlink := fi.Mode()&fs.ModeSymlink != 0
+
+	if t.Chown && hdr != nil {
+		if err := os.Lchown(p, hdr.Uid, hdr.Gid); err != nil {
+			return err
+		}
+	}
+	// changing the owner clears the setuid and setgid bits so the mode is set after it
+	if !symlink {
+		mode := fi.Mode() & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)
+		if err := os.Chmod(p, mode); err != nil {
+			return err
+		}
+	}
+	if hdr != nil {
+		for key, value := range hdr.PAXRecords {
+			if !strings.HasPrefix(key, paxXattr) {
+				continue
+			}
+			// filesystems and unprivileged users may not support every attribute, tar only warns too
+			if err := lsetxattr(p, strings.TrimPrefix(key, paxXattr), []byte(value)); err != nil {
+				log.Warnf("failed to set extended attribute %s on %s: %v", strings.TrimPrefix(key, paxXattr), p, err)
+			}
+		}
+	}
+	if !fi.ModTime().IsZero() {
+		if err := lutimes(p, fi.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TarTarget writes the extracted files to a tar stream
+type TarTarget struct {
+	tw *tar.Writer
+}
+
+// NewTarTarget returns a target that writes a tar stream to w
+func NewTarTarget(w io.Writer) *TarTarget {
+	return &TarTarget{tw: tar.NewWriter(w)}
+}
+
+// tarHeader returns the tar header of an extracted file, keeping its owner and extended attributes
+func tarHeader(name string, fi fs.FileInfo, link string) (*tar.Header, error) {
+	if err := checkPath(name); err != nil {
+		return nil, err
+	}
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return nil, err
+	}
+	hdr.Name = name
+	if fi.IsDir() {
+		hdr.Name += "/"
+	}
+	return hdr, nil
+}
+
+func (t *TarTarget) Dir(name string, fi fs.FileInfo) error {
+	if fsPath(name) == "." {
+		return nil
+	}
+	hdr, err := tarHeader(name, fi, "")
+	if err != nil {
+		return err
+	}
+	return t.tw.WriteHeader(hdr)
+}
+
+func (t *TarTarget) File(name string, fi fs.FileInfo, r io.Reader) error {
+	hdr, err := tarHeader(name, fi, "")
+	if err != nil {
+		return err
+	}
+	// a hard link whose target isn't extracted is written as a copy of it
+	hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeReg, "", fi.Size()
+	if err := t.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(t.tw, r)
+	return err
+}
+
+func (t *TarTarget) Symlink(name, target string, fi fs.FileInfo) error {
+	hdr, err := tarHeader(name, fi, target)
+	if err != nil {
+		return err
+	}
+	return t.tw.WriteHeader(hdr)
+}
+
+func (t *TarTarget) Link(name, target string, fi fs.FileInfo) error {
+	hdr, err := tarHeader(name, fi, "")
+	if err != nil {
+		return err
+	}
+	hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeLink, target, 0
+	return t.tw.WriteHeader(hdr)
+}
+
+// Close writes the end of the tar stream, it does not close the underlying writer
+func (t *TarTarget) Close() error {
+	return t.tw.Close()
+}
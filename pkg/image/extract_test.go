@@ -0,0 +1,283 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// extractLayer is a layer with modes, owners, modification times, extended attributes and links
+func extractLayer(t testing.TB) []byte {
+	at := func(e testEntry, mode int64, mtime time.Time) testEntry {
+		e.hdr.Mode, e.hdr.ModTime = mode, mtime
+		e.hdr.Uid, e.hdr.Gid, e.hdr.Uname, e.hdr.Gname = 1000, 100, "app", "users"
+		return e
+	}
+	script := at(file("opt/app/run.sh", "#!/bin/sh\necho hi\n"), 0755, testTime.Add(2*time.Hour))
+	script.hdr.PAXRecords = map[string]string{paxXattr + "user.origin": "test"}
+	return layerTar(t,
+		at(dir("opt/"), 0755, testTime),
+		at(dir("opt/app/"), 0750, testTime.Add(time.Hour)),
+		script,
+		at(file("opt/app/suid", "x"), 04711, testTime.Add(3*time.Hour)),
+		at(dir("opt/app/tmp/"), 01777, testTime.Add(4*time.Hour)),
+		at(symlink("opt/app/current", "run.sh"), 0777, testTime.Add(5*time.Hour)),
+		at(hardlink("opt/app/start.sh", "opt/app/run.sh"), 0755, testTime.Add(6*time.Hour)),
+	)
+}
+
+// checkExtracted checks the metadata of what extractLayer extracted under root
+func checkExtracted(t *testing.T, root string) {
+	t.Helper()
+	for name, want := range map[string]struct {
+		mode  fs.FileMode
+		mtime time.Time
+	}{
+		"opt":             {fs.ModeDir | 0755, testTime},
+		"opt/app":         {fs.ModeDir | 0750, testTime.Add(time.Hour)},
+		"opt/app/run.sh":  {0755, testTime.Add(2 * time.Hour)},
+		"opt/app/suid":    {fs.ModeSetuid | 0711, testTime.Add(3 * time.Hour)},
+		"opt/app/tmp":     {fs.ModeDir | fs.ModeSticky | 0777, testTime.Add(4 * time.Hour)},
+		"opt/app/current": {fs.ModeSymlink, testTime.Add(5 * time.Hour)},
+	} {
+		fi, err := os.Lstat(filepath.Join(root, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		mode := fi.Mode()
+		if mode&fs.ModeSymlink != 0 {
+			mode = fs.ModeSymlink
+		}
+		if mode != want.mode {
+			t.Errorf("%s: mode is %s, expected %s", name, mode, want.mode)
+		}
+		if !fi.ModTime().Equal(want.mtime) {
+			t.Errorf("%s: modified at %s, expected %s", name, fi.ModTime(), want.mtime)
+		}
+	}
+
+	if target, err := os.Readlink(filepath.Join(root, "opt/app/current")); err != nil || target != "run.sh" {
+		t.Errorf("opt/app/current links to %q (%v), expected run.sh", target, err)
+	}
+	run, err := os.Stat(filepath.Join(root, "opt/app/run.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start, err := os.Stat(filepath.Join(root, "opt/app/start.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(run, start) {
+		t.Error("opt/app/start.sh isn't a hard link to opt/app/run.sh")
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(root, "opt/app/start.sh")); err != nil || string(data) != "#!/bin/sh\necho hi\n" {
+		t.Errorf("opt/app/start.sh has %q (%v)", data, err)
+	}
+}
+
+func TestExtractPaths(t *testing.T) {
+	archive := imageArchive(t, extractLayer(t))
+	fsys := testFSFrom(t, archive)
+
+	t.Run("ExtractPaths", func(t *testing.T) {
+		root := t.TempDir()
+		dt, err := NewDirTarget(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n, err := ExtractPaths(fsys, []string{"/opt"}, dt, DefaultLimits()); err != nil || n != 7 {
+			t.Fatalf("extracted %d files: %v", n, err)
+		}
+		if err := dt.Close(); err != nil {
+			t.Fatal(err)
+		}
+		checkExtracted(t, root)
+	})
+
+	t.Run("ExtractPathsFrom", func(t *testing.T) {
+		root := t.TempDir()
+		dt, err := NewDirTarget(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n, err := ExtractPathsFrom(bytes.NewReader(archive), fsys, []string{"opt"}, dt, DefaultLimits()); err != nil || n != 7 {
+			t.Fatalf("extracted %d files: %v", n, err)
+		}
+		if err := dt.Close(); err != nil {
+			t.Fatal(err)
+		}
+		checkExtracted(t, root)
+	})
+
+	t.Run("link without its target", func(t *testing.T) {
+		root := t.TempDir()
+		dt, err := NewDirTarget(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ExtractPaths(fsys, []string{"opt/app/start.sh"}, dt, DefaultLimits()); err != nil {
+			t.Fatal(err)
+		}
+		if err := dt.Close(); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Lstat(filepath.Join(root, "opt/app/start.sh"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fi.Mode().IsRegular() || fi.Size() != 18 {
+			t.Fatalf("expected a copy of opt/app/run.sh, got %s of %d bytes", fi.Mode(), fi.Size())
+		}
+	})
+}
+
+func TestTarTarget(t *testing.T) {
+	fsys := testFSFrom(t, imageArchive(t, extractLayer(t)))
+	var buf bytes.Buffer
+	tt := NewTarTarget(&buf)
+	if _, err := ExtractPaths(fsys, []string{"opt"}, tt, DefaultLimits()); err != nil {
+		t.Fatal(err)
+	}
+	if err := tt.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the headers written are the layer's, but for the hard link's mode
+	want := make(map[string]*tar.Header)
+	tr := tar.NewReader(bytes.NewReader(extractLayer(t)))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[hdr.Name] = hdr
+	}
+
+	tr = tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, ok := want[hdr.Name]
+		if !ok {
+			t.Fatalf("unexpected %s", hdr.Name)
+		}
+		delete(want, hdr.Name)
+		if hdr.Typeflag != w.Typeflag || hdr.Linkname != w.Linkname || hdr.Size != w.Size ||
+			hdr.Mode != w.Mode || !hdr.ModTime.Equal(w.ModTime) ||
+			hdr.Uid != w.Uid || hdr.Gid != w.Gid || hdr.Uname != w.Uname || hdr.Gname != w.Gname ||
+			hdr.PAXRecords[paxXattr+"user.origin"] != w.PAXRecords[paxXattr+"user.origin"] {
+			t.Errorf("%s: header is\n%+v\nexpected\n%+v", hdr.Name, hdr, w)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			data, err := ioutil.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if int64(len(data)) != w.Size {
+				t.Errorf("%s: %d bytes of contents, expected %d", hdr.Name, len(data), w.Size)
+			}
+		}
+	}
+	for name := range want {
+		t.Errorf("%s is missing", name)
+	}
+}
+
+func TestDirTargetUnsafe(t *testing.T) {
+	root := t.TempDir()
+	dt, err := NewDirTarget(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := testFS(t, layerTar(t, file("f", "x"))).Stat("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"../f", "/f", "a/../../f"} {
+		if err := dt.File(name, fi, bytes.NewReader(nil)); err == nil {
+			t.Errorf("%s: expected an unsafe path", name)
+		}
+	}
+	if err := dt.Symlink("up", "..", fi); err == nil {
+		t.Error("expected a symlink to the parent directory to be refused")
+	}
+	if err := dt.Symlink("abs", "/etc/passwd", fi); err == nil {
+		t.Error("expected an absolute symlink to be refused")
+	}
+	// writing through a symlink that was extracted is refused
+	if err := dt.Symlink("d", ".", fi); err != nil {
+		t.Fatal(err)
+	}
+	if err := dt.File("d/f", fi, bytes.NewReader(nil)); err == nil {
+		t.Error("expected writing through a symlink to be refused")
+	}
+	if err := dt.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDirTargetAbsoluteLinks(t *testing.T) {
+	fsys := testFS(t, layerTar(t, file("f", "x"), symlink("l", "f")))
+	fi, err := fsys.Lstat("l")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ffi, err := fsys.Stat("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	links := []struct{ name, target string }{
+		{"abs", "/etc/passwd"},
+		// .. at the root of a root filesystem stays there
+		{"a/up", "../../../etc/x"},
+		{"a/b/up", "../../.."},
+	}
+
+	for _, absolute := range []bool{false, true} {
+		sandbox := t.TempDir()
+		dt, err := NewDirTarget(filepath.Join(sandbox, "root"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dt.AbsoluteLinks = absolute
+		for _, l := range links {
+			if err := dt.Symlink(l.name, l.target, fi); (err == nil) != absolute {
+				t.Errorf("absolute links %v: symlink %s -> %s: %v", absolute, l.name, l.target, err)
+			}
+		}
+		// a symlink through one that goes above the root resolves from the root
+		if absolute {
+			if err := dt.Symlink("a/chain", "b/up/../etc/x", fi); err != nil {
+				t.Error(err)
+			}
+		}
+		// what the symlinks point to is never written through them
+		if err := dt.File("a/up/evil", ffi, bytes.NewReader(nil)); absolute && err == nil {
+			t.Error("expected writing through a symlink to be refused")
+		}
+		if err := dt.Close(); err != nil {
+			t.Fatal(err)
+		}
+		entries, err := ioutil.ReadDir(sandbox)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 {
+			t.Fatalf("absolute links %v: wrote outside of the root: %d entries", absolute, len(entries))
+		}
+	}
+}
@@ -0,0 +1,592 @@
+package image
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/blacktop/graboid/pkg/compress"
+	"github.com/wagoodman/dive/dive/filetree"
+)
+
+// maxSymlinks is the most symlinks followed while resolving a path
+const maxSymlinks = 40
+
+var (
+	_ fs.ReadDirFS  = (*FS)(nil)
+	_ fs.StatFS     = (*FS)(nil)
+	_ fs.ReadFileFS = (*FS)(nil)
+)
+
+// FS is a read-only io/fs filesystem over an image's merged filesystem or over one
+// of its layers. Symlinks resolve within the image's root and file contents are
+// read from the image archive when they are opened.
+type FS struct {
+	i *Tar
+	// layer is the index of the layer or -1 for the merged filesystem
+	layer  int
+	merged *Merged
+	// open returns a layer's uncompressed tar
+	open func(blob *layerBlob) (io.ReadCloser, error)
+	// openAt returns a layer's uncompressed tar from an offset, if the archive can be seeked
+	openAt func(blob *layerBlob, off int64) (io.ReadCloser, error)
+}
+
+// NewFS returns the merged filesystem of an image parsed with Parse.
+// open reopens the image archive each time a file's contents are read.
+func NewFS(i *Tar, open func() (io.ReadCloser, error)) (*FS, error) {
+	return i.newFS(func(blob *layerBlob) (io.ReadCloser, error) {
+		r, err := open()
+		if err != nil {
+			return nil, err
+		}
+		lr, err := openLayer(r, blob, i.limits)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		return readCloser{Reader: lr, closers: []io.Closer{lr, r}}, nil
+	})
+}
+
+// NewDirFS returns the merged filesystem of an image parsed with ParseDir.
+// Files are read by seeking to them in their layer's file.
+func NewDirFS(i *Tar, dir string) (*FS, error) {
+	fsys, err := i.newFS(func(blob *layerBlob) (io.ReadCloser, error) {
+		return openDirLayer(dir, blob, i.limits)
+	})
+	if err != nil {
+		return nil, err
+	}
+	fsys.openAt = func(blob *layerBlob, off int64) (io.ReadCloser, error) {
+		p, err := (&dirArchive{dir: dir}).path(blob.path)
+		if err != nil {
+			return nil, err
+		}
+		return openAt(blob.compression, blob.checkpoints, func(layerOff int64) (io.ReadCloser, error) {
+			return openFileAt(p, layerOff)
+		}, off)
+	}
+	return fsys, nil
+}
+
+func (i *Tar) newFS(open func(blob *layerBlob) (io.ReadCloser, error)) (*FS, error) {
+	m, err := i.Merged()
+	if err != nil {
+		return nil, err
+	}
+	return &FS{i: i, layer: -1, merged: m, open: open}, nil
+}
+
+// Layer returns the filesystem of the image's layer idx
+func (fsys *FS) Layer(idx int) (*FS, error) {
+	if idx < 0 || idx >= len(fsys.i.blobs) {
+		return nil, fmt.Errorf("image has no layer %d", idx)
+	}
+	layer := *fsys
+	layer.layer = idx
+	return &layer, nil
+}
+
+// OpenLayer returns the uncompressed tar of the image's layer idx
+func (fsys *FS) OpenLayer(idx int) (io.ReadCloser, error) {
+	if idx < 0 || idx >= len(fsys.i.blobs) {
+		return nil, fmt.Errorf("image has no layer %d", idx)
+	}
+	return fsys.open(fsys.i.blobs[idx])
+}
+
+// readCloser closes every closer when it is closed
+type readCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r readCloser) Close() error {
+	var err error
+	for _, c := range r.closers {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// openLayer returns the uncompressed tar of a layer in the image archive read
+// from r, both of which are decompressed within limits
+func openLayer(r io.Reader, blob *layerBlob, limits Limits) (io.ReadCloser, error) {
+	zr, err := compress.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(limits.reader(zr, "the archive"))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			zr.Close()
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg || archiveName(hdr.Name) != blob.path {
+			continue
+		}
+		lr, err := compress.NewReader(tr)
+		if err != nil {
+			zr.Close()
+			return nil, err
+		}
+		return readCloser{Reader: limits.reader(lr, blob.path), closers: []io.Closer{lr, zr}}, nil
+	}
+	zr.Close()
+	return nil, fmt.Errorf("layer %s not found in archive", blob.path)
+}
+
+// openDirLayer returns the uncompressed tar of a layer in an image archive
+// extracted to dir, decompressed within limits
+func openDirLayer(dir string, blob *layerBlob, limits Limits) (io.ReadCloser, error) {
+	p, err := (&dirArchive{dir: dir}).path(blob.path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	lr, err := compress.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return readCloser{Reader: limits.reader(lr, blob.path), closers: []io.Closer{lr, f}}, nil
+}
+
+// node returns the node at an absolute path without following symlinks
+func (fsys *FS) node(p string) (*filetree.FileNode, bool) {
+	tree := fsys.merged.Tree
+	if fsys.layer >= 0 {
+		tree = fsys.i.blobs[fsys.layer].tree
+	}
+	node, err := tree.GetNode(p)
+	if err != nil || node.IsWhiteout() {
+		return nil, false
+	}
+	return node, true
+}
+
+// lookup resolves name to an absolute path and its node, following symlinks in
+// every directory of the path and in the last element too if follow is set
+func (fsys *FS) lookup(op, name string, follow bool) (string, *filetree.FileNode, error) {
+	if !fs.ValidPath(name) {
+		return "", nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	resolved := "/"
+	var elems []string
+	if name != "." {
+		elems = strings.Split(name, "/")
+	}
+	node, _ := fsys.node(resolved)
+
+	for links := 0; len(elems) > 0; {
+		elem := elems[0]
+		elems = elems[1:]
+		switch elem {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Dir(resolved)
+			node, _ = fsys.node(resolved)
+			continue
+		}
+
+		p := path.Join(resolved, elem)
+		next, ok := fsys.node(p)
+		if !ok {
+			return "", nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+
+		if next.Data.FileInfo.TypeFlag == tar.TypeSymlink && (len(elems) > 0 || follow) {
+			if links++; links > maxSymlinks {
+				return "", nil, &fs.PathError{Op: op, Path: name, Err: errors.New("too many levels of symbolic links")}
+			}
+			target := next.Data.FileInfo.Linkname
+			if path.IsAbs(target) {
+				// absolute symlinks resolve from the image's root rather than the host's
+				resolved = "/"
+				node, _ = fsys.node(resolved)
+			}
+			elems = append(strings.Split(target, "/"), elems...)
+			continue
+		}
+		if len(elems) > 0 && !isDir(next) {
+			return "", nil, &fs.PathError{Op: op, Path: name, Err: errors.New("not a directory")}
+		}
+		resolved, node = p, next
+	}
+
+	return resolved, node, nil
+}
+
+// contents returns the layer and path that hold the contents of a file, following
+// a hard link to the file it links to in its layer or, failing that, a lower one
+func (fsys *FS) contents(p string, node *filetree.FileNode) (int, string, filetree.FileInfo, error) {
+	layer := fsys.layer
+	if layer < 0 {
+		layer, _ = fsys.merged.Layer(p)
+	}
+	info := node.Data.FileInfo
+	if info.TypeFlag != tar.TypeLink {
+		return layer, p, info, nil
+	}
+	target := path.Clean("/" + info.Linkname)
+	for idx := layer; idx >= 0; idx-- {
+		linked, err := fsys.i.blobs[idx].tree.GetNode(target)
+		if err == nil && linked.Data.FileInfo.TypeFlag == tar.TypeReg {
+			return idx, target, linked.Data.FileInfo, nil
+		}
+	}
+	return 0, "", info, fmt.Errorf("hard link %s → %s: target not found", p, info.Linkname)
+}
+
+// isDir returns true if the node is a directory (including directories that are
+// only implied by the paths under them)
+func isDir(node *filetree.FileNode) bool {
+	return node.Data.FileInfo.IsDir || len(node.Data.FileInfo.Path) == 0
+}
+
+// Open opens the named file, following symlinks
+func (fsys *FS) Open(name string) (fs.File, error) {
+	p, node, err := fsys.lookup("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	fi := fsys.stat(p, node)
+
+	if isDir(node) {
+		return &dirFile{info: fi, entries: fsys.readDir(p, node)}, nil
+	}
+
+	if node.Data.FileInfo.TypeFlag != tar.TypeReg && node.Data.FileInfo.TypeFlag != tar.TypeLink {
+		// devices, fifos and the like have no contents
+		return &regularFile{fsys: fsys, info: fi}, nil
+	}
+	layer, target, _, err := fsys.contents(p, node)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &regularFile{fsys: fsys, info: fi, layer: layer, path: target}, nil
+}
+
+// Stat returns the named file's info, following symlinks
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	p, node, err := fsys.lookup("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return fsys.stat(p, node), nil
+}
+
+// Lstat returns the named file's info without following a symlink it names
+func (fsys *FS) Lstat(name string) (fs.FileInfo, error) {
+	p, node, err := fsys.lookup("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return fsys.stat(p, node), nil
+}
+
+// ReadLink returns the target of the named symlink
+func (fsys *FS) ReadLink(name string) (string, error) {
+	_, node, err := fsys.lookup("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if node.Data.FileInfo.TypeFlag != tar.TypeSymlink {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return node.Data.FileInfo.Linkname, nil
+}
+
+// ReadFile reads the named file, following symlinks
+func (fsys *FS) ReadFile(name string) ([]byte, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, _ := f.Stat()
+	if fi.IsDir() {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: errors.New("is a directory")}
+	}
+	return ioutil.ReadAll(f)
+}
+
+// ReadDir reads the named directory sorted by file name, following symlinks
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	p, node, err := fsys.lookup("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if !isDir(node) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	return fsys.readDir(p, node), nil
+}
+
+func (fsys *FS) readDir(p string, node *filetree.FileNode) []fs.DirEntry {
+	var entries []fs.DirEntry
+	for _, child := range node.Children {
+		if child.IsWhiteout() {
+			continue
+		}
+		entries = append(entries, fs.FileInfoToDirEntry(fsys.stat(path.Join(p, child.Name), child)))
+	}
+	sort.Slice(entries, func(a, b int) bool { return entries[a].Name() < entries[b].Name() })
+	return entries
+}
+
+// stat returns the info of a node, with hard links taking the size of the file they link to
+func (fsys *FS) stat(p string, node *filetree.FileNode) fs.FileInfo {
+	fi := fileInfo{name: path.Base(p), info: node.Data.FileInfo, layer: fsys.layer}
+	if p == "/" {
+		fi.name = "."
+	}
+	if fi.layer < 0 {
+		fi.layer, _ = fsys.merged.Layer(p)
+	}
+	if fi.layer < len(fsys.i.blobs) {
+		fi.entry = fsys.i.blobs[fi.layer].files[p]
+	}
+
+	switch fi.info.TypeFlag {
+	case tar.TypeLink:
+		if layer, target, linked, err := fsys.contents(p, node); err == nil {
+			fi.info.Size = linked.Size
+			fi.layer, fi.src = layer, target
+		}
+	case tar.TypeReg:
+		fi.src = p
+	}
+	return fi
+}
+
+// fileInfo is the fs.FileInfo of a file in an image
+type fileInfo struct {
+	name string
+	info filetree.FileInfo
+	// entry is the file's entry in its layer tar, nil for directories only implied by the paths under them
+	entry *layerEntry
+	// layer and src are where the contents of a regular file or hard link are
+	layer int
+	src   string
+}
+
+func (fi fileInfo) Name() string { return fi.name }
+func (fi fileInfo) Size() int64  { return fi.info.Size }
+func (fi fileInfo) Mode() fs.FileMode {
+	if len(fi.info.Path) == 0 {
+		return fs.ModeDir | 0755
+	}
+	return fi.info.Mode
+}
+
+func (fi fileInfo) ModTime() time.Time {
+	if fi.entry == nil {
+		return time.Time{}
+	}
+	return fi.entry.ModTime
+}
+
+func (fi fileInfo) IsDir() bool { return fi.Mode().IsDir() }
+
+// Sys returns the file's *tar.Header as it is in its layer, with its owner and extended attributes
+func (fi fileInfo) Sys() interface{} {
+	hdr := &tar.Header{
+		Name:     fi.info.Path,
+		Typeflag: fi.info.TypeFlag,
+		Linkname: fi.info.Linkname,
+		Size:     fi.info.Size,
+		Mode:     unixMode(fi.Mode()),
+		Uid:      fi.info.Uid,
+		Gid:      fi.info.Gid,
+		ModTime:  fi.ModTime(),
+	}
+	if len(fi.info.Path) == 0 {
+		hdr.Typeflag = tar.TypeDir
+	}
+	if hdr.Typeflag == tar.TypeLink {
+		hdr.Size = 0
+	}
+	if fi.entry != nil {
+		hdr.Uname, hdr.Gname = fi.entry.Uname, fi.entry.Gname
+		for name, value := range fi.entry.Xattrs {
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = make(map[string]string)
+			}
+			hdr.PAXRecords[paxXattr+name] = value
+		}
+	}
+	return hdr
+}
+
+// unixMode returns the unix permission bits of a file mode
+func unixMode(mode fs.FileMode) int64 {
+	m := int64(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		m |= 04000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		m |= 02000
+	}
+	if mode&fs.ModeSticky != 0 {
+		m |= 01000
+	}
+	return m
+}
+
+// sameFile returns true if two files in an image have the same contents
+// because they are the same file or hard links to it
+func sameFile(a, b fs.FileInfo) bool {
+	fa, ok := a.(fileInfo)
+	if !ok {
+		return false
+	}
+	fb, ok := b.(fileInfo)
+	return ok && len(fa.src) > 0 && fa.layer == fb.layer && fa.src == fb.src
+}
+
+// dirFile is an open directory
+type dirFile struct {
+	info    fs.FileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *dirFile) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *dirFile) Close() error               { return nil }
+
+func (d *dirFile) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.Name(), Err: errors.New("is a directory")}
+}
+
+func (d *dirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	entries := d.entries[d.offset:]
+	if n > 0 && len(entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > 0 && len(entries) > n {
+		entries = entries[:n]
+	}
+	d.offset += len(entries)
+	return entries, nil
+}
+
+// regularFile is an open file whose contents are read from its layer on demand.
+// Seeking backwards reopens the file at the new offset if the archive can be
+// seeked, otherwise it rereads the layer up to it.
+type regularFile struct {
+	fsys  *FS
+	info  fs.FileInfo
+	layer int
+	path  string
+
+	offset int64
+	// r reads the file's contents from pos
+	r      io.Reader
+	pos    int64
+	closer io.Closer
+}
+
+func (f *regularFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+func (f *regularFile) Read(p []byte) (int, error) {
+	if f.offset >= f.info.Size() {
+		return 0, io.EOF
+	}
+	if f.r == nil || f.offset < f.pos {
+		if err := f.reopen(); err != nil {
+			return 0, err
+		}
+	}
+	if f.offset > f.pos {
+		if _, err := io.CopyN(ioutil.Discard, f.r, f.offset-f.pos); err != nil {
+			return 0, err
+		}
+		f.pos = f.offset
+	}
+	n, err := f.r.Read(p)
+	f.pos += int64(n)
+	f.offset = f.pos
+	return n, err
+}
+
+// reopen seeks to the file's contents at the current offset or reads the
+// file's layer from the start up to the file's contents
+func (f *regularFile) reopen() error {
+	f.Close()
+	blob := f.fsys.i.blobs[f.layer]
+	if entry, ok := blob.files[f.path]; ok && entry.TypeFlag == tar.TypeReg && f.fsys.openAt != nil {
+		lr, err := f.fsys.openAt(blob, entry.Offset+f.offset)
+		if err != nil {
+			return err
+		}
+		f.r, f.pos, f.closer = io.LimitReader(lr, f.info.Size()-f.offset), f.offset, lr
+		return nil
+	}
+
+	lr, err := f.fsys.open(blob)
+	if err != nil {
+		return err
+	}
+	name := archiveName(strings.TrimPrefix(f.path, "/"))
+	tr := tar.NewReader(lr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			lr.Close()
+			return err
+		}
+		if hdr.Typeflag == tar.TypeReg && archiveName(hdr.Name) == name {
+			f.r, f.pos, f.closer = tr, 0, lr
+			return nil
+		}
+	}
+	lr.Close()
+	return &fs.PathError{Op: "read", Path: f.path, Err: fs.ErrNotExist}
+}
+
+func (f *regularFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.Size()
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.path, Err: fs.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *regularFile) Close() error {
+	if f.closer == nil {
+		return nil
+	}
+	err := f.closer.Close()
+	f.r, f.closer = nil, nil
+	return err
+}
@@ -0,0 +1,172 @@
+package image
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// testImageLayers are the layers of a two layer image with whiteouts, an
+// opaque directory, symlinks and hard links
+func testImageLayers(t testing.TB) [][]byte {
+	return [][]byte{
+		layerTar(t,
+			dir("bin/"),
+			file("bin/busybox", "#!busybox"),
+			hardlink("bin/sh", "bin/busybox"),
+			dir("etc/"),
+			file("etc/passwd", "root:x:0:0"),
+			file("etc/shadow", "root:*"),
+			dir("app/"),
+			file("app/old.conf", "old"),
+			dir("app/plugins/"),
+			file("app/plugins/a.so", "a"),
+			dir("usr/"),
+			dir("usr/share/"),
+			dir("usr/share/zoneinfo/"),
+			file("usr/share/zoneinfo/UTC", "TZif"),
+		),
+		layerTar(t,
+			dir("etc/"),
+			file("etc/.wh.shadow", ""),
+			symlink("etc/localtime", "/usr/share/zoneinfo/UTC"),
+			symlink("etc/zones", "../usr/share/zoneinfo"),
+			dir("app/"),
+			file("app/.wh..wh..opq", ""),
+			file("app/new.conf", "new"),
+			// a hard link to a file in the lower layer
+			hardlink("bin/ash", "bin/busybox"),
+			file("bin/.wh.sh", ""),
+			// relative and absolute symlinks that try to leave the root resolve inside it
+			symlink("escape", "../../../../etc/passwd"),
+			symlink("escape-abs", "/../etc/passwd"),
+		),
+	}
+}
+
+// testFS returns the merged filesystem of an image archive
+func testFS(t testing.TB, layers ...[]byte) *FS {
+	t.Helper()
+	archive := imageArchive(t, layers...)
+	images, err := Parse(bytes.NewReader(archive), DefaultLimits())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := NewFS(images[0], func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(archive)), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fsys
+}
+
+func TestFS(t *testing.T) {
+	fsys := testFS(t, testImageLayers(t)...)
+	if err := fstest.TestFS(fsys,
+		"bin/busybox", "bin/ash", "etc/passwd", "etc/localtime", "etc/zones",
+		"app/new.conf", "usr/share/zoneinfo/UTC", "escape", "escape-abs",
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"etc/shadow", "bin/sh", "app/old.conf", "app/plugins", "etc/.wh.shadow", "app/.wh..wh..opq"} {
+		if _, err := fsys.Lstat(name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s: expected it not to exist, got %v", name, err)
+		}
+	}
+
+	for name, want := range map[string]string{
+		"bin/ash":       "#!busybox",
+		"etc/localtime": "TZif",
+		"etc/zones/UTC": "TZif",
+		"escape":        "root:x:0:0",
+		"escape-abs":    "root:x:0:0",
+		"app/new.conf":  "new",
+	} {
+		data, err := fsys.ReadFile(name)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if string(data) != want {
+			t.Errorf("%s: read %q, expected %q", name, data, want)
+		}
+	}
+
+	if target, err := fsys.ReadLink("etc/localtime"); err != nil || target != "/usr/share/zoneinfo/UTC" {
+		t.Errorf("readlink etc/localtime = %q, %v", target, err)
+	}
+	busybox, _ := fsys.Stat("bin/busybox")
+	ash, _ := fsys.Stat("bin/ash")
+	if !sameFile(busybox, ash) {
+		t.Error("bin/ash isn't the same file as bin/busybox")
+	}
+}
+
+func TestFSLayer(t *testing.T) {
+	fsys := testFS(t, testImageLayers(t)...)
+	lower, err := fsys.Layer(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(lower, "bin/sh", "etc/shadow", "app/old.conf", "app/plugins/a.so"); err != nil {
+		t.Fatal(err)
+	}
+	upper, err := fsys.Layer(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the upper layer's symlinks dangle without the lower layer so fstest can't walk it
+	entries, err := upper.ReadDir("etc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Name() != "localtime" || entries[0].Type() != fs.ModeSymlink || entries[1].Name() != "zones" {
+		t.Fatalf("unexpected etc entries in the upper layer: %v", entries)
+	}
+	if _, err := upper.Stat("etc/localtime"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected etc/localtime to dangle in the upper layer, got %v", err)
+	}
+	// the upper layer's hard link reads its target from the lower layer
+	if data, err := upper.ReadFile("bin/ash"); err != nil || string(data) != "#!busybox" {
+		t.Fatalf("read bin/ash from the upper layer: %q, %v", data, err)
+	}
+	if _, err := fsys.Layer(2); err == nil {
+		t.Fatal("expected an error for a layer the image doesn't have")
+	}
+}
+
+func TestFSSymlinks(t *testing.T) {
+	fsys := testFS(t, layerTar(t,
+		symlink("loop1", "loop2"),
+		symlink("loop2", "loop1"),
+		symlink("self", "self/x"),
+		symlink("dangling", "/nowhere"),
+		file("file", "x"),
+		symlink("notdir", "file/x"),
+	))
+	for _, name := range []string{"loop1", "loop2/x", "self"} {
+		if _, err := fsys.Open(name); err == nil || !strings.Contains(err.Error(), "too many levels of symbolic links") {
+			t.Errorf("%s: expected too many levels of symbolic links, got %v", name, err)
+		}
+	}
+	// the links themselves are there
+	if fi, err := fsys.Lstat("loop1"); err != nil || fi.Mode()&fs.ModeSymlink == 0 {
+		t.Errorf("lstat loop1: %v", err)
+	}
+	if _, err := fsys.Stat("dangling"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("dangling: expected it not to exist, got %v", err)
+	}
+	if _, err := fsys.Stat("notdir"); err == nil {
+		t.Error("notdir: expected an error resolving a path through a file")
+	}
+	for _, name := range []string{"/file", "../file", "./file", "file/"} {
+		if _, err := fsys.Open(name); !errors.Is(err, fs.ErrInvalid) {
+			t.Errorf("%s: expected an invalid path, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package image
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/blacktop/graboid/pkg/compress"
+)
+
+// fuzzLayers are the layers the fuzz tests start from
+func fuzzLayers(t testing.TB) [][]byte {
+	layers := append(testImageLayers(t), extractLayer(t))
+	return append(layers,
+		layerTar(t, dir("./"), file("./etc/hostname", "x")),
+		layerTar(t, symlink("up", ".."), file("up/evil", "x")),
+		layerTar(t, file("a", "x"), hardlink("b", "../a")),
+	)
+}
+
+// extractAll extracts everything in the images parsed from archive, both
+// file by file and in a single pass over the archive, and fails if anything
+// is written outside of the root
+func extractAll(t *testing.T, archive []byte, images []*Tar) {
+	for _, i := range images {
+		fsys, err := NewFS(i, func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(archive)), nil
+		})
+		if err != nil {
+			continue
+		}
+		extractSandboxed(t, fsys, func(fsys *FS, dt *DirTarget) error {
+			_, err := ExtractPaths(fsys, []string{"."}, dt, testLimits)
+			return err
+		})
+		extractSandboxed(t, fsys, func(fsys *FS, dt *DirTarget) error {
+			_, err := ExtractPathsFrom(bytes.NewReader(archive), fsys, []string{"."}, dt, testLimits)
+			return err
+		})
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	for _, archive := range readHostile(f) {
+		f.Add(archive)
+	}
+	f.Add(imageArchive(f, testImageLayers(f)...))
+	f.Add(gzipBytes(f, imageArchive(f, gzipBytes(f, extractLayer(f)))))
+
+	f.Fuzz(func(t *testing.T, archive []byte) {
+		images, err := Parse(bytes.NewReader(archive), testLimits)
+		if err != nil {
+			return
+		}
+		extractAll(t, archive, images)
+	})
+}
+
+func FuzzGetFileList(f *testing.F) {
+	for _, layer := range fuzzLayers(f) {
+		f.Add(layer)
+	}
+
+	f.Fuzz(func(t *testing.T, layer []byte) {
+		entries, err := getFileList("layer.tar", bytes.NewReader(layer), testLimits)
+		if err != nil {
+			return
+		}
+		blob, err := newLayerBlob("layer.tar", entries, testLimits)
+		if err != nil {
+			return
+		}
+		// the files are keyed by their clean absolute path
+		for name := range blob.files {
+			if name != path.Clean(name) || escapes(strings.TrimPrefix(name, "/")) {
+				t.Fatalf("the layer has %s", name)
+			}
+		}
+	})
+}
+
+func FuzzExtract(f *testing.F) {
+	for _, layer := range fuzzLayers(f) {
+		f.Add(layer)
+	}
+
+	f.Fuzz(func(t *testing.T, layer []byte) {
+		// imageArchive fails on corrupt compressed layers
+		if compress.Detect(layer) != compress.None {
+			return
+		}
+		archive := imageArchive(t, layer)
+		images, err := Parse(bytes.NewReader(archive), testLimits)
+		if err != nil {
+			return
+		}
+		extractAll(t, archive, images)
+	})
+}
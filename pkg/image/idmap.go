@@ -0,0 +1,104 @@
+package image
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/fs"
+	"strconv"
+	"strings"
+)
+
+// OverflowID is the owner of files whose uid or gid isn't in any IDMap
+const OverflowID = 65534
+
+// IDMap maps a range of uids or gids in an image to the host, like a line of a
+// user namespace's uid_map
+type IDMap struct {
+	ContainerID int
+	HostID      int
+	Size        int
+}
+
+// ParseIDMap parses an IDMap written as container:host:size
+func ParseIDMap(s string) (IDMap, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return IDMap{}, fmt.Errorf("bad id map %q: expected container:host:size", s)
+	}
+	var ids [3]int
+	for idx, part := range parts {
+		id, err := strconv.Atoi(part)
+		if err != nil || id < 0 {
+			return IDMap{}, fmt.Errorf("bad id map %q: %s is not an id", s, part)
+		}
+		ids[idx] = id
+	}
+	if ids[2] == 0 {
+		return IDMap{}, fmt.Errorf("bad id map %q: the size is 0", s)
+	}
+	return IDMap{ContainerID: ids[0], HostID: ids[1], Size: ids[2]}, nil
+}
+
+// mapID returns the host id of a container id, OverflowID if no map has it.
+// An id is returned as is without any maps.
+func mapID(maps []IDMap, id int) int {
+	if len(maps) == 0 {
+		return id
+	}
+	for _, m := range maps {
+		if id >= m.ContainerID && id < m.ContainerID+m.Size {
+			return m.HostID + id - m.ContainerID
+		}
+	}
+	return OverflowID
+}
+
+// remapTarget changes the owners of the files written to a target
+type remapTarget struct {
+	Target
+	uids, gids []IDMap
+}
+
+// RemapTarget returns a target that writes files to t with their uid and gid
+// mapped by uids and gids (i.e. to a rootless user's subordinate ids). Owner
+// names are dropped as they no longer match the ids.
+func RemapTarget(t Target, uids, gids []IDMap) Target {
+	return &remapTarget{Target: t, uids: uids, gids: gids}
+}
+
+// remap returns fi with its owner mapped
+func (t *remapTarget) remap(fi fs.FileInfo) fs.FileInfo {
+	hdr, ok := fi.Sys().(*tar.Header)
+	if !ok {
+		return fi
+	}
+	mapped := *hdr
+	mapped.Uid, mapped.Gid = mapID(t.uids, hdr.Uid), mapID(t.gids, hdr.Gid)
+	mapped.Uname, mapped.Gname = "", ""
+	return remappedInfo{FileInfo: fi, hdr: &mapped}
+}
+
+func (t *remapTarget) Dir(name string, fi fs.FileInfo) error {
+	return t.Target.Dir(name, t.remap(fi))
+}
+
+func (t *remapTarget) File(name string, fi fs.FileInfo, r io.Reader) error {
+	return t.Target.File(name, t.remap(fi), r)
+}
+
+func (t *remapTarget) Symlink(name, target string, fi fs.FileInfo) error {
+	return t.Target.Symlink(name, target, t.remap(fi))
+}
+
+func (t *remapTarget) Link(name, target string, fi fs.FileInfo) error {
+	return t.Target.Link(name, target, t.remap(fi))
+}
+
+// remappedInfo is a file's info with its owner mapped
+type remappedInfo struct {
+	fs.FileInfo
+	hdr *tar.Header
+}
+
+func (fi remappedInfo) Sys() interface{} { return fi.hdr }
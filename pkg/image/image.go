@@ -2,34 +2,82 @@ package image
 
 import (
 	"archive/tar"
-	"compress/gzip"
-	"encoding/json"
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"os"
-	"path/filepath"
+	"path"
 	"strings"
 
+	"github.com/cespare/xxhash"
 	"github.com/dustin/go-humanize"
 	"github.com/gizak/termui/v3/widgets"
 	"github.com/wagoodman/dive/dive/filetree"
 )
 
-// Parse parses an image tar.gz file
-func Parse(r io.Reader) (*Tar, error) {
+// MergedNode is the name of the tree node holding the merged filesystem
+const MergedNode = "merged filesystem"
 
-	i := &Tar{}
+// paxXattr prefixes the PAX records holding a file's extended attributes
+const paxXattr = "SCHILY.xattr."
 
-	gz, err := gzip.NewReader(r)
+// archiveName normalizes the name of a file in an image archive
+func archiveName(name string) string {
+	return path.Clean(strings.TrimPrefix(name, "./"))
+}
+
+// isTar returns true if header is the first block of a tar stream (an empty tar is all zeros)
+func isTar(header []byte) bool {
+	if len(header) < 512 {
+		return false
+	}
+	if bytes.Equal(header[257:262], []byte("ustar")) {
+		return true
+	}
+	return bytes.Count(header[:512], []byte{0}) == 512
+}
+
+// Parse parses every image in an image archive that is uncompressed or compressed with gzip, zstd or bzip2.
+// graboid archives (<digest>.json and <digest>.tar), 'docker save' archives (<id>/json,
+// <id>/layer.tar and repositories) and OCI image layouts are supported as the images'
+// configs and layers are looked up from manifest.json or index.json. Layers are recognized
+// by their contents rather than their names, so they may be compressed. Layers shared by
+// several images are only read once. Reading the archive, and later the images' files,
+// fails with ErrLimit once it exceeds limits.
+func Parse(r io.Reader, limits Limits) ([]*Tar, error) {
+	// the archive is only read once so no gzip checkpoints are recorded
+	a, err := readArchive(r, 0, limits)
 	if err != nil {
 		return nil, err
 	}
-	defer gz.Close()
+	return load(a, limits)
+}
 
-	tr := tar.NewReader(gz)
+// readArchive reads the configs, manifests and layer file trees of an image
+// archive along with where each layer and each file in it is in the archive,
+// recording checkpoints every span bytes of gzip streams if span > 0
+func readArchive(r io.Reader, span int64, limits Limits) (*streamArchive, error) {
 
-	for {
+	a := &streamArchive{
+		files:  make(map[string][]byte),
+		layers: make(map[string]*layerBlob),
+		links:  make(map[string]string),
+		limits: limits,
+	}
+
+	zr, err := newIndexedReader(r, span)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	// the tar reader doesn't read ahead so the count is the offset of the current file's contents
+	cr := &countingReader{r: limits.reader(zr, "the archive")}
+	tr := tar.NewReader(cr)
+
+	for entries := 1; ; entries++ {
 		hdr, err := tr.Next()
 
 		if err == io.EOF {
@@ -38,99 +86,140 @@ func Parse(r io.Reader) (*Tar, error) {
 		if err != nil {
 			return nil, err
 		}
+		if err := limits.tooManyEntries("the archive", entries); err != nil {
+			return nil, err
+		}
 
+		name := archiveName(hdr.Name)
 		switch hdr.Typeflag {
 		case tar.TypeSymlink:
+			// docker save links layers shared by several images
+			a.links[name] = archiveName(path.Join(path.Dir(name), hdr.Linkname))
+		case tar.TypeLink:
+			a.links[name] = archiveName(hdr.Linkname)
 		case tar.TypeReg:
-			switch filepath.Ext(hdr.Name) {
-			case ".json":
-				if strings.EqualFold(hdr.Name, "manifest.json") {
-					rawJSON, err := ioutil.ReadAll(tr)
-					if err != nil {
-						return nil, err
-					}
-					var manifests []Manifest
-					if err := json.Unmarshal(rawJSON, &manifests); err != nil {
-						return nil, err
-					}
-					i.Manifest = manifests[0]
-				} else {
-					rawJSON, err := ioutil.ReadAll(tr)
-					if err != nil {
-						return nil, err
-					}
-					i.Config, err = NewFromJSON(rawJSON)
-					if err != nil {
-						return nil, err
-					}
-				}
-			case ".tar":
-				// if err = i.processLayerTar(hdr.Name, currentLayer, tar.NewReader(tr)); err != nil {
-				if err = i.processLayerTar(hdr.Name, 0, tr); err != nil {
-					return nil, err
-				}
+			offset := cr.n
+			layer, data, err := readArchiveFile(name, hdr.Size, tr, span, limits)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
 			}
-		}
-	}
-
-	i.Tag = i.Manifest.RepoTags[0]
-	i.Layers = make([]Layer, len(i.RefTrees))
-
-	nonEmptyLayerIdx := 0 // TODO
-
-	for _, history := range i.Config.History {
-		if !history.EmptyLayer {
-			for _, tree := range i.RefTrees {
-				if strings.Contains(i.Manifest.Layers[nonEmptyLayerIdx], tree.Name) {
-					history.Size = tree.FileSize
-					i.Layers[nonEmptyLayerIdx] = &dockerLayer{
-						history: history,
-						index:   nonEmptyLayerIdx,
-						tree:    tree,
-						tarPath: i.Manifest.Layers[nonEmptyLayerIdx],
-					}
-				}
+			if layer != nil {
+				layer.offset = offset
+				a.layers[name] = layer
+			} else {
+				// files too large to be metadata are kept as nil to report them if they are read
+				a.files[name] = data
 			}
-			nonEmptyLayerIdx++
 		}
 	}
 
-	return i, nil
+	a.compression = zr.compression
+	a.checkpoints = zr.checkpoints()
+	return a, nil
 }
 
-func (i *Tar) processLayerTar(name string, layerIdx uint, reader io.Reader) error {
-	tree := filetree.NewFileTree()
-	tree.Name = name
-
-	fileInfos, err := i.getFileList(reader)
+// readArchiveFile reads a file in an image archive as a layer if it is a
+// (compressed) tar, otherwise its contents are returned if it is small enough
+// to be a config or manifest (and nil if not)
+func readArchiveFile(name string, size int64, r io.Reader, span int64, limits Limits) (*layerBlob, []byte, error) {
+	compressed := newDigester()
+	zr, err := newIndexedReader(io.TeeReader(r, compressed), span)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
+	defer zr.Close()
 
-	for _, element := range fileInfos {
-		tree.FileSize += uint64(element.Size)
+	sr := bufio.NewReader(limits.reader(zr, name))
+	header, err := sr.Peek(512)
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
 
-		_, _, err := tree.AddPath(element.Path, element)
-		if err != nil {
-			return err
+	if !isTar(header) {
+		if max := limits.MaxJSONSize; max > 0 && size > max {
+			return nil, nil, nil
 		}
+		data, err := limits.readJSON(name, sr)
+		if errors.Is(err, ErrLimit) {
+			return nil, nil, nil
+		}
+		return nil, data, err
+	}
+
+	uncompressed := newDigester()
+	entries, err := getFileList(name, io.TeeReader(sr, uncompressed), limits)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the digests cover the whole stream, including any padding after the end of the tar
+	if _, err := io.Copy(uncompressed, sr); err != nil {
+		return nil, nil, err
+	}
+	if _, err := io.Copy(ioutil.Discard, zr.raw); err != nil {
+		return nil, nil, err
 	}
 
-	i.RefTrees = append(i.RefTrees, tree) // TODO
-	return nil
+	blob, err := newLayerBlob(name, entries, limits)
+	if err != nil {
+		return nil, nil, err
+	}
+	blob.compression = zr.compression
+	blob.checkpoints = zr.checkpoints()
+	blob.digest = compressed.Digest()
+	blob.diffID = uncompressed.Digest()
+	blob.compressedSize = compressed.size
+	blob.uncompressedSize = uncompressed.size
+	return blob, nil, nil
 }
 
-func (i *Tar) getFileList(r io.Reader) ([]filetree.FileInfo, error) {
+// newLayerBlob builds a layer's file tree from its tar entries, keeping the
+// directories it marks opaque separately as the file tree drops them. Entries
+// that are absolute, leave the layer's root or are nested too deeply are rejected
+// and an entry for the root itself is skipped.
+func newLayerBlob(name string, entries []layerEntry, limits Limits) (*layerBlob, error) {
+	if err := limits.tooManyEntries("layer "+name, len(entries)); err != nil {
+		return nil, err
+	}
+	blob := &layerBlob{
+		path:    name,
+		tree:    filetree.NewFileTree(),
+		entries: entries,
+		files:   make(map[string]*layerEntry),
+	}
+	blob.tree.Name = name
+
+	for idx, element := range entries {
+		if err := limits.checkEntry(element.FileInfo); err != nil {
+			return nil, fmt.Errorf("layer %s: %w", name, err)
+		}
+		// the layer's root directory ("./" in layers tarred up from their root) isn't a file in the tree
+		if archiveName(element.Path) == "." {
+			continue
+		}
+		blob.tree.FileSize += uint64(element.Size)
 
-	var files []filetree.FileInfo
+		p := "/" + archiveName(element.Path)
+		if path.Base(p) == whiteoutOpaque {
+			blob.opaque = append(blob.opaque, path.Dir(p))
+			continue
+		}
+		blob.files[p] = &blob.entries[idx]
 
-	gz, err := gzip.NewReader(r)
-	if err != nil {
-		return nil, err
+		_, _, err := blob.tree.AddPath(element.Path, element.FileInfo)
+		if err != nil {
+			return nil, err
+		}
 	}
-	defer gz.Close()
 
-	tr := tar.NewReader(gz)
+	return blob, nil
+}
+
+// getFileList reads the entries of the layer tar named layer
+func getFileList(layer string, r io.Reader, limits Limits) ([]layerEntry, error) {
+	var files []layerEntry
+
+	cr := &countingReader{r: r}
+	tr := tar.NewReader(cr)
 
 	for {
 		header, err := tr.Next()
@@ -148,75 +237,114 @@ func (i *Tar) getFileList(r io.Reader) ([]filetree.FileInfo, error) {
 		case tar.TypeXHeader:
 			return nil, fmt.Errorf("unexptected tar file (XHeader): type=%v name=%s", header.Typeflag, name)
 		default:
-			files = append(files, filetree.NewFileInfoFromTarHeader(tr, header, name))
+			entry := layerEntry{
+				Offset:  cr.n,
+				ModTime: header.ModTime,
+				Uname:   header.Uname,
+				Gname:   header.Gname,
+			}
+			for key, value := range header.PAXRecords {
+				if strings.HasPrefix(key, paxXattr) {
+					if entry.Xattrs == nil {
+						entry.Xattrs = make(map[string]string)
+					}
+					entry.Xattrs[strings.TrimPrefix(key, paxXattr)] = value
+				}
+			}
+			// the contents are hashed here as dive's hash isn't kept in an index, and
+			// dive panics when reading them fails (i.e. a truncated or corrupt layer).
+			// They have been read by the time dive gets the reader, so its hash is
+			// the same for every file and only entry.Hash tells contents apart.
+			h := xxhash.New()
+			if _, err := io.Copy(h, tr); err != nil {
+				return nil, fmt.Errorf("failed to read %s: %w", name, err)
+			}
+			entry.Hash = h.Sum64()
+			entry.FileInfo = filetree.NewFileInfoFromTarHeader(tr, header, name)
+			files = append(files, entry)
+			if err := limits.tooManyEntries("layer "+layer, len(files)); err != nil {
+				return nil, err
+			}
 		}
 	}
 
 	return files, nil
 }
 
-// Extract extracts a path from a tar.gz and can handle a set depth of nested tar.gz(s)
-func (i *Tar) Extract(r io.Reader, path string, depth int) error {
+// Extract extracts a file, or a directory and everything under it, as a container
+// of the image sees it (i.e. from the top-most layer that has it) from the image
+// archive read from r to the same path under the current directory. Files keep
+// their mode, modification time, extended attributes and links.
+func (i *Tar) Extract(r io.Reader, path string) error {
+	return i.ExtractLayer(r, -1, path)
+}
+
+// ExtractLayer is Extract from layer idx (or the merged filesystem if idx is -1)
+func (i *Tar) ExtractLayer(r io.Reader, idx int, path string) error {
+	fsys, err := i.newFS(nil)
+	if err != nil {
+		return err
+	}
+	if idx >= 0 {
+		if fsys, err = fsys.Layer(idx); err != nil {
+			return err
+		}
+	}
+	t, err := NewDirTarget(".")
+	if err != nil {
+		return err
+	}
+	if _, err := ExtractPathsFrom(r, fsys, []string{path}, t, i.limits); err != nil {
+		return err
+	}
+	return t.Close()
+}
 
-	depth--
+// ExtractDir is Extract for an image parsed with ParseDir
+func (i *Tar) ExtractDir(dir, path string) error {
+	return i.ExtractLayerDir(dir, -1, path)
+}
 
-	gz, err := gzip.NewReader(r)
+// ExtractLayerDir is ExtractLayer for an image parsed with ParseDir
+func (i *Tar) ExtractLayerDir(dir string, idx int, path string) error {
+	fsys, err := NewDirFS(i, dir)
 	if err != nil {
 		return err
 	}
-	defer gz.Close()
+	return extractFS(fsys, idx, path)
+}
 
-	tr := tar.NewReader(gz)
+// ExtractIndexed is Extract for an image parsed with ParseIndexed
+func (i *Tar) ExtractIndexed(path string) error {
+	return i.ExtractLayerIndexed(-1, path)
+}
 
-	for {
-		hdr, err := tr.Next()
+// ExtractLayerIndexed is ExtractLayer for an image parsed with ParseIndexed
+func (i *Tar) ExtractLayerIndexed(idx int, path string) error {
+	fsys, err := NewIndexedFS(i)
+	if err != nil {
+		return err
+	}
+	return extractFS(fsys, idx, path)
+}
 
-		if err == io.EOF {
-			break // End of archive
-		}
-		if err != nil {
+// extractFS extracts a path from layer idx (or the merged filesystem if idx is -1)
+// of fsys to the current directory
+func extractFS(fsys *FS, idx int, name string) error {
+	if idx >= 0 {
+		var err error
+		if fsys, err = fsys.Layer(idx); err != nil {
 			return err
 		}
-
-		switch hdr.Typeflag {
-		case tar.TypeSymlink:
-		case tar.TypeReg:
-			switch filepath.Ext(hdr.Name) {
-			case ".tar":
-				if depth > 0 {
-					if err = i.Extract(tr, path, depth); err != nil {
-						return err
-					}
-				}
-			default:
-				// fmt.Println(hdr.Name)
-				var name string
-				if hdr.Typeflag == tar.TypeSymlink {
-					name = hdr.Linkname
-				} else {
-					name = hdr.Name
-				}
-				if strings.Contains(path, name) {
-					// fmt.Println(name)
-					// fmt.Println(filepath.Dir(name))
-					// os.MkdirAll(filepath.Dir(name), os.ModePerm)
-					f, err := os.OpenFile(filepath.Base(name), os.O_CREATE|os.O_RDWR, 0644)
-					// f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, os.FileMode(hdr.Mode)) // TODO
-					if err != nil {
-						return err
-					}
-					if _, err := io.Copy(f, tr); err != nil {
-						return err
-					}
-					f.Close()
-					return nil
-				}
-			}
-		}
 	}
-
-	return nil
-	// return fmt.Errorf("did not find path: %s", path)
+	t, err := NewDirTarget(".")
+	if err != nil {
+		return err
+	}
+	if _, err := ExtractPaths(fsys, []string{name}, t, fsys.i.limits); err != nil {
+		return err
+	}
+	return t.Close()
 }
 
 type nodeValue string
@@ -225,55 +353,64 @@ func (nv nodeValue) String() string {
 	return string(nv)
 }
 
-// Nodes returns the filetree as widget treenodes
-func (i *Tar) Nodes() []*widgets.TreeNode {
+// FileValue is a tree node's file
+type FileValue struct {
+	Path string
+	// Layer is the index of the layer the file is in, or -1 for the merged filesystem
+	Layer   int
+	display string
+}
 
-	var nodes []*widgets.TreeNode
-	// currentTree := 0
+func (fv FileValue) String() string {
+	return fv.display
+}
 
-	for _, layer := range i.Layers {
-		var treeNodes []*widgets.TreeNode
-		// tree := layer.Tree()
-		// visitor := func(node *filetree.FileNode) error {
-
-		// 	if !node.IsWhiteout() {
-		// 		sizer := func(curNode *filetree.FileNode) error {
-		// 			sizeBytes += curNode.Name
-		// 			return nil
-		// 		}
-		// 		previousTreeNode, err := tree.GetNode(node.Path())
-		// 		if err != nil {
-		// 			log.Debug(fmt.Sprintf("CurrentTree: %d : %s", currentTree, err))
-		// 		} else if previousTreeNode.Data.FileInfo.IsDir {
-		// 			err = previousTreeNode.VisitDepthChildFirst(sizer, nil)
-		// 			if err != nil {
-		// 				log.Errorf("unable to propagate dir: %+v", err)
-		// 			}
-		// 		}
-		// 	}
-
-		// 	data.Nodes = append(data.Nodes, node)
-
-		// 	return nil
-		// }
-		// visitEvaluator := func(node *filetree.FileNode) bool {
-		// 	return node.IsLeaf()
-		// }
-		// if err := tree.VisitDepthChildFirst(visitor, visitEvaluator); err != nil {
-		// 	return nil
-		// }
+// fileDisplay returns how a file is shown in the tree
+func fileDisplay(node *filetree.FileNode) string {
+	display := node.Path()
+	if node.Data.FileInfo.TypeFlag == tar.TypeSymlink || node.Data.FileInfo.TypeFlag == tar.TypeLink {
+		display += " → " + node.Data.FileInfo.Linkname
+	}
+	return display + fmt.Sprintf(" (%s)", humanize.Bytes(uint64(node.Data.FileInfo.Size)))
+}
 
+// Nodes returns the merged filesystem followed by each layer's filetree as widget treenodes
+func (i *Tar) Nodes() ([]*widgets.TreeNode, error) {
+
+	m, err := i.Merged()
+	if err != nil {
+		return nil, err
+	}
+	var merged []*widgets.TreeNode
+	m.Tree.VisitDepthParentFirst(func(node *filetree.FileNode) error {
+		layer, _ := m.Layer(node.Path())
+		merged = append(merged, &widgets.TreeNode{
+			Value: FileValue{
+				Path:    node.Path(),
+				Layer:   -1,
+				display: fmt.Sprintf("%s [layer %d]", fileDisplay(node), layer),
+			},
+		})
+		return nil
+	}, nil)
+
+	nodes := []*widgets.TreeNode{{
+		Value: nodeValue(MergedNode),
+		Nodes: merged,
+	}}
+
+	for idx, layer := range i.Layers {
+		var treeNodes []*widgets.TreeNode
+		// whiteouts only show up in the merged filesystem
 		layer.Tree().VisitDepthChildFirst(func(node *filetree.FileNode) error {
 			for _, child := range node.Children {
 				if !child.IsWhiteout() {
-					display := child.Path()
-					if child.Data.FileInfo.TypeFlag == tar.TypeSymlink || child.Data.FileInfo.TypeFlag == tar.TypeLink {
-						display += " → " + child.Data.FileInfo.Linkname
-					}
-					display += fmt.Sprintf(" (%s)", humanize.Bytes(uint64(child.Data.FileInfo.Size)))
 					treeNodes = append(treeNodes, &widgets.TreeNode{
-						Value: nodeValue(display),
-						// Nodes: child.Children,
+						Value: FileValue{
+							Path:    child.Path(),
+							Layer:   idx,
+							display: fileDisplay(child),
+						},
 					})
 				}
 			}
@@ -286,5 +423,5 @@ func (i *Tar) Nodes() []*widgets.TreeNode {
 		})
 	}
 
-	return nodes
+	return nodes, nil
 }
@@ -0,0 +1,190 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blacktop/graboid/pkg/compress"
+)
+
+// testTime is the modification time of the files in the test layers
+var testTime = time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// testEntry is a file in a test layer
+type testEntry struct {
+	hdr  tar.Header
+	body string
+}
+
+func file(name, body string) testEntry {
+	return testEntry{hdr: tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: int64(len(body))}, body: body}
+}
+
+func dir(name string) testEntry {
+	return testEntry{hdr: tar.Header{Typeflag: tar.TypeDir, Name: name, Mode: 0755}}
+}
+
+func symlink(name, target string) testEntry {
+	return testEntry{hdr: tar.Header{Typeflag: tar.TypeSymlink, Name: name, Linkname: target, Mode: 0777}}
+}
+
+func hardlink(name, target string) testEntry {
+	return testEntry{hdr: tar.Header{Typeflag: tar.TypeLink, Name: name, Linkname: target, Mode: 0644}}
+}
+
+// layerTar returns a layer tar holding entries
+func layerTar(t testing.TB, entries ...testEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := e.hdr
+		if hdr.ModTime.IsZero() {
+			hdr.ModTime = testTime
+		}
+		hdr.Format = tar.FormatPAX
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// gzipBytes compresses data with gzip
+func gzipBytes(t testing.TB, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// imageArchive returns an uncompressed docker save archive of an image with
+// layers, which may be compressed with gzip
+func imageArchive(t testing.TB, layers ...[]byte) []byte {
+	t.Helper()
+	config := map[string]interface{}{
+		"architecture": "amd64",
+		"os":           "linux",
+		"created":      testTime,
+	}
+	var diffIDs []string
+	var history []map[string]interface{}
+	for idx, layer := range layers {
+		if compress.Detect(layer) == compress.Gzip {
+			zr, err := gzip.NewReader(bytes.NewReader(layer))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if layer, err = ioutil.ReadAll(zr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		diffIDs = append(diffIDs, fmt.Sprintf("sha256:%x", sha256.Sum256(layer)))
+		history = append(history, map[string]interface{}{
+			"created":    testTime.Add(time.Duration(idx) * time.Hour),
+			"created_by": fmt.Sprintf("layer %d", idx),
+		})
+	}
+	config["rootfs"] = map[string]interface{}{"type": "layers", "diff_ids": diffIDs}
+	config["history"] = history
+	configJSON, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := Manifest{
+		Config:   fmt.Sprintf("%x.json", sha256.Sum256(configJSON)),
+		RepoTags: []string{"test:latest"},
+	}
+	files := []testEntry{file(m.Config, string(configJSON))}
+	for idx, layer := range layers {
+		name := fmt.Sprintf("%d/layer.tar", idx)
+		m.Layers = append(m.Layers, name)
+		files = append(files, dir(fmt.Sprintf("%d/", idx)), file(name, string(layer)))
+	}
+	manifest, err := json.Marshal([]Manifest{m})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return layerTar(t, append(files, file("manifest.json", string(manifest)))...)
+}
+
+// parseImage parses the image archive of layers
+func parseImage(t testing.TB, layers ...[]byte) *Tar {
+	t.Helper()
+	images, err := Parse(bytes.NewReader(imageArchive(t, layers...)), DefaultLimits())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 1 {
+		t.Fatalf("expected one image, got %d", len(images))
+	}
+	return images[0]
+}
+
+func TestParseRootEntry(t *testing.T) {
+	// layers tarred up from their root (tar -C rootfs -c .) start with a "./" entry
+	i := parseImage(t,
+		layerTar(t, dir("./"), dir("./etc/"), file("./etc/hostname", "base")),
+		layerTar(t, dir("./"), file("./etc/hostname", "top")),
+	)
+	if len(i.Layers) != 2 {
+		t.Fatalf("expected 2 layers, got %d", len(i.Layers))
+	}
+	for idx, layer := range i.Layers {
+		if _, err := layer.Tree().GetNode("/etc/hostname"); err != nil {
+			t.Fatalf("layer %d: %v", idx, err)
+		}
+	}
+	if i.Layers[0].Command() != "layer 0" || i.Layers[1].Command() != "layer 1" {
+		t.Fatalf("layers matched to the wrong history: %q, %q", i.Layers[0].Command(), i.Layers[1].Command())
+	}
+	m, err := i.Merged()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layer, ok := m.Layer("/etc/hostname"); !ok || layer != 1 {
+		t.Fatalf("expected /etc/hostname from layer 1, got %d", layer)
+	}
+}
+
+func TestParseCheckpoints(t *testing.T) {
+	archive := gzipBytes(t, imageArchive(t, layerTar(t, file("a", strings.Repeat("a", 1<<20)))))
+
+	// Parse only reads the archive once so recording checkpoints would be wasted
+	a, err := readArchive(bytes.NewReader(archive), 0, DefaultLimits())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.compression != compress.Gzip || a.checkpoints != nil {
+		t.Fatalf("expected a gzip archive without checkpoints, got %s with %v", a.compression, a.checkpoints)
+	}
+
+	a, err = readArchive(bytes.NewReader(archive), 64<<10, DefaultLimits())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.checkpoints == nil || len(a.checkpoints.Checkpoints) == 0 {
+		t.Fatal("expected checkpoints for an indexed archive")
+	}
+}
@@ -0,0 +1,320 @@
+package image
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/blacktop/graboid/pkg/compress"
+	"github.com/blacktop/graboid/pkg/gzran"
+)
+
+// IndexExt is the extension of the index ParseIndexed saves next to an archive
+const IndexExt = ".gidx"
+
+// indexVersion is bumped when the index format changes so older indexes are rebuilt
+const indexVersion = 3
+
+// archiveIndex is what ParseIndexed saves of an archive so it doesn't have to
+// read the archive again while it is unchanged
+type archiveIndex struct {
+	Version     int
+	Size        int64
+	ModTime     time.Time
+	Compression compress.Algorithm
+	Checkpoints *gzran.Index `json:",omitempty"`
+	Files       map[string][]byte
+	Links       map[string]string
+	Layers      map[string]*layerIndex
+}
+
+// layerIndex is the index of a layer in an archive
+type layerIndex struct {
+	Offset           int64
+	Compression      compress.Algorithm
+	Checkpoints      *gzran.Index `json:",omitempty"`
+	Digest           string
+	DiffID           string
+	CompressedSize   int64
+	UncompressedSize int64
+	Entries          []layerEntry
+}
+
+// ParseIndexed parses the image archive at path like Parse and saves an index
+// of it to path+IndexExt, which later calls use instead of reading the archive
+// while its size and modification time are unchanged. The index records where
+// each layer and file is in the archive (with checkpoints to resume
+// decompressing gzip streams from) so NewIndexedFS can read a file by seeking
+// to it rather than rereading the archive up to it. The archive and the index
+// are read within limits like Parse.
+func ParseIndexed(path string, limits Limits) ([]*Tar, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	a, err := readIndex(path, fi, limits)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Debugf("rebuilding the index of %s: %v", path, err)
+		}
+		if a, err = indexArchive(path, fi, limits); err != nil {
+			return nil, err
+		}
+	}
+	a.path = path
+
+	images, err := load(a, limits)
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range images {
+		i.source = a
+	}
+	return images, nil
+}
+
+// indexArchive reads the archive at path and saves its index
+func indexArchive(path string, fi os.FileInfo, limits Limits) (*streamArchive, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	a, err := readArchive(f, gzran.DefaultSpan, limits)
+	if err != nil {
+		return nil, err
+	}
+	// the index only saves rereading the archive so failing to write it isn't an error
+	if err := writeIndex(path, fi, a); err != nil {
+		log.Debugf("failed to save the index of %s: %v", path, err)
+	}
+	return a, nil
+}
+
+// readIndex reads the saved index of the archive at path
+func readIndex(path string, fi os.FileInfo, limits Limits) (*streamArchive, error) {
+	f, err := os.Open(path + IndexExt)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return nil, err
+	}
+	var idx archiveIndex
+	if err := json.NewDecoder(zr).Decode(&idx); err != nil {
+		return nil, err
+	}
+	switch {
+	case idx.Version != indexVersion:
+		return nil, fmt.Errorf("index version %d is not supported", idx.Version)
+	case idx.Size != fi.Size() || !idx.ModTime.Equal(fi.ModTime()):
+		return nil, fmt.Errorf("the archive changed since it was indexed")
+	}
+
+	a := &streamArchive{
+		files:       idx.Files,
+		layers:      make(map[string]*layerBlob),
+		links:       idx.Links,
+		compression: idx.Compression,
+		checkpoints: idx.Checkpoints,
+		limits:      limits,
+	}
+	for name, l := range idx.Layers {
+		blob, err := newLayerBlob(name, l.Entries, limits)
+		if err != nil {
+			return nil, err
+		}
+		blob.offset = l.Offset
+		blob.compression = l.Compression
+		blob.checkpoints = l.Checkpoints
+		blob.digest = l.Digest
+		blob.diffID = l.DiffID
+		blob.compressedSize = l.CompressedSize
+		blob.uncompressedSize = l.UncompressedSize
+		a.layers[name] = blob
+	}
+	return a, nil
+}
+
+// writeIndex saves the index of the archive at path
+func writeIndex(path string, fi os.FileInfo, a *streamArchive) error {
+	idx := archiveIndex{
+		Version:     indexVersion,
+		Size:        fi.Size(),
+		ModTime:     fi.ModTime(),
+		Compression: a.compression,
+		Checkpoints: a.checkpoints,
+		Files:       a.files,
+		Links:       a.links,
+		Layers:      make(map[string]*layerIndex),
+	}
+	for name, blob := range a.layers {
+		idx.Layers[name] = &layerIndex{
+			Offset:           blob.offset,
+			Compression:      blob.compression,
+			Checkpoints:      blob.checkpoints,
+			Digest:           blob.digest,
+			DiffID:           blob.diffID,
+			CompressedSize:   blob.compressedSize,
+			UncompressedSize: blob.uncompressedSize,
+			Entries:          blob.entries,
+		}
+	}
+
+	// write to a temporary file first so a partial index is never read
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+IndexExt+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	zw := gzip.NewWriter(tmp)
+	if err := json.NewEncoder(zw).Encode(idx); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path+IndexExt)
+}
+
+// NewIndexedFS returns the merged filesystem of an image parsed with ParseIndexed.
+// Opening a file seeks to it in the archive and its layer, only decompressing
+// gzip streams from the closest checkpoint before it. zstd and bzip2 streams
+// have no checkpoints and are still decompressed from their start.
+func NewIndexedFS(i *Tar) (*FS, error) {
+	a := i.source
+	if a == nil {
+		return nil, errors.New("image was not parsed with ParseIndexed")
+	}
+	fsys, err := NewFS(i, func() (io.ReadCloser, error) {
+		return os.Open(a.path)
+	})
+	if err != nil {
+		return nil, err
+	}
+	fsys.openAt = func(blob *layerBlob, off int64) (io.ReadCloser, error) {
+		return openAt(blob.compression, blob.checkpoints, func(layerOff int64) (io.ReadCloser, error) {
+			rc, err := openAt(a.compression, a.checkpoints, func(archiveOff int64) (io.ReadCloser, error) {
+				return openFileAt(a.path, archiveOff)
+			}, blob.offset+layerOff)
+			if err != nil {
+				return nil, err
+			}
+			// stop at the end of the layer's file rather than reading into the rest of the archive
+			return readCloser{Reader: io.LimitReader(rc, blob.compressedSize-layerOff), closers: []io.Closer{rc}}, nil
+		}, off)
+	}
+	return fsys, nil
+}
+
+// openAt returns a stream decompressed from off, given a function that returns
+// the compressed stream from an offset. gzip streams resume from the closest
+// checkpoint before off, other compressed streams are decompressed from their start.
+func openAt(algo compress.Algorithm, checkpoints *gzran.Index, open func(off int64) (io.ReadCloser, error), off int64) (io.ReadCloser, error) {
+	switch {
+	case algo == compress.None:
+		return open(off)
+	case algo == compress.Gzip && checkpoints != nil:
+		return checkpoints.Open(open, off)
+	}
+
+	r, err := open(0)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := compress.NewReader(r)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	rc := readCloser{Reader: zr, closers: []io.Closer{zr, r}}
+	if _, err := io.CopyN(ioutil.Discard, zr, off); err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return rc, nil
+}
+
+// openFileAt opens a file and seeks to off
+func openFileAt(name string, off int64) (io.ReadCloser, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// indexedReader decompresses a stream, recording checkpoints if it is gzip
+type indexedReader struct {
+	io.ReadCloser
+	compression compress.Algorithm
+	gz          *gzran.Reader
+	// raw reads the rest of the compressed stream
+	raw io.Reader
+}
+
+// newIndexedReader returns a reader that transparently decompresses r, recording
+// a checkpoint every span bytes if it is gzip and span > 0.
+// Closing the returned reader does NOT close r.
+func newIndexedReader(r io.Reader, span int64) (*indexedReader, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(4)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	ir := &indexedReader{compression: compress.Detect(header), raw: br}
+	if ir.compression == compress.Gzip && span > 0 {
+		if ir.gz, err = gzran.NewReader(br, span); err != nil {
+			return nil, err
+		}
+		ir.ReadCloser = ir.gz
+		return ir, nil
+	}
+	if ir.ReadCloser, err = compress.NewReader(br); err != nil {
+		return nil, err
+	}
+	return ir, nil
+}
+
+// checkpoints returns the checkpoints recorded in a gzip stream
+func (r *indexedReader) checkpoints() *gzran.Index {
+	if r.gz == nil {
+		return nil
+	}
+	return r.gz.Index()
+}
+
+// countingReader counts the bytes read from r
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,272 @@
+package image
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// indexedLayers are gzip layers with files large enough to be spread over several checkpoints
+func indexedLayers(t testing.TB) [][]byte {
+	rnd := rand.New(rand.NewSource(1))
+	big := func(n int) string {
+		data := make([]byte, n)
+		for idx := range data {
+			data[idx] = byte('a' + rnd.Intn(4))
+		}
+		return string(data)
+	}
+	return [][]byte{
+		gzipBytes(t, layerTar(t,
+			dir("data/"),
+			file("data/first", big(6<<20)),
+			file("data/second", big(5<<20)),
+			file("data/small", "small"),
+		)),
+		gzipBytes(t, layerTar(t,
+			dir("data/"),
+			file("data/third", big(9<<20)),
+			hardlink("data/link", "data/second"),
+			file("data/.wh.small", ""),
+		)),
+	}
+}
+
+// writeArchive writes a gzip image archive of layers to dir
+func writeArchive(t testing.TB, dir string, layers ...[]byte) string {
+	t.Helper()
+	path := filepath.Join(dir, "image.tar.gz")
+	if err := ioutil.WriteFile(path, gzipBytes(t, imageArchive(t, layers...)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func parseIndexed(t *testing.T, path string) (*Tar, error) {
+	t.Helper()
+	images, err := ParseIndexed(path, DefaultLimits())
+	if err != nil {
+		return nil, err
+	}
+	if len(images) != 1 {
+		t.Fatalf("expected one image, got %d", len(images))
+	}
+	return images[0], nil
+}
+
+// setModTime sets the modification time of the file at path
+func setModTime(t *testing.T, path string, mtime time.Time) {
+	t.Helper()
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// scramble overwrites the file at path with as many random bytes, keeping its modification time
+func scramble(t *testing.T, path string) {
+	t.Helper()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	garbage := make([]byte, fi.Size())
+	rand.Read(garbage)
+	if err := ioutil.WriteFile(path, garbage, 0644); err != nil {
+		t.Fatal(err)
+	}
+	setModTime(t, path, fi.ModTime())
+}
+
+func TestParseIndexed(t *testing.T) {
+	dir := t.TempDir()
+	path := writeArchive(t, dir, indexedLayers(t)...)
+	archive, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i, err := parseIndexed(t, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + IndexExt); err != nil {
+		t.Fatalf("the index wasn't saved: %v", err)
+	}
+	if len(i.source.checkpoints.Checkpoints) == 0 || len(i.blobs[0].checkpoints.Checkpoints) == 0 {
+		t.Fatal("expected checkpoints in the archive and its layers")
+	}
+
+	// the second parse reads the index, not the archive
+	i, err = parseIndexed(t, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexed, err := NewIndexedFS(i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamed := testFSFrom(t, archive)
+	for _, name := range []string{"data/first", "data/second", "data/third", "data/link"} {
+		want, err := streamed.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := indexed.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%s: the indexed read differs from NewFS", name)
+		}
+		checkSeek(t, indexed, name, want)
+	}
+	if _, err := indexed.Stat("data/small"); err == nil {
+		t.Fatal("data/small should be whited out")
+	}
+
+	scramble(t, path)
+	if _, err := parseIndexed(t, path); err != nil {
+		t.Fatalf("expected the unchanged index to be used, got %v", err)
+	}
+}
+
+// testFSFrom returns the merged filesystem of the image archive
+func testFSFrom(t *testing.T, archive []byte) *FS {
+	t.Helper()
+	images, err := Parse(bytes.NewReader(archive), DefaultLimits())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := NewFS(images[0], func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(archive)), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fsys
+}
+
+// checkSeek reads the file at random offsets, which resume from checkpoints
+func checkSeek(t *testing.T, fsys *FS, name string, want []byte) {
+	t.Helper()
+	f, err := fsys.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rs := f.(io.ReadSeeker)
+	rnd := rand.New(rand.NewSource(int64(len(want))))
+	buf := make([]byte, 4096)
+	for n := 0; n < 8; n++ {
+		off := rnd.Int63n(int64(len(want) - len(buf)))
+		if _, err := rs.Seek(off, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(rs, buf); err != nil {
+			t.Fatalf("%s: read at %d: %v", name, off, err)
+		}
+		if !bytes.Equal(buf, want[off:off+int64(len(buf))]) {
+			t.Fatalf("%s: read at %d differs", name, off)
+		}
+	}
+}
+
+func TestParseIndexedRebuild(t *testing.T) {
+	small := layerTar(t, file("a", "a"))
+	tests := []struct {
+		name   string
+		change func(t *testing.T, path string)
+	}{
+		{"modification time", func(t *testing.T, path string) {
+			scramble(t, path)
+			fi, _ := os.Stat(path)
+			setModTime(t, path, fi.ModTime().Add(time.Second))
+		}},
+		{"size", func(t *testing.T, path string) {
+			fi, _ := os.Stat(path)
+			if err := ioutil.WriteFile(path, make([]byte, fi.Size()+1), 0644); err != nil {
+				t.Fatal(err)
+			}
+			setModTime(t, path, fi.ModTime())
+		}},
+		{"index version", func(t *testing.T, path string) {
+			scramble(t, path)
+			rewriteIndex(t, path, func(idx *archiveIndex) { idx.Version = indexVersion + 1 })
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeArchive(t, t.TempDir(), small)
+			if _, err := parseIndexed(t, path); err != nil {
+				t.Fatal(err)
+			}
+			tt.change(t, path)
+			// the index is rebuilt from the changed archive, which is no longer an image
+			if _, err := parseIndexed(t, path); err == nil {
+				t.Fatal("expected the index to be rebuilt")
+			}
+		})
+	}
+
+	// a rebuilt index replaces the stale one
+	dir := t.TempDir()
+	path := writeArchive(t, dir, small)
+	if _, err := parseIndexed(t, path); err != nil {
+		t.Fatal(err)
+	}
+	path = writeArchive(t, dir, layerTar(t, file("b", "bb")))
+	i, err := parseIndexed(t, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := NewIndexedFS(i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := fsys.ReadFile("b"); err != nil || string(data) != "bb" {
+		t.Fatalf("read b from the rebuilt index: %q, %v", data, err)
+	}
+	if _, err := fsys.Stat("a"); err == nil {
+		t.Fatal("the stale index was used")
+	}
+	fi, _ := os.Stat(path)
+	if _, err := readIndex(path, fi, DefaultLimits()); err != nil {
+		t.Fatalf("the rebuilt index wasn't saved: %v", err)
+	}
+
+	if _, err := NewIndexedFS(parseImage(t, small)); err == nil {
+		t.Fatal("expected an error for an image not parsed with ParseIndexed")
+	}
+}
+
+// rewriteIndex modifies the saved index of the archive at path
+func rewriteIndex(t *testing.T, path string, modify func(idx *archiveIndex)) {
+	t.Helper()
+	data, err := ioutil.ReadFile(path + IndexExt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var idx archiveIndex
+	if err := json.NewDecoder(zr).Decode(&idx); err != nil {
+		t.Fatal(err)
+	}
+	modify(&idx)
+	b, err := json.Marshal(idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path+IndexExt, gzipBytes(t, b), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,9 +1,15 @@
 package image
 
 import (
+	"crypto/sha256"
 	"fmt"
+	"hash"
+	"path"
 	"strings"
+	"time"
 
+	"github.com/blacktop/graboid/pkg/compress"
+	"github.com/blacktop/graboid/pkg/gzran"
 	"github.com/dustin/go-humanize"
 	"github.com/wagoodman/dive/dive/filetree"
 )
@@ -22,22 +28,140 @@ type Layer interface {
 	Size() uint64
 	Tree() *filetree.FileTree
 	String() string
+	// Digest is the digest of the layer as it is stored in the archive
+	Digest() string
+	// DiffID is the digest of the uncompressed layer tar
+	DiffID() string
+	MediaType() string
+	CompressedSize() int64
+	UncompressedSize() int64
+	// Changes are the paths the layer adds, modifies and removes
+	Changes() (*Changes, error)
+}
+
+// layerBlob is a layer tar read from an image archive
+type layerBlob struct {
+	// path is the name of the layer's file in the archive
+	path string
+	tree *filetree.FileTree
+	// opaque are the directories the layer marks opaque (hiding the lower layers' contents)
+	opaque           []string
+	compression      compress.Algorithm
+	digest           string
+	diffID           string
+	compressedSize   int64
+	uncompressedSize int64
+
+	// offset is where the layer's file starts in the uncompressed archive
+	offset int64
+	// checkpoints let a gzip layer be decompressed from the middle
+	checkpoints *gzran.Index
+	entries     []layerEntry
+	// files maps the paths in the layer to their (last) entry
+	files map[string]*layerEntry
+}
+
+// layerEntry is a file in a layer tar
+type layerEntry struct {
+	filetree.FileInfo
+	// Offset is where the file's contents start in the uncompressed layer tar
+	Offset  int64
+	ModTime time.Time
+	Uname   string `json:",omitempty"`
+	Gname   string `json:",omitempty"`
+	// Xattrs are the file's extended attributes
+	Xattrs map[string]string `json:",omitempty"`
+	// Hash is the xxhash of the file's contents
+	Hash uint64 `json:",omitempty"`
+}
+
+// digester hashes and counts the bytes written to it
+type digester struct {
+	hash hash.Hash
+	size int64
+}
+
+func newDigester() *digester {
+	return &digester{hash: sha256.New()}
+}
+
+func (d *digester) Write(p []byte) (int, error) {
+	d.size += int64(len(p))
+	return d.hash.Write(p)
+}
+
+// Digest returns the sha256 digest of the bytes written so far
+func (d *digester) Digest() string {
+	return fmt.Sprintf("sha256:%x", d.hash.Sum(nil))
+}
+
+// layerMediaType returns the media type of a layer found in a docker archive
+func layerMediaType(algo compress.Algorithm) string {
+	switch algo {
+	case compress.None:
+		return mediaTypeDockerLayerTar
+	case compress.Gzip:
+		return mediaTypeDockerLayer
+	}
+	return mediaTypeOCILayer + "+" + string(algo)
 }
 
 // dockerLayer represents a Docker image layer and metadata
 type dockerLayer struct {
-	tarPath string
-	history imageHistory
-	index   int
-	tree    *filetree.FileTree
+	image     *Tar
+	tarPath   string
+	history   imageHistory
+	index     int
+	tree      *filetree.FileTree
+	blob      *layerBlob
+	mediaType string
 }
 
 func (dockerLayer *dockerLayer) TarID() string {
+	// docker save stores layers as <id>/layer.tar and OCI layouts as blobs/<algorithm>/<hex>
+	if path.Base(dockerLayer.tarPath) == "layer.tar" {
+		return path.Dir(dockerLayer.tarPath)
+	}
+	if strings.HasPrefix(dockerLayer.tarPath, "blobs/") {
+		return path.Base(dockerLayer.tarPath)
+	}
 	return strings.TrimSuffix(dockerLayer.tarPath, ".tar")
 }
 
+// ID returns the hex of the layer's diff_id
 func (dockerLayer *dockerLayer) ID() string {
-	return dockerLayer.history.ID
+	return strings.TrimPrefix(dockerLayer.blob.diffID, "sha256:")
+}
+
+func (dockerLayer *dockerLayer) Digest() string {
+	return dockerLayer.blob.digest
+}
+
+func (dockerLayer *dockerLayer) DiffID() string {
+	return dockerLayer.blob.diffID
+}
+
+func (dockerLayer *dockerLayer) MediaType() string {
+	if len(dockerLayer.mediaType) > 0 {
+		return dockerLayer.mediaType
+	}
+	return layerMediaType(dockerLayer.blob.compression)
+}
+
+func (dockerLayer *dockerLayer) CompressedSize() int64 {
+	return dockerLayer.blob.compressedSize
+}
+
+func (dockerLayer *dockerLayer) UncompressedSize() int64 {
+	return dockerLayer.blob.uncompressedSize
+}
+
+func (dockerLayer *dockerLayer) Changes() (*Changes, error) {
+	changes, err := dockerLayer.image.layerChanges()
+	if err != nil {
+		return nil, err
+	}
+	return changes[dockerLayer.index], nil
 }
 
 func (dockerLayer *dockerLayer) Index() int {
@@ -0,0 +1,147 @@
+package image
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+	"github.com/wagoodman/dive/dive/filetree"
+)
+
+var (
+	// ErrLimit is returned when an image archive or an extraction exceeds its Limits
+	ErrLimit = errors.New("limit exceeded")
+	// ErrUnsafePath is returned for a path that is absolute or leaves the root it is relative to
+	ErrUnsafePath = errors.New("unsafe path")
+)
+
+// Limits bounds what reading an untrusted image archive may cost, a zero field is unlimited
+type Limits struct {
+	// MaxBytes is the most bytes decompressed from an archive or one of its
+	// layers, and the most bytes of files extracted at once
+	MaxBytes int64
+	// MaxEntries is the most entries in an archive or one of its layers, and
+	// the most files extracted at once
+	MaxEntries int
+	// MaxDepth is the most path elements of a file in a layer
+	MaxDepth int
+	// MaxJSONSize is the largest manifest, index or config kept in memory
+	MaxJSONSize int64
+}
+
+// DefaultLimits returns limits that real images stay well within
+func DefaultLimits() Limits {
+	return Limits{
+		MaxBytes:    32 << 30,
+		MaxEntries:  1 << 20,
+		MaxDepth:    256,
+		MaxJSONSize: 32 << 20,
+	}
+}
+
+// limitedReader fails with ErrLimit once more than max bytes are read from r
+type limitedReader struct {
+	r    io.Reader
+	max  int64
+	n    int64
+	name string
+}
+
+// reader bounds the bytes decompressed from name to MaxBytes
+func (l Limits) reader(r io.Reader, name string) io.Reader {
+	if l.MaxBytes <= 0 {
+		return r
+	}
+	return &limitedReader{r: r, max: l.MaxBytes, name: name}
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.n > l.max {
+		return n, fmt.Errorf("%w: %s decompresses to more than %s", ErrLimit, l.name, humanize.IBytes(uint64(l.max)))
+	}
+	return n, err
+}
+
+// readJSON reads a manifest, index or config of at most MaxJSONSize bytes
+func (l Limits) readJSON(name string, r io.Reader) ([]byte, error) {
+	max := l.MaxJSONSize
+	if max <= 0 {
+		return ioutil.ReadAll(r)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > max {
+		return nil, l.errTooLarge(name)
+	}
+	return data, nil
+}
+
+// errTooLarge is the error for a file too large to be a manifest, index or config
+func (l Limits) errTooLarge(name string) error {
+	return fmt.Errorf("%w: %s is larger than %s", ErrLimit, name, humanize.IBytes(uint64(l.MaxJSONSize)))
+}
+
+// tooManyEntries returns an error once n entries exceed MaxEntries
+func (l Limits) tooManyEntries(name string, n int) error {
+	if max := l.MaxEntries; max > 0 && n > max {
+		return fmt.Errorf("%w: %s has more than %d entries", ErrLimit, name, max)
+	}
+	return nil
+}
+
+// escapes returns true if a path relative to a root is absolute or leaves it
+func escapes(name string) bool {
+	p := path.Clean(name)
+	return path.IsAbs(name) || p == ".." || strings.HasPrefix(p, "../")
+}
+
+// checkEntry returns an error for a layer entry whose path (or hard link
+// target) is absolute, leaves the layer's root or is nested too deeply
+func (l Limits) checkEntry(info filetree.FileInfo) error {
+	if escapes(info.Path) {
+		return fmt.Errorf("%w: %s", ErrUnsafePath, info.Path)
+	}
+	if info.TypeFlag == tar.TypeLink && escapes(info.Linkname) {
+		return fmt.Errorf("%w: %s links to %s", ErrUnsafePath, info.Path, info.Linkname)
+	}
+	if max := l.MaxDepth; max > 0 && strings.Count(strings.Trim(archiveName(info.Path), "/"), "/") >= max {
+		return fmt.Errorf("%w: %s is nested more than %d deep", ErrLimit, info.Path, max)
+	}
+	return nil
+}
+
+// checkPath returns an error for an extracted file's path that isn't a
+// relative io/fs path under the root of the extraction
+func checkPath(name string) error {
+	if !fs.ValidPath(name) {
+		return fmt.Errorf("%w: %s", ErrUnsafePath, name)
+	}
+	return nil
+}
+
+// checkExtract returns an error if extracting the files would exceed the limits
+func (l Limits) checkExtract(items, links []extractItem) error {
+	if err := l.tooManyEntries("the extraction", len(items)+len(links)); err != nil {
+		return err
+	}
+	var size int64
+	for _, item := range items {
+		if item.fi.Mode().IsRegular() {
+			size += item.fi.Size()
+		}
+	}
+	if max := l.MaxBytes; max > 0 && size > max {
+		return fmt.Errorf("%w: the extracted files add up to more than %s", ErrLimit, humanize.IBytes(uint64(max)))
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package image
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var updateHostile = flag.Bool("hostile.update", false, "rewrite the image archives in testdata/hostile")
+
+// testLimits are small enough for the hostile archives to exceed them quickly
+var testLimits = Limits{
+	MaxBytes:    16 << 20,
+	MaxEntries:  100,
+	MaxDepth:    32,
+	MaxJSONSize: 64 << 10,
+}
+
+// hostileArchives are image archives that try to write outside of the root or
+// to exhaust memory or disk, named as they are saved in testdata/hostile
+func hostileArchives(t testing.TB) map[string][]byte {
+	var deep []string
+	for idx := 0; idx < 40; idx++ {
+		deep = append(deep, "d")
+	}
+	var many []testEntry
+	for idx := 0; idx < 200; idx++ {
+		many = append(many, file(fmt.Sprintf("f%d", idx), ""))
+	}
+	bigConfig := `{"architecture":"amd64","os":"linux","rootfs":{"type":"layers","diff_ids":[]}}` + strings.Repeat(" ", 128<<10)
+
+	return map[string][]byte{
+		"dotdot.tar":            imageArchive(t, layerTar(t, file("../evil", "x"))),
+		"dotdot-nested.tar":     imageArchive(t, layerTar(t, dir("a/"), file("a/../../evil", "x"))),
+		"absolute.tar":          imageArchive(t, layerTar(t, file("/etc/evil", "x"))),
+		"hardlink-dotdot.tar":   imageArchive(t, layerTar(t, file("a", "x"), hardlink("b", "../../etc/passwd"))),
+		"hardlink-absolute.tar": imageArchive(t, layerTar(t, file("a", "x"), hardlink("b", "/etc/passwd"))),
+		// the symlinks are fine in the layer but extracting them would leave the root
+		"symlink-chain.tar": imageArchive(t, layerTar(t,
+			symlink("up", ".."),
+			symlink("chain", "up/up/etc/passwd"),
+		)),
+		"symlink-absolute.tar": imageArchive(t, layerTar(t, symlink("passwd", "/etc/passwd"))),
+		// a file written through a symlink to the parent directory, which the upper layer replaces
+		"symlink-through.tar": imageArchive(t,
+			layerTar(t, symlink("up", "..")),
+			layerTar(t, dir("up/"), file("up/evil", "x")),
+		),
+		"deep.tar":    imageArchive(t, layerTar(t, file(strings.Join(deep, "/")+"/f", "x"))),
+		"entries.tar": imageArchive(t, layerTar(t, many...)),
+		// 64MiB of zeros compress to 64KiB
+		"bomb.tar": imageArchive(t, gzipBytes(t, layerTar(t, file("zeros", string(make([]byte, 64<<20)))))),
+		"json.tar": layerTar(t,
+			file("config.json", bigConfig),
+			file("manifest.json", `[{"Config":"config.json","RepoTags":["test:latest"],"Layers":[]}]`),
+		),
+		// layers tarred up from their root start with a "./" entry
+		"root.tar": imageArchive(t, layerTar(t, dir("./"), dir("./etc/"), file("./etc/hostname", "x"))),
+	}
+}
+
+// readHostile returns the archives in testdata/hostile, rewriting them first with -hostile.update
+func readHostile(t testing.TB) map[string][]byte {
+	t.Helper()
+	dir := filepath.Join("testdata", "hostile")
+	if *updateHostile {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for name, data := range hostileArchives(t) {
+			if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	archives := make(map[string][]byte)
+	for _, p := range paths {
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		archives[filepath.Base(p)] = data
+	}
+	return archives
+}
+
+// extractSandboxed extracts everything in fsys to a root in an empty directory
+// and fails if anything is written beside the root
+func extractSandboxed(t *testing.T, fsys *FS, extract func(fsys *FS, dt *DirTarget) error) error {
+	t.Helper()
+	sandbox := t.TempDir()
+	dt, err := NewDirTarget(filepath.Join(sandbox, "root"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = extract(fsys, dt)
+	if cerr := dt.Close(); err == nil {
+		err = cerr
+	}
+	entries, rerr := ioutil.ReadDir(sandbox)
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	if len(entries) != 1 || entries[0].Name() != "root" {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		t.Fatalf("extraction wrote outside of the root: %v", names)
+	}
+	return err
+}
+
+func TestHostileArchives(t *testing.T) {
+	tests := map[string]struct {
+		parse, extract error
+	}{
+		"dotdot.tar":            {parse: ErrUnsafePath},
+		"dotdot-nested.tar":     {parse: ErrUnsafePath},
+		"absolute.tar":          {parse: ErrUnsafePath},
+		"hardlink-dotdot.tar":   {parse: ErrUnsafePath},
+		"hardlink-absolute.tar": {parse: ErrUnsafePath},
+		"symlink-chain.tar":     {extract: ErrUnsafePath},
+		"symlink-absolute.tar":  {extract: ErrUnsafePath},
+		"symlink-through.tar":   {},
+		"deep.tar":              {parse: ErrLimit},
+		"entries.tar":           {parse: ErrLimit},
+		"bomb.tar":              {parse: ErrLimit},
+		"json.tar":              {parse: ErrLimit},
+		"root.tar":              {},
+	}
+
+	archives := readHostile(t)
+	var names []string
+	for name := range archives {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) != len(tests) {
+		t.Fatalf("testdata/hostile has %v, run the tests with -hostile.update", names)
+	}
+	for _, name := range names {
+		archive := archives[name]
+		want, ok := tests[name]
+		if !ok {
+			t.Fatalf("unexpected testdata/hostile/%s", name)
+		}
+		t.Run(name, func(t *testing.T) {
+			images, err := Parse(bytes.NewReader(archive), testLimits)
+			if !errors.Is(err, want.parse) || (want.parse == nil && err != nil) {
+				t.Fatalf("parse: got %v, expected %v", err, want.parse)
+			}
+			if err != nil {
+				return
+			}
+			fsys, err := NewFS(images[0], func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(bytes.NewReader(archive)), nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = extractSandboxed(t, fsys, func(fsys *FS, dt *DirTarget) error {
+				_, err := ExtractPaths(fsys, []string{"."}, dt, testLimits)
+				return err
+			})
+			if !errors.Is(err, want.extract) || (want.extract == nil && err != nil) {
+				t.Fatalf("extract: got %v, expected %v", err, want.extract)
+			}
+		})
+	}
+}
+
+func TestHostileArchivesDefaultLimits(t *testing.T) {
+	// unsafe paths are rejected whatever the limits, and real images stay within the default ones
+	archives := readHostile(t)
+	for _, name := range []string{"dotdot.tar", "absolute.tar", "hardlink-dotdot.tar"} {
+		if _, err := Parse(bytes.NewReader(archives[name]), Limits{}); !errors.Is(err, ErrUnsafePath) {
+			t.Errorf("%s: expected an unsafe path without limits, got %v", name, err)
+		}
+	}
+	for _, name := range []string{"entries.tar", "bomb.tar", "json.tar", "root.tar"} {
+		if _, err := Parse(bytes.NewReader(archives[name]), DefaultLimits()); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestExtractLimits(t *testing.T) {
+	big := strings.Repeat("x", 100<<10)
+	archive := imageArchive(t, layerTar(t, dir("a/"), file("a/big", big), file("a/small", "x")))
+	fsys := testFSFrom(t, archive)
+
+	extract := func(limits Limits) error {
+		return extractSandboxed(t, fsys, func(fsys *FS, dt *DirTarget) error {
+			_, err := ExtractPaths(fsys, []string{"a"}, dt, limits)
+			return err
+		})
+	}
+	if err := extract(Limits{MaxEntries: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := extract(Limits{MaxEntries: 2}); !errors.Is(err, ErrLimit) {
+		t.Fatalf("expected too many files, got %v", err)
+	}
+	if err := extract(Limits{MaxBytes: 100 << 10}); !errors.Is(err, ErrLimit) {
+		t.Fatalf("expected too many bytes, got %v", err)
+	}
+
+	// the files fit but the layer holding them doesn't
+	limits := Limits{MaxBytes: 100<<10 + 1}
+	err := extractSandboxed(t, fsys, func(fsys *FS, dt *DirTarget) error {
+		_, err := ExtractPathsFrom(bytes.NewReader(archive), fsys, []string{"a"}, dt, limits)
+		return err
+	})
+	if !errors.Is(err, ErrLimit) {
+		t.Fatalf("expected the layer to be too large, got %v", err)
+	}
+
+	// files read through the filesystem are decompressed within the limits the image was parsed with
+	fsys.i.limits = limits
+	if _, err := fsys.ReadFile("a/big"); !errors.Is(err, ErrLimit) {
+		t.Fatalf("expected the layer to be too large, got %v", err)
+	}
+}
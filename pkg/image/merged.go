@@ -0,0 +1,169 @@
+package image
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/wagoodman/dive/dive/filetree"
+)
+
+const (
+	// whiteoutPrefix marks a file deleted from the lower layers
+	whiteoutPrefix = ".wh."
+	// whiteoutOpaque marks a directory whose lower layers' contents are hidden
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// Merged is the filesystem a container of the image sees: its layers stacked
+// in order with their whiteouts and opaque directories applied
+type Merged struct {
+	Tree *filetree.FileTree
+	// origins maps each path to the index of the layer it came from
+	origins map[string]int
+}
+
+// MergedFile is a file in the merged filesystem
+type MergedFile struct {
+	Path  string
+	Info  filetree.FileInfo
+	Layer int
+}
+
+// Merged stacks the image's layers into the filesystem a container sees
+func (i *Tar) Merged() (*Merged, error) {
+	if i.merged != nil {
+		return i.merged, nil
+	}
+	m, err := mergeLayers(i.blobs)
+	if err != nil {
+		return nil, err
+	}
+	i.merged = m
+	return m, nil
+}
+
+// newMerged returns an empty merged filesystem
+func newMerged() *Merged {
+	m := &Merged{
+		Tree:    filetree.NewFileTree(),
+		origins: make(map[string]int),
+	}
+	m.Tree.Name = "merged"
+	return m
+}
+
+// mergeLayers stacks layers in order with their whiteouts and opaque directories applied
+func mergeLayers(blobs []*layerBlob) (*Merged, error) {
+	m := newMerged()
+	for idx, blob := range blobs {
+		if err := m.add(idx, blob); err != nil {
+			return nil, err
+		}
+	}
+
+	err := m.Tree.VisitDepthChildFirst(func(node *filetree.FileNode) error {
+		if !node.Data.FileInfo.IsDir {
+			m.Tree.FileSize += uint64(node.Data.FileInfo.Size)
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// add stacks layer idx on top of the merged filesystem
+func (m *Merged) add(idx int, blob *layerBlob) error {
+	// an opaque directory only hides the lower layers, so it is emptied before the layer is added
+	for _, dir := range blob.opaque {
+		if node, err := m.Tree.GetNode(dir); err == nil {
+			for _, child := range node.Children {
+				if err := m.remove(child); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	err := blob.tree.VisitDepthParentFirst(func(node *filetree.FileNode) error {
+		if !node.IsWhiteout() {
+			return nil
+		}
+		if lower, err := m.Tree.GetNode(node.Path()); err == nil {
+			return m.remove(lower)
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	return blob.tree.VisitDepthParentFirst(func(node *filetree.FileNode) error {
+		if node.IsWhiteout() {
+			return nil
+		}
+		p := node.Path()
+		info := node.Data.FileInfo
+		if lower, err := m.Tree.GetNode(p); err == nil {
+			if len(info.Path) == 0 {
+				// a parent directory that isn't in the layer tar keeps the lower layer's
+				return nil
+			}
+			if !info.IsDir {
+				// a file replacing a directory hides its contents
+				for _, child := range lower.Children {
+					if err := m.remove(child); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		if _, _, err := m.Tree.AddPath(p, info); err != nil {
+			return err
+		}
+		m.origins[p] = idx
+		return nil
+	}, nil)
+}
+
+// remove removes a node and everything under it from the merged filesystem
+func (m *Merged) remove(node *filetree.FileNode) error {
+	err := node.VisitDepthChildFirst(func(n *filetree.FileNode) error {
+		delete(m.origins, n.Path())
+		return nil
+	}, nil)
+	if err != nil {
+		return err
+	}
+	return node.Remove()
+}
+
+// Layer returns the index of the layer a path in the merged filesystem came from
+func (m *Merged) Layer(p string) (int, bool) {
+	idx, ok := m.origins[path.Clean("/"+strings.TrimPrefix(p, "/"))]
+	return idx, ok
+}
+
+// Lookup returns a file in the merged filesystem
+func (m *Merged) Lookup(p string) (MergedFile, bool) {
+	p = path.Clean("/" + strings.TrimPrefix(p, "/"))
+	node, err := m.Tree.GetNode(p)
+	if err != nil || node == m.Tree.Root {
+		return MergedFile{}, false
+	}
+	return MergedFile{Path: p, Info: node.Data.FileInfo, Layer: m.origins[p]}, true
+}
+
+// Files returns every file in the merged filesystem sorted by path
+func (m *Merged) Files() []MergedFile {
+	var files []MergedFile
+	m.Tree.VisitDepthParentFirst(func(node *filetree.FileNode) error {
+		p := node.Path()
+		files = append(files, MergedFile{Path: p, Info: node.Data.FileInfo, Layer: m.origins[p]})
+		return nil
+	}, nil)
+	sort.Slice(files, func(a, b int) bool { return files[a].Path < files[b].Path })
+	return files
+}
@@ -0,0 +1,154 @@
+package image
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMerged(t *testing.T) {
+	tests := []struct {
+		name   string
+		layers [][]testEntry
+		// want maps every path in the merged filesystem to the layer it came from
+		want map[string]int
+	}{
+		{
+			name: "whiteout file",
+			layers: [][]testEntry{
+				{dir("etc/"), file("etc/passwd", "root"), file("etc/shadow", "secret")},
+				{file("etc/.wh.shadow", "")},
+			},
+			want: map[string]int{"/etc": 0, "/etc/passwd": 0},
+		},
+		{
+			name: "whiteout directory",
+			layers: [][]testEntry{
+				{dir("var/"), dir("var/cache/"), file("var/cache/a", "a"), file("var/log", "log")},
+				{file("var/.wh.cache", "")},
+			},
+			want: map[string]int{"/var": 0, "/var/log": 0},
+		},
+		{
+			name: "whiteout of a file that was never there",
+			layers: [][]testEntry{
+				{dir("etc/"), file("etc/passwd", "root")},
+				{file("etc/.wh.group", "")},
+			},
+			want: map[string]int{"/etc": 0, "/etc/passwd": 0},
+		},
+		{
+			name: "whiteout then re-add",
+			layers: [][]testEntry{
+				{file("a", "one")},
+				{file(".wh.a", "")},
+				{file("a", "three")},
+			},
+			want: map[string]int{"/a": 2},
+		},
+		{
+			name: "opaque directory",
+			layers: [][]testEntry{
+				{dir("app/"), file("app/old", "old"), dir("app/lib/"), file("app/lib/x.so", "x"), file("keep", "keep")},
+				{dir("app/"), file("app/.wh..wh..opq", ""), file("app/new", "new")},
+			},
+			want: map[string]int{"/app": 1, "/app/new": 1, "/keep": 0},
+		},
+		{
+			name: "opaque directory re-adding a file",
+			layers: [][]testEntry{
+				{dir("app/"), file("app/a", "a"), file("app/b", "b")},
+				{dir("app/"), file("app/.wh..wh..opq", ""), file("app/a", "a")},
+			},
+			want: map[string]int{"/app": 1, "/app/a": 1},
+		},
+		{
+			name: "file replacing a directory",
+			layers: [][]testEntry{
+				{dir("opt/"), dir("opt/tool/"), file("opt/tool/bin", "bin")},
+				{file("opt/tool", "script")},
+			},
+			want: map[string]int{"/opt": 0, "/opt/tool": 1},
+		},
+		{
+			name: "symlink replacing a directory",
+			layers: [][]testEntry{
+				{dir("lib/"), file("lib/libc.so", "libc")},
+				{dir("usr/"), dir("usr/lib/"), symlink("lib", "usr/lib")},
+			},
+			want: map[string]int{"/lib": 1, "/usr": 1, "/usr/lib": 1},
+		},
+		{
+			name: "directory replacing a file",
+			layers: [][]testEntry{
+				{file("data", "file")},
+				{dir("data/"), file("data/x", "x")},
+			},
+			want: map[string]int{"/data": 1, "/data/x": 1},
+		},
+		{
+			name: "parent directory missing from the upper layer",
+			layers: [][]testEntry{
+				{dir("etc/"), file("etc/passwd", "root")},
+				{file("etc/hosts", "localhost")},
+			},
+			want: map[string]int{"/etc": 0, "/etc/passwd": 0, "/etc/hosts": 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var layers [][]byte
+			for _, entries := range tt.layers {
+				layers = append(layers, layerTar(t, entries...))
+			}
+			m, err := parseImage(t, layers...).Merged()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string]int)
+			for _, f := range m.Files() {
+				if f.Path == "/" {
+					continue
+				}
+				if strings.Contains(f.Path, whiteoutPrefix) {
+					t.Fatalf("whiteout %s is in the merged filesystem", f.Path)
+				}
+				got[f.Path] = f.Layer
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("merged filesystem is %v, expected %v", got, tt.want)
+			}
+			for p, layer := range tt.want {
+				if f, ok := m.Lookup(p); !ok || f.Layer != layer {
+					t.Fatalf("lookup %s: got layer %d (%v), expected %d", p, f.Layer, ok, layer)
+				}
+			}
+		})
+	}
+}
+
+func TestMergedContents(t *testing.T) {
+	i := parseImage(t,
+		layerTar(t, file("a", "lower"), file("b", "same")),
+		layerTar(t, file("a", "upper!")),
+	)
+	m, err := i.Merged()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p, size := range map[string]int64{"/a": 6, "/b": 4} {
+		f, ok := m.Lookup(p)
+		if !ok {
+			t.Fatalf("%s is missing", p)
+		}
+		if f.Info.Size != size {
+			t.Fatalf("%s: size is %d, expected %d", p, f.Info.Size, size)
+		}
+	}
+	if _, ok := m.Lookup("/missing"); ok {
+		t.Fatal("lookup of a missing file succeeded")
+	}
+	if m.Tree.FileSize != 10 {
+		t.Fatalf("merged size is %d, expected 10", m.Tree.FileSize)
+	}
+}
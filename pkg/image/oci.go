@@ -0,0 +1,218 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+)
+
+const (
+	// OCILayoutFile is the file marking the root of an OCI image layout
+	OCILayoutFile = "oci-layout"
+	// OCIIndexFile is the OCI image layout's entry point
+	OCIIndexFile = "index.json"
+	// OCILayoutVersion is the OCI image layout version written
+	OCILayoutVersion = "1.0.0"
+	// MediaTypeOCIIndex is the OCI image index media type
+	MediaTypeOCIIndex = "application/vnd.oci.image.index.v1+json"
+	// MediaTypeOCIConfig is the OCI image config media type
+	MediaTypeOCIConfig = "application/vnd.oci.image.config.v1+json"
+	// AnnotationRefName is the annotation holding an image's reference name in an OCI layout
+	AnnotationRefName = "org.opencontainers.image.ref.name"
+	// AnnotationImageName is the annotation holding an image's full name (as used by containerd)
+	AnnotationImageName = "io.containerd.image.name"
+	// mediaTypeDockerManifestList is the docker manifest list media type (an image index)
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	// mediaTypeDockerLayer is the media type of docker's gzipped layers
+	mediaTypeDockerLayer = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	// mediaTypeDockerLayerTar is the media type of docker's uncompressed layers
+	mediaTypeDockerLayerTar = "application/vnd.docker.image.rootfs.diff.tar"
+	// mediaTypeOCILayer is the media type of uncompressed OCI layers (compressed layers add +<algorithm>)
+	mediaTypeOCILayer = "application/vnd.oci.image.layer.v1.tar"
+	// annotationReferenceType marks the attestation manifests buildkit adds to an index
+	annotationReferenceType = "vnd.docker.reference.type"
+)
+
+// Format is an image archive format
+type Format string
+
+const (
+	// FormatDocker is the `docker load` archive format
+	FormatDocker Format = "docker"
+	// FormatOCI is the OCI image layout format
+	FormatOCI Format = "oci"
+)
+
+// ParseFormat parses an archive format name
+func ParseFormat(name string) (Format, error) {
+	switch Format(strings.ToLower(name)) {
+	case FormatDocker, "":
+		return FormatDocker, nil
+	case FormatOCI:
+		return FormatOCI, nil
+	}
+	return "", fmt.Errorf("unknown archive format %q (must be docker or oci)", name)
+}
+
+// Descriptor describes a blob in an OCI image layout
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *OCIPlatform      `json:"platform,omitempty"`
+}
+
+// OCIPlatform is the platform of a manifest in an OCI image index
+type OCIPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// OCIIndex is an OCI image index
+type OCIIndex struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Manifests     []Descriptor `json:"manifests"`
+}
+
+// BlobPath returns the path of a blob in an OCI image layout
+func BlobPath(digest string) string {
+	algo, hex := "sha256", digest
+	if idx := strings.Index(digest, ":"); idx > 0 {
+		algo, hex = digest[:idx], digest[idx+1:]
+	}
+	return path.Join("blobs", algo, hex)
+}
+
+// OCIManifest is an OCI (or docker v2 schema 2) image manifest
+type OCIManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	Config        Descriptor        `json:"config"`
+	Layers        []Descriptor      `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// ociImage is an image manifest found in an OCI layout's index
+type ociImage struct {
+	Descriptor
+	// RefName and ImageName are from the index.json descriptor that led to the manifest
+	RefName   string
+	ImageName string
+}
+
+func (img ociImage) String() string {
+	name := img.ImageName
+	if len(name) == 0 {
+		name = img.RefName
+	}
+	if len(name) == 0 {
+		name = img.Digest
+	}
+	if p := img.Platform; p != nil {
+		if len(p.Variant) > 0 {
+			return fmt.Sprintf("%s (%s/%s/%s)", name, p.OS, p.Architecture, p.Variant)
+		}
+		return fmt.Sprintf("%s (%s/%s)", name, p.OS, p.Architecture)
+	}
+	return name
+}
+
+// ociImages returns the image manifests an index refers to, following nested indexes
+func ociImages(a archive, index []byte, parent ociImage, depth int) ([]ociImage, error) {
+	if depth > 4 {
+		return nil, fmt.Errorf("image indexes are nested too deeply")
+	}
+	var idx OCIIndex
+	if err := json.Unmarshal(index, &idx); err != nil {
+		return nil, fmt.Errorf("failed to parse image index: %v", err)
+	}
+
+	var images []ociImage
+	for _, desc := range idx.Manifests {
+		if desc.Annotations[annotationReferenceType] == "attestation-manifest" {
+			continue
+		}
+		img := ociImage{Descriptor: desc, RefName: parent.RefName, ImageName: parent.ImageName}
+		if name, ok := desc.Annotations[AnnotationRefName]; ok {
+			img.RefName = name
+		}
+		if name, ok := desc.Annotations[AnnotationImageName]; ok {
+			img.ImageName = name
+		}
+		switch desc.MediaType {
+		case MediaTypeOCIIndex, mediaTypeDockerManifestList:
+			data, err := a.readFile(BlobPath(desc.Digest))
+			if err != nil {
+				return nil, err
+			}
+			nested, err := ociImages(a, data, img, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			images = append(images, nested...)
+		default:
+			images = append(images, img)
+		}
+	}
+	return images, nil
+}
+
+// loadOCI loads every image in an OCI image layout
+func loadOCI(a archive, index []byte) ([]*Tar, error) {
+	refs, err := ociImages(a, index, ociImage{}, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var images []*Tar
+	for _, ref := range refs {
+		data, err := a.readFile(BlobPath(ref.Digest))
+		if err != nil {
+			return nil, fmt.Errorf("manifest %s: %v", ref.Digest, err)
+		}
+		var m OCIManifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil, fmt.Errorf("failed to parse manifest %s: %v", ref.Digest, err)
+		}
+		rawJSON, err := a.readFile(BlobPath(m.Config.Digest))
+		if err != nil {
+			return nil, fmt.Errorf("image config %s: %v", m.Config.Digest, err)
+		}
+		config, err := NewFromJSON(rawJSON)
+		if err != nil {
+			return nil, err
+		}
+
+		i := &Tar{
+			Manifest: Manifest{Config: BlobPath(m.Config.Digest)},
+			Config:   config,
+		}
+		mediaTypes := make(map[string]string)
+		for _, layer := range m.Layers {
+			if strings.HasSuffix(layer.MediaType, "+encrypted") {
+				return nil, fmt.Errorf("layer %s of %s is encrypted", layer.Digest, ref)
+			}
+			i.Manifest.Layers = append(i.Manifest.Layers, BlobPath(layer.Digest))
+			mediaTypes[BlobPath(layer.Digest)] = layer.MediaType
+		}
+		for _, name := range []string{ref.ImageName, ref.RefName} {
+			if len(name) > 0 && !contains(i.Manifest.RepoTags, name) {
+				i.Manifest.RepoTags = append(i.Manifest.RepoTags, name)
+			}
+		}
+		if len(i.Manifest.RepoTags) > 0 {
+			i.Tag = i.Manifest.RepoTags[0]
+		} else {
+			i.Tag = untagged(i.ID())
+		}
+		if err := i.loadLayers(a, mediaTypes); err != nil {
+			return nil, err
+		}
+		images = append(images, i)
+	}
+	return images, nil
+}
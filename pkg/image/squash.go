@@ -0,0 +1,233 @@
+package image
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/wagoodman/dive/dive/filetree"
+)
+
+// SquashLayer writes the layer tar that replaces the image's layers from
+// index from up: the files a container sees that come from those layers,
+// as they are in their layer tars, and whiteouts for the files of the lower
+// layers they delete. Deleted files (i.e. secrets removed by a later layer)
+// aren't in it.
+func SquashLayer(fsys *FS, from int, w io.Writer) error {
+	i := fsys.i
+	if from < 0 || from >= len(i.blobs) {
+		return fmt.Errorf("image has no layer %d", from)
+	}
+	merged, err := i.Merged()
+	if err != nil {
+		return err
+	}
+	lower, err := mergeLayers(i.blobs[:from])
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	if err := writeWhiteouts(tw, lower, merged); err != nil {
+		return err
+	}
+	for idx := from; idx < len(i.blobs); idx++ {
+		if err := squashBlob(fsys, idx, merged, tw); err != nil {
+			return fmt.Errorf("layer %d: %v", idx, err)
+		}
+	}
+	return tw.Close()
+}
+
+// writeWhiteouts writes a whiteout for every file of the lower layers that
+// isn't in the merged filesystem and for every directory replaced by something
+// else, leaving out the files under removed directories
+func writeWhiteouts(tw *tar.Writer, lower, merged *Merged) error {
+	removed := make(map[string]bool)
+	return lower.Tree.VisitDepthParentFirst(func(node *filetree.FileNode) error {
+		p := node.Path()
+		if removed[path.Dir(p)] {
+			removed[p] = true
+			return nil
+		}
+		upper, err := merged.Tree.GetNode(p)
+		// a file replacing a directory removes everything under it
+		if err == nil && (!isDir(node) || isDir(upper)) {
+			return nil
+		}
+		removed[p] = true
+		return tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     strings.TrimPrefix(path.Join(path.Dir(p), whiteoutPrefix+path.Base(p)), "/"),
+			Mode:     0644,
+			ModTime:  time.Unix(0, 0),
+		})
+	}, nil)
+}
+
+// squashBlob copies the entries of layer idx that are in the merged filesystem to tw
+func squashBlob(fsys *FS, idx int, merged *Merged, tw *tar.Writer) error {
+	blob := fsys.i.blobs[idx]
+	r, err := fsys.open(blob)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	cr := &countingReader{r: r}
+	tr := tar.NewReader(cr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		p := "/" + archiveName(hdr.Name)
+		// only the last entry of a path in the layer counts
+		if entry, ok := blob.files[p]; !ok || entry.Offset != cr.n {
+			continue
+		}
+		if layer, ok := merged.Layer(p); !ok || layer != idx {
+			continue
+		}
+		squashed := *hdr
+		squashed.Format = tar.FormatUnknown
+		if hdr.Typeflag == tar.TypeLink {
+			// a later layer replaces or removes the file linked to, so the link becomes a copy of it
+			target := "/" + archiveName(strings.TrimPrefix(hdr.Linkname, "/"))
+			if layer, ok := merged.Layer(target); !ok || layer > idx {
+				if err := copyLink(fsys, idx, p, squashed, tw); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if err := tw.WriteHeader(&squashed); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// copyLink writes the hard link p of layer idx as a regular file with the
+// contents of the file it links to
+func copyLink(fsys *FS, idx int, p string, hdr tar.Header, tw *tar.Writer) error {
+	layer, err := fsys.Layer(idx)
+	if err != nil {
+		return err
+	}
+	f, err := layer.Open(fsPath(p))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeReg, "", fi.Size()
+	if err := tw.WriteHeader(&hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// SquashConfig returns the image's config with its layers from index from up
+// replaced by the squashed layer with diffID. Their history entries are kept
+// as empty layers and a history entry created by createdBy is added for the
+// squashed layer, created when the newest of them was so that squashing an
+// image twice gives the same config. Every other field of the config is kept as is.
+func (i *Tar) SquashConfig(from int, diffID, createdBy string) ([]byte, error) {
+	if from < 0 || from >= len(i.blobs) {
+		return nil, fmt.Errorf("image has no layer %d", from)
+	}
+
+	var conf map[string]json.RawMessage
+	if err := json.Unmarshal(i.Config.RawJSON(), &conf); err != nil {
+		return nil, fmt.Errorf("failed to parse image config: %v", err)
+	}
+	var rootfs map[string]json.RawMessage
+	if err := json.Unmarshal(conf["rootfs"], &rootfs); err != nil {
+		return nil, fmt.Errorf("failed to parse image config rootfs: %v", err)
+	}
+	var diffIDs []string
+	for _, blob := range i.blobs[:from] {
+		diffIDs = append(diffIDs, blob.diffID)
+	}
+	var err error
+	if rootfs["diff_ids"], err = json.Marshal(append(diffIDs, diffID)); err != nil {
+		return nil, err
+	}
+	if conf["rootfs"], err = json.Marshal(rootfs); err != nil {
+		return nil, err
+	}
+
+	var history []json.RawMessage
+	if raw, ok := conf["history"]; ok {
+		if err := json.Unmarshal(raw, &history); err != nil {
+			return nil, fmt.Errorf("failed to parse image config history: %v", err)
+		}
+	} else {
+		// the kept layers get empty entries so the entries still line up with the layers
+		for idx := 0; idx < from; idx++ {
+			history = append(history, json.RawMessage("{}"))
+		}
+	}
+	var created time.Time
+	json.Unmarshal(conf["created"], &created)
+	layer := 0
+	for idx, h := range history {
+		var entry map[string]json.RawMessage
+		if err := json.Unmarshal(h, &entry); err != nil {
+			return nil, fmt.Errorf("failed to parse image config history: %v", err)
+		}
+		var t time.Time
+		if json.Unmarshal(entry["created"], &t); t.After(created) {
+			created = t
+		}
+		var empty bool
+		if json.Unmarshal(entry["empty_layer"], &empty); empty {
+			continue
+		}
+		if layer >= from {
+			entry["empty_layer"] = json.RawMessage("true")
+			if history[idx], err = json.Marshal(entry); err != nil {
+				return nil, err
+			}
+		}
+		layer++
+	}
+
+	squashed := len(i.blobs) - from
+	comment := fmt.Sprintf("squashed %d layers", squashed)
+	if squashed == 1 {
+		comment = "squashed 1 layer"
+	}
+	entry := struct {
+		Created   *time.Time `json:"created,omitempty"`
+		CreatedBy string     `json:"created_by,omitempty"`
+		Comment   string     `json:"comment,omitempty"`
+	}{CreatedBy: createdBy, Comment: comment}
+	if !created.IsZero() {
+		created = created.UTC()
+		entry.Created = &created
+	}
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	if conf["history"], err = json.Marshal(append(history, raw)); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(conf)
+}
@@ -0,0 +1,235 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// squash squashes the layers of an image from index from up and returns the squashed layer
+func squash(t *testing.T, from int, layers ...[]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := SquashLayer(testFS(t, layers...), from, &buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// readLayer returns the headers of a layer tar in order and the contents of its regular files
+func readLayer(t *testing.T, layer []byte) ([]*tar.Header, map[string]string) {
+	t.Helper()
+	var headers []*tar.Header
+	contents := make(map[string]string)
+	tr := tar.NewReader(bytes.NewReader(layer))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return headers, contents
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers = append(headers, hdr)
+		if hdr.Typeflag == tar.TypeReg {
+			data, err := ioutil.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			contents[hdr.Name] = string(data)
+		}
+	}
+}
+
+// mergedLayers maps every path in the merged filesystem of an image with layers
+// to its type, where hard links are regular files
+func mergedLayers(t *testing.T, layers ...[]byte) map[string]byte {
+	t.Helper()
+	m, err := parseImage(t, layers...).Merged()
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := make(map[string]byte)
+	for p := range m.origins {
+		node, err := m.Tree.GetNode(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths[p] = node.Data.FileInfo.TypeFlag
+		if paths[p] == tar.TypeLink {
+			paths[p] = tar.TypeReg
+		}
+	}
+	return paths
+}
+
+func TestSquashLayer(t *testing.T) {
+	tests := []struct {
+		name   string
+		layers [][]testEntry
+		from   int
+		// want are the sorted names in the squashed layer
+		want     []string
+		contents map[string]string
+	}{
+		{
+			name: "file deleted later",
+			layers: [][]testEntry{
+				{dir("etc/"), file("etc/passwd", "root"), file("etc/secret", "v1")},
+				{file("etc/secret", "v2"), file("etc/app.conf", "conf")},
+				{file("etc/.wh.secret", "")},
+			},
+			from:     1,
+			want:     []string{"etc/.wh.secret", "etc/app.conf"},
+			contents: map[string]string{"etc/app.conf": "conf"},
+		},
+		{
+			name: "file deleted later, squashing every layer",
+			layers: [][]testEntry{
+				{dir("etc/"), file("etc/passwd", "root"), file("etc/secret", "v1")},
+				{file("etc/.wh.secret", "")},
+			},
+			want:     []string{"etc/", "etc/passwd"},
+			contents: map[string]string{"etc/passwd": "root"},
+		},
+		{
+			name: "directory replaced by a file",
+			layers: [][]testEntry{
+				{dir("opt/"), dir("opt/tool/"), file("opt/tool/a", "a"), dir("opt/tool/lib/"), file("opt/tool/lib/b", "b")},
+				{file("opt/tool", "script")},
+			},
+			from:     1,
+			want:     []string{"opt/.wh.tool", "opt/tool"},
+			contents: map[string]string{"opt/tool": "script"},
+		},
+		{
+			name: "hard link whose target is replaced",
+			layers: [][]testEntry{
+				{dir("bin/"), file("bin/tool", "v1"), hardlink("bin/alias", "bin/tool")},
+				{dir("bin/"), file("bin/tool", "v2")},
+			},
+			want:     []string{"bin/", "bin/alias", "bin/tool"},
+			contents: map[string]string{"bin/alias": "v1", "bin/tool": "v2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var layers [][]byte
+			for _, entries := range tt.layers {
+				layers = append(layers, layerTar(t, entries...))
+			}
+			squashed := squash(t, tt.from, layers...)
+
+			headers, contents := readLayer(t, squashed)
+			var names []string
+			for _, hdr := range headers {
+				names = append(names, hdr.Name)
+			}
+			sort.Strings(names)
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Fatalf("squashed layer has %v, expected %v", names, tt.want)
+			}
+			for name, want := range tt.contents {
+				if contents[name] != want {
+					t.Errorf("%s: has %q, expected %q", name, contents[name], want)
+				}
+			}
+
+			// the squashed image has the same filesystem as the image
+			want := mergedLayers(t, layers...)
+			if got := mergedLayers(t, append(layers[:tt.from:tt.from], squashed)...); !reflect.DeepEqual(got, want) {
+				t.Fatalf("squashed image has\n%v\nexpected\n%v", got, want)
+			}
+		})
+	}
+}
+
+// squashConfig squashes the config of i from index from up and returns it decoded
+func squashConfig(t *testing.T, i *Tar, from int) (diffIDs []string, history []map[string]interface{}) {
+	t.Helper()
+	raw, err := i.SquashConfig(from, "sha256:squashed", "graboid squash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conf struct {
+		RootFS struct {
+			DiffIDs []string `json:"diff_ids"`
+		} `json:"rootfs"`
+		History []map[string]interface{} `json:"history"`
+	}
+	if err := json.Unmarshal(raw, &conf); err != nil {
+		t.Fatal(err)
+	}
+	return conf.RootFS.DiffIDs, conf.History
+}
+
+func TestSquashConfig(t *testing.T) {
+	i := parseImage(t,
+		layerTar(t, file("a", "a")),
+		layerTar(t, file("b", "b")),
+		layerTar(t, file("c", "c")),
+	)
+
+	diffIDs, history := squashConfig(t, i, 1)
+	if want := []string{i.Layers[0].DiffID(), "sha256:squashed"}; !reflect.DeepEqual(diffIDs, want) {
+		t.Fatalf("diff_ids are %v, expected %v", diffIDs, want)
+	}
+	if len(history) != 4 {
+		t.Fatalf("expected 4 history entries, got %d", len(history))
+	}
+	for idx, entry := range history[:3] {
+		if empty := entry["empty_layer"] == true; empty != (idx >= 1) {
+			t.Errorf("history entry %d: empty_layer is %v", idx, entry["empty_layer"])
+		}
+	}
+	// the squashed layer was created with the newest layer it replaces, not when it was squashed
+	squashed := history[3]
+	if want := testTime.Add(2 * time.Hour).Format(time.RFC3339); squashed["created"] != want ||
+		squashed["created_by"] != "graboid squash" || squashed["comment"] != "squashed 2 layers" {
+		t.Fatalf("unexpected squashed history entry %v", squashed)
+	}
+	raw, err := i.SquashConfig(1, "sha256:squashed", "graboid squash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := i.SquashConfig(1, "sha256:squashed", "graboid squash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(raw, again) {
+		t.Fatal("squashing the config twice gave different configs")
+	}
+
+	if _, history := squashConfig(t, i, 2); history[3]["comment"] != "squashed 1 layer" {
+		t.Fatalf("unexpected comment %q", history[3]["comment"])
+	}
+
+	// an image without history gets one, with entries for the layers that are kept
+	var conf map[string]json.RawMessage
+	if err := json.Unmarshal(i.Config.RawJSON(), &conf); err != nil {
+		t.Fatal(err)
+	}
+	delete(conf, "history")
+	b, err := json.Marshal(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.Config, err = NewFromJSON(b); err != nil {
+		t.Fatal(err)
+	}
+	_, history = squashConfig(t, i, 2)
+	if len(history) != 3 || len(history[0]) != 0 || len(history[1]) != 0 ||
+		history[2]["created"] != testTime.Format(time.RFC3339) || history[2]["comment"] != "squashed 1 layer" {
+		t.Fatalf("unexpected history %v", history)
+	}
+
+	if _, err := i.SquashConfig(3, "sha256:squashed", ""); err == nil {
+		t.Fatal("expected an error for a layer the image doesn't have")
+	}
+}
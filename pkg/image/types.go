@@ -37,6 +37,8 @@ type Image struct {
 	Architecture string `json:"architecture,omitempty"`
 	// OS is the operating system used to build and run the image
 	OS string `json:"os,omitempty"`
+	// Variant is the variant of the CPU the image is built for (i.e. v8 for arm64)
+	Variant string `json:"variant,omitempty"`
 	// Size is the total size of the image including all layers it is composed of
 	Size   int64        `json:",omitempty"`
 	RootFS *imageRootFS `json:"rootfs,omitempty"`
@@ -52,7 +54,6 @@ type imageRootFS struct {
 }
 
 type imageHistory struct {
-	ID         string
 	Size       uint64
 	Created    time.Time `json:"created"`
 	Author     string    `json:"author,omitempty"`
@@ -61,6 +62,15 @@ type imageHistory struct {
 	EmptyLayer bool      `json:"empty_layer,omitempty"`
 }
 
+// Platform returns the image's os/architecture[/variant]
+func (img *Image) Platform() string {
+	platform := img.OS + "/" + img.Architecture
+	if len(img.Variant) > 0 {
+		platform += "/" + img.Variant
+	}
+	return platform
+}
+
 // RawJSON returns the immutable JSON associated with the image.
 func (img *Image) RawJSON() []byte {
 	return img.rawJSON
@@ -97,4 +107,12 @@ type Tar struct {
 	RefTrees      []*filetree.FileTree
 	SizeBytes     uint64
 	UserSizeByes  uint64 // this is all bytes except for the base image
+
+	blobs   []*layerBlob
+	merged  *Merged
+	changes []*Changes
+	// source is the indexed archive of an image parsed with ParseIndexed
+	source *streamArchive
+	// limits bound reading the image's files from its archive
+	limits Limits
 }
@@ -0,0 +1,177 @@
+package image
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Writer streams a `docker load` compatible image archive or an OCI image layout
+type Writer struct {
+	tw        *tar.Writer
+	format    Format
+	manifests []Manifest
+	index     []Descriptor
+	written   map[string]bool
+	files     []File
+	modTime   time.Time
+}
+
+// File is a file that was written to an archive
+type File struct {
+	Name   string
+	Size   int64
+	Digest string
+}
+
+// NewWriter creates a new image archive Writer that writes to w
+func NewWriter(w io.Writer) *Writer {
+	return NewFormatWriter(w, FormatDocker)
+}
+
+// NewFormatWriter creates a new Writer that writes an archive of format to w
+func NewFormatWriter(w io.Writer, format Format) *Writer {
+	return &Writer{
+		tw:      tar.NewWriter(w),
+		format:  format,
+		written: make(map[string]bool),
+		modTime: time.Now(),
+	}
+}
+
+// Format returns the format of the archive being written
+func (w *Writer) Format() Format {
+	return w.format
+}
+
+// Exclude prevents files from being written to the archive (i.e. blobs the target already has)
+func (w *Writer) Exclude(names ...string) {
+	for _, name := range names {
+		w.written[name] = true
+	}
+}
+
+// Has returns true if a file has already been written to (or is excluded from) the archive
+func (w *Writer) Has(name string) bool {
+	return w.written[name]
+}
+
+// WriteFile writes a file entry of size bytes read from r to the archive.
+// Files that have already been written are skipped so that blobs shared
+// between images are only stored once.
+func (w *Writer) WriteFile(name string, size int64, r io.Reader) error {
+	if w.written[name] {
+		return nil
+	}
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  w.modTime,
+	}
+	if err := w.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w.tw, h), r)
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("short write for %s: wrote %d of %d bytes", name, n, size)
+	}
+	w.written[name] = true
+	w.files = append(w.files, File{
+		Name:   name,
+		Size:   size,
+		Digest: fmt.Sprintf("sha256:%x", h.Sum(nil)),
+	})
+	return nil
+}
+
+// Files returns the files written to the archive so far (manifest.json is included after Close)
+func (w *Writer) Files() []File {
+	return w.files
+}
+
+// AddManifest adds an image to the archive's manifest.json.
+// Images that are already in the archive have the new RepoTags merged into their entry.
+func (w *Writer) AddManifest(m Manifest) {
+	for idx, existing := range w.manifests {
+		if existing.Config == m.Config && strings.Join(existing.Layers, ",") == strings.Join(m.Layers, ",") {
+			for _, tag := range m.RepoTags {
+				if !contains(existing.RepoTags, tag) {
+					w.manifests[idx].RepoTags = append(w.manifests[idx].RepoTags, tag)
+				}
+			}
+			return
+		}
+	}
+	w.manifests = append(w.manifests, m)
+}
+
+// AddIndexManifest adds an image manifest (that has been written as a blob) to an OCI layout's index.json
+func (w *Writer) AddIndexManifest(desc Descriptor) {
+	w.index = append(w.index, desc)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *Writer) writeJSON(name string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     int64(len(data)),
+		Mode:     0644,
+		ModTime:  w.modTime,
+	}
+	if err := w.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := w.tw.Write(data); err != nil {
+		return err
+	}
+	w.files = append(w.files, File{
+		Name:   hdr.Name,
+		Size:   hdr.Size,
+		Digest: fmt.Sprintf("sha256:%x", sha256.Sum256(data)),
+	})
+	return nil
+}
+
+// Close writes the manifest.json (or the OCI layout's index.json) and finishes the archive
+func (w *Writer) Close() error {
+	if w.format == FormatOCI {
+		if err := w.writeJSON(OCILayoutFile, map[string]string{"imageLayoutVersion": OCILayoutVersion}); err != nil {
+			return err
+		}
+		if err := w.writeJSON(OCIIndexFile, OCIIndex{
+			SchemaVersion: 2,
+			MediaType:     MediaTypeOCIIndex,
+			Manifests:     w.index,
+		}); err != nil {
+			return err
+		}
+		return w.tw.Close()
+	}
+	if err := w.writeJSON("manifest.json", w.manifests); err != nil {
+		return err
+	}
+	return w.tw.Close()
+}
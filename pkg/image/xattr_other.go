@@ -0,0 +1,24 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package image
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"time"
+)
+
+// lsetxattr is not supported on this platform
+func lsetxattr(path, name string, value []byte) error {
+	return fmt.Errorf("extended attributes are not supported on %s", runtime.GOOS)
+}
+
+// lutimes sets the access and modification times of a file, symlinks keep theirs
+func lutimes(path string, mtime time.Time) error {
+	if fi, err := os.Lstat(path); err != nil || fi.Mode()&os.ModeSymlink != 0 {
+		return err
+	}
+	return os.Chtimes(path, mtime, mtime)
+}
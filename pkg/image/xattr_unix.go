@@ -0,0 +1,21 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package image
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// lsetxattr sets an extended attribute of a file without following symlinks
+func lsetxattr(path, name string, value []byte) error {
+	return unix.Lsetxattr(path, name, value, 0)
+}
+
+// lutimes sets the access and modification times of a file without following symlinks
+func lutimes(path string, mtime time.Time) error {
+	ts := unix.NsecToTimespec(mtime.UnixNano())
+	return unix.UtimesNanoAt(unix.AT_FDCWD, path, []unix.Timespec{ts, ts}, unix.AT_SYMLINK_NOFOLLOW)
+}
@@ -0,0 +1,367 @@
+package minisign
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	untrustedPrefix = "untrusted comment: "
+	trustedPrefix   = "trusted comment: "
+
+	// kdf parameters used by minisign for encrypted secret keys
+	defaultOpsLimit = 33554432
+	defaultMemLimit = 1073741824
+)
+
+var (
+	algEd        = [2]byte{'E', 'd'} // ed25519 over the message
+	algPrehashed = [2]byte{'E', 'D'} // ed25519 over the blake2b-512 hash of the message
+	kdfScrypt    = [2]byte{'S', 'c'}
+	kdfNone      = [2]byte{0, 0}
+	chkBlake2b   = [2]byte{'B', '2'}
+)
+
+// ErrPasswordRequired is returned when parsing an encrypted secret key without a password
+var ErrPasswordRequired = errors.New("secret key is encrypted and requires a password")
+
+// KeyID identifies the key pair a signature was made with
+type KeyID [8]byte
+
+// String returns the key ID the way minisign prints it
+func (id KeyID) String() string {
+	return fmt.Sprintf("%016X", binary.LittleEndian.Uint64(id[:]))
+}
+
+// PublicKey is a minisign public key
+type PublicKey struct {
+	ID  KeyID
+	Key ed25519.PublicKey
+}
+
+// PrivateKey is a minisign secret key
+type PrivateKey struct {
+	ID  KeyID
+	Key ed25519.PrivateKey
+}
+
+// Public returns the public half of the key pair
+func (sk *PrivateKey) Public() *PublicKey {
+	return &PublicKey{ID: sk.ID, Key: sk.Key.Public().(ed25519.PublicKey)}
+}
+
+// GenerateKey creates a new random key pair
+func GenerateKey() (*PrivateKey, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	sk := &PrivateKey{Key: key}
+	if _, err := rand.Read(sk.ID[:]); err != nil {
+		return nil, err
+	}
+	return sk, nil
+}
+
+// pemKeyID derives a key ID for ed25519 keys that were not created by minisign
+func pemKeyID(pub ed25519.PublicKey) KeyID {
+	var id KeyID
+	sum := blake2b.Sum256(pub)
+	copy(id[:], sum[:])
+	return id
+}
+
+// decodeFile skips a minisign file's untrusted comment and returns the decoded
+// payload of size bytes along with any remaining lines
+func decodeFile(data []byte, size int) ([]byte, []string, error) {
+	lines := strings.Split(strings.TrimSpace(strings.ReplaceAll(string(data), "\r\n", "\n")), "\n")
+	if strings.HasPrefix(lines[0], untrustedPrefix) {
+		lines = lines[1:]
+	}
+	if len(lines) < 1 {
+		return nil, nil, fmt.Errorf("missing data")
+	}
+	payload, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[0]))
+	if err != nil {
+		return nil, nil, fmt.Errorf("bad base64 data: %v", err)
+	}
+	if len(payload) != size {
+		return nil, nil, fmt.Errorf("unexpected data length %d", len(payload))
+	}
+	return payload, lines[1:], nil
+}
+
+// MarshalText returns the key in minisign's public key file format
+func (pk *PublicKey) MarshalText() ([]byte, error) {
+	payload := append(append(algEd[:], pk.ID[:]...), pk.Key...)
+	return []byte(fmt.Sprintf("%sminisign public key %s\n%s\n",
+		untrustedPrefix, pk.ID, base64.StdEncoding.EncodeToString(payload))), nil
+}
+
+// ParsePublicKey parses a minisign public key file, a bare minisign public key
+// string or a PEM encoded (PKIX) ed25519 public key
+func ParsePublicKey(data []byte) (*PublicKey, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse public key: %v", err)
+		}
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("public key is a %T, not ed25519", key)
+		}
+		return &PublicKey{ID: pemKeyID(pub), Key: pub}, nil
+	}
+
+	payload, _, err := decodeFile(data, 2+8+ed25519.PublicKeySize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %v", err)
+	}
+	if !bytes.Equal(payload[:2], algEd[:]) {
+		return nil, fmt.Errorf("unsupported public key algorithm %q", payload[:2])
+	}
+	pk := &PublicKey{Key: ed25519.PublicKey(payload[10:])}
+	copy(pk.ID[:], payload[2:10])
+	return pk, nil
+}
+
+// ReadPublicKey reads a public key file
+func ReadPublicKey(path string) (*PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pk, err := ParsePublicKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return pk, nil
+}
+
+// scryptParams converts libsodium's opslimit/memlimit into scrypt parameters
+// the same way crypto_pwhash_scryptsalsa208sha256 does
+func scryptParams(opsLimit, memLimit uint64) (n, r, p int) {
+	if opsLimit < 32768 {
+		opsLimit = 32768
+	}
+	r = 8
+	var maxN uint64
+	if opsLimit < memLimit/32 {
+		p = 1
+		maxN = opsLimit / uint64(r*4)
+	} else {
+		maxN = memLimit / uint64(r*128)
+	}
+	logN := uint(1)
+	for ; logN < 63; logN++ {
+		if uint64(1)<<logN > maxN/2 {
+			break
+		}
+	}
+	if p == 0 {
+		maxrp := (opsLimit / 4) / (uint64(1) << logN)
+		if maxrp > 0x3fffffff {
+			maxrp = 0x3fffffff
+		}
+		p = int(maxrp) / r
+	}
+	return 1 << logN, r, p
+}
+
+func xorStream(keynum []byte, password string, salt []byte, opsLimit, memLimit uint64) error {
+	n, r, p := scryptParams(opsLimit, memLimit)
+	stream, err := scrypt.Key([]byte(password), salt, n, r, p, len(keynum))
+	if err != nil {
+		return err
+	}
+	for i := range keynum {
+		keynum[i] ^= stream[i]
+	}
+	return nil
+}
+
+func (sk *PrivateKey) checksum() []byte {
+	sum := blake2b.Sum256(append(append(algEd[:], sk.ID[:]...), sk.Key...))
+	return sum[:]
+}
+
+// Marshal returns the key in minisign's secret key file format.
+// The key is encrypted with password unless it is empty.
+func (sk *PrivateKey) Marshal(password string) ([]byte, error) {
+	kdf := kdfNone
+	salt := make([]byte, 32)
+	opsLimit, memLimit := uint64(0), uint64(0)
+	if len(password) > 0 {
+		kdf = kdfScrypt
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		opsLimit, memLimit = defaultOpsLimit, defaultMemLimit
+	}
+
+	keynum := append(append(append([]byte{}, sk.ID[:]...), sk.Key...), sk.checksum()...)
+	if len(password) > 0 {
+		if err := xorStream(keynum, password, salt, opsLimit, memLimit); err != nil {
+			return nil, err
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.Write(algEd[:])
+	buf.Write(kdf[:])
+	buf.Write(chkBlake2b[:])
+	buf.Write(salt)
+	binary.Write(&buf, binary.LittleEndian, opsLimit)
+	binary.Write(&buf, binary.LittleEndian, memLimit)
+	buf.Write(keynum)
+
+	comment := "minisign secret key"
+	if len(password) > 0 {
+		comment = "minisign encrypted secret key"
+	}
+	return []byte(fmt.Sprintf("%s%s\n%s\n", untrustedPrefix, comment, base64.StdEncoding.EncodeToString(buf.Bytes()))), nil
+}
+
+// ParsePrivateKey parses a minisign secret key file (decrypting it with password)
+// or a PEM encoded (PKCS #8) ed25519 private key
+func ParsePrivateKey(data []byte, password string) (*PrivateKey, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse secret key: %v", err)
+		}
+		priv, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("secret key is a %T, not ed25519", key)
+		}
+		return &PrivateKey{ID: pemKeyID(priv.Public().(ed25519.PublicKey)), Key: priv}, nil
+	}
+
+	const keynumSize = 8 + ed25519.PrivateKeySize + 32
+	payload, _, err := decodeFile(data, 2+2+2+32+8+8+keynumSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse secret key: %v", err)
+	}
+	if !bytes.Equal(payload[:2], algEd[:]) {
+		return nil, fmt.Errorf("unsupported secret key algorithm %q", payload[:2])
+	}
+	if !bytes.Equal(payload[4:6], chkBlake2b[:]) {
+		return nil, fmt.Errorf("unsupported secret key checksum algorithm %q", payload[4:6])
+	}
+	salt := payload[6:38]
+	opsLimit := binary.LittleEndian.Uint64(payload[38:46])
+	memLimit := binary.LittleEndian.Uint64(payload[46:54])
+	keynum := append([]byte{}, payload[54:]...)
+
+	switch {
+	case bytes.Equal(payload[2:4], kdfScrypt[:]):
+		if len(password) == 0 {
+			return nil, ErrPasswordRequired
+		}
+		if err := xorStream(keynum, password, salt, opsLimit, memLimit); err != nil {
+			return nil, err
+		}
+	case bytes.Equal(payload[2:4], kdfNone[:]):
+	default:
+		return nil, fmt.Errorf("unsupported secret key kdf %q", payload[2:4])
+	}
+
+	sk := &PrivateKey{Key: ed25519.PrivateKey(keynum[8 : 8+ed25519.PrivateKeySize])}
+	copy(sk.ID[:], keynum[:8])
+	if !bytes.Equal(sk.checksum(), keynum[8+ed25519.PrivateKeySize:]) {
+		return nil, fmt.Errorf("secret key checksum mismatch (wrong password?)")
+	}
+	return sk, nil
+}
+
+// ReadPrivateKey reads a secret key file
+func ReadPrivateKey(path, password string) (*PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sk, err := ParsePrivateKey(data, password)
+	if err != nil && err != ErrPasswordRequired {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return sk, err
+}
+
+// Sign returns a minisign signature file for the message read from r.
+// The trusted comment is signed along with the message.
+func (sk *PrivateKey) Sign(r io.Reader, trustedComment string) ([]byte, error) {
+	h, _ := blake2b.New512(nil)
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	sig := ed25519.Sign(sk.Key, h.Sum(nil))
+	globalSig := ed25519.Sign(sk.Key, append(append([]byte{}, sig...), trustedComment...))
+
+	payload := append(append(algPrehashed[:], sk.ID[:]...), sig...)
+	return []byte(fmt.Sprintf("%ssignature from minisign secret key\n%s\n%s%s\n%s\n",
+		untrustedPrefix,
+		base64.StdEncoding.EncodeToString(payload),
+		trustedPrefix, trustedComment,
+		base64.StdEncoding.EncodeToString(globalSig))), nil
+}
+
+// Verify checks a minisign signature file against the message read from r
+// and returns its trusted comment
+func (pk *PublicKey) Verify(r io.Reader, signature []byte) (string, error) {
+	payload, rest, err := decodeFile(signature, 2+8+ed25519.SignatureSize)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse signature: %v", err)
+	}
+	if len(rest) < 2 || !strings.HasPrefix(rest[0], trustedPrefix) {
+		return "", fmt.Errorf("signature is missing its trusted comment")
+	}
+	trustedComment := strings.TrimPrefix(rest[0], trustedPrefix)
+	globalSig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(rest[1]))
+	if err != nil || len(globalSig) != ed25519.SignatureSize {
+		return "", fmt.Errorf("signature has a bad trusted comment signature")
+	}
+
+	var id KeyID
+	copy(id[:], payload[2:10])
+	if id != pk.ID {
+		return "", fmt.Errorf("signature was made with key %s, not %s", id, pk.ID)
+	}
+
+	var h io.Writer
+	var message func() []byte
+	switch {
+	case bytes.Equal(payload[:2], algPrehashed[:]):
+		b2, _ := blake2b.New512(nil)
+		h, message = b2, func() []byte { return b2.Sum(nil) }
+	case bytes.Equal(payload[:2], algEd[:]):
+		var buf bytes.Buffer
+		h, message = &buf, buf.Bytes
+	default:
+		return "", fmt.Errorf("unsupported signature algorithm %q", payload[:2])
+	}
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+
+	sig := payload[10:]
+	if !ed25519.Verify(pk.Key, message(), sig) {
+		return "", fmt.Errorf("signature verification failed")
+	}
+	if !ed25519.Verify(pk.Key, append(append([]byte{}, sig...), trustedComment...), globalSig) {
+		return "", fmt.Errorf("trusted comment signature verification failed")
+	}
+	return trustedComment, nil
+}
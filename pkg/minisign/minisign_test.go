@@ -0,0 +1,206 @@
+package minisign
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	testPassword = "correct horse battery staple"
+	testComment  = "timestamp:1614549543\tfile:message.txt"
+)
+
+func readTestdata(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func testPublicKey(t *testing.T) *PublicKey {
+	t.Helper()
+	pk, err := ParsePublicKey(readTestdata(t, "minisign.pub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pk
+}
+
+func testPrivateKey(t *testing.T) *PrivateKey {
+	t.Helper()
+	sk, err := ParsePrivateKey(readTestdata(t, "minisign-unencrypted.key"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sk
+}
+
+func TestParsePublicKey(t *testing.T) {
+	pk := testPublicKey(t)
+	if id := pk.ID.String(); id != "C373193807678450" {
+		t.Fatalf("key id is %s, expected the C373193807678450 minisign prints", id)
+	}
+	text, err := pk.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := readTestdata(t, "minisign.pub"); !bytes.Equal(bytes.TrimSpace(text), bytes.TrimSpace(want)) {
+		t.Fatalf("marshaled public key\n%s\ndiffers from minisign's\n%s", text, want)
+	}
+}
+
+func TestParseEncryptedPrivateKey(t *testing.T) {
+	if testing.Short() {
+		t.Skip("decrypting minisign's key takes 1GiB of memory for scrypt")
+	}
+	data := readTestdata(t, "minisign.key")
+	if _, err := ParsePrivateKey(data, ""); err != ErrPasswordRequired {
+		t.Fatalf("expected ErrPasswordRequired, got %v", err)
+	}
+	sk, err := ParsePrivateKey(data, testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := testPrivateKey(t); sk.ID != want.ID || !sk.Key.Equal(want.Key) {
+		t.Fatal("decrypted key differs from minisign-unencrypted.key")
+	}
+	if !sk.Public().Key.Equal(testPublicKey(t).Key) {
+		t.Fatal("decrypted key doesn't match minisign.pub")
+	}
+	if _, err := ParsePrivateKey(data, "wrong password"); err == nil {
+		t.Fatal("expected an error for a wrong password")
+	}
+}
+
+func TestVerifyMinisign(t *testing.T) {
+	// a legacy (Ed) signature made by minisign
+	comment, err := testPublicKey(t).Verify(bytes.NewReader(readTestdata(t, "message.txt")), readTestdata(t, "message.txt.minisig"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if comment != testComment {
+		t.Fatalf("trusted comment is %q, expected %q", comment, testComment)
+	}
+}
+
+func TestSignMatchesVector(t *testing.T) {
+	sig, err := testPrivateKey(t).Sign(bytes.NewReader(readTestdata(t, "message.txt")), testComment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := readTestdata(t, "message.txt.graboid.minisig")
+	if !bytes.Equal(sig, want) {
+		t.Fatalf("signature\n%s\ndiffers from the checked in vector\n%s", sig, want)
+	}
+	if !strings.HasPrefix(strings.Split(string(sig), "\n")[1], "RUR") {
+		t.Fatal("expected a prehashed (ED) signature")
+	}
+	comment, err := testPublicKey(t).Verify(bytes.NewReader(readTestdata(t, "message.txt")), sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if comment != testComment {
+		t.Fatalf("trusted comment is %q, expected %q", comment, testComment)
+	}
+}
+
+func TestVerifyTampered(t *testing.T) {
+	pk := testPublicKey(t)
+	message := readTestdata(t, "message.txt")
+
+	for _, name := range []string{"message.txt.minisig", "message.txt.graboid.minisig"} {
+		sig := readTestdata(t, name)
+		lines := strings.Split(string(sig), "\n")
+
+		tests := map[string]func() ([]byte, []byte){
+			"message": func() ([]byte, []byte) {
+				return append([]byte("!"), message...), sig
+			},
+			"trusted comment": func() ([]byte, []byte) {
+				l := append([]string{}, lines...)
+				l[2] = strings.Replace(l[2], "1614549543", "1714549543", 1)
+				return message, []byte(strings.Join(l, "\n"))
+			},
+			"global signature": func() ([]byte, []byte) {
+				l := append([]string{}, lines...)
+				l[3] = "A" + l[3][1:]
+				return message, []byte(strings.Join(l, "\n"))
+			},
+			"missing trusted comment": func() ([]byte, []byte) {
+				return message, []byte(strings.Join(lines[:2], "\n"))
+			},
+		}
+		for what, tamper := range tests {
+			t.Run(name+"/"+what, func(t *testing.T) {
+				m, s := tamper()
+				if _, err := pk.Verify(bytes.NewReader(m), s); err == nil {
+					t.Fatal("expected verification to fail")
+				}
+			})
+		}
+	}
+}
+
+func TestVerifyWrongKey(t *testing.T) {
+	message := readTestdata(t, "message.txt")
+	sig := readTestdata(t, "message.txt.graboid.minisig")
+
+	other, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = other.Public().Verify(bytes.NewReader(message), sig)
+	if err == nil || !strings.Contains(err.Error(), "C373193807678450") {
+		t.Fatalf("expected a key id mismatch, got %v", err)
+	}
+
+	// a different key claiming minisign.pub's key id
+	impostor := other.Public()
+	impostor.ID = testPublicKey(t).ID
+	if _, err := impostor.Verify(bytes.NewReader(message), sig); err == nil {
+		t.Fatal("expected verification with the wrong key to fail")
+	}
+}
+
+func TestKeyRoundTrip(t *testing.T) {
+	sk, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := sk.Marshal("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParsePrivateKey(data, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.ID != sk.ID || !parsed.Key.Equal(sk.Key) {
+		t.Fatal("parsed key differs from the marshaled one")
+	}
+
+	text, err := sk.Public().MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, err := ParsePublicKey(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := sk.Sign(strings.NewReader("message"), "comment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pk.Verify(strings.NewReader("message"), sig); err != nil {
+		t.Fatal(err)
+	}
+	if len(pk.Key) != ed25519.PublicKeySize {
+		t.Fatalf("unexpected public key size %d", len(pk.Key))
+	}
+}
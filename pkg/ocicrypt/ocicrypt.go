@@ -0,0 +1,342 @@
+package ocicrypt
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"go.mozilla.org/pkcs7"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+const (
+	// AnnotationJWE holds the layer's key options wrapped as JWEs
+	AnnotationJWE = "org.opencontainers.image.enc.keys.jwe"
+	// AnnotationPKCS7 holds the layer's key options wrapped as PKCS #7 enveloped data
+	AnnotationPKCS7 = "org.opencontainers.image.enc.keys.pkcs7"
+	// AnnotationPubOpts holds the layer's public cipher options
+	AnnotationPubOpts = "org.opencontainers.image.enc.pubopts"
+	// AnnotationPrefix is the prefix of every layer encryption annotation
+	AnnotationPrefix = "org.opencontainers.image.enc."
+
+	// CipherAES256CTR is the only layer cipher defined by ocicrypt
+	CipherAES256CTR = "AES_256_CTR_HMAC_SHA256"
+
+	encryptedSuffix = "+encrypted"
+)
+
+// IsEncrypted returns true if mediaType is an encrypted layer media type
+func IsEncrypted(mediaType string) bool {
+	return strings.HasSuffix(mediaType, encryptedSuffix)
+}
+
+// DecryptedMediaType returns the media type of an encrypted layer once decrypted
+func DecryptedMediaType(mediaType string) string {
+	return strings.TrimSuffix(mediaType, encryptedSuffix)
+}
+
+// publicOptions are the cipher options stored in the clear in the layer's annotations
+type publicOptions struct {
+	Cipher        string            `json:"cipher"`
+	HMAC          []byte            `json:"hmac"`
+	CipherOptions map[string][]byte `json:"cipheroptions"`
+}
+
+// privateOptions are the cipher options wrapped for each recipient
+type privateOptions struct {
+	SymmetricKey  []byte            `json:"symkey"`
+	Digest        string            `json:"digest"`
+	CipherOptions map[string][]byte `json:"cipheroptions"`
+}
+
+// LayerOptions are the unwrapped options needed to decrypt a layer
+type LayerOptions struct {
+	Cipher string
+	Key    []byte
+	Nonce  []byte
+	HMAC   []byte
+	// Digest is the digest of the decrypted layer (if it was recorded)
+	Digest string
+}
+
+// KeyRing holds the private keys (and certificates for PKCS #7) used to unwrap layer keys
+type KeyRing struct {
+	keys  []crypto.PrivateKey
+	certs []*x509.Certificate
+}
+
+// LoadKeyRing reads private keys and certificates from PEM files (PKCS #8,
+// PKCS #1 or SEC 1 keys and X.509 certificates) or JWK files
+func LoadKeyRing(files []string) (*KeyRing, error) {
+	k := new(KeyRing)
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if err := k.add(data); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+	}
+	return k, nil
+}
+
+func (k *KeyRing) add(data []byte) error {
+	var jwk jose.JSONWebKey
+	if err := jwk.UnmarshalJSON(data); err == nil {
+		if jwk.IsPublic() {
+			return fmt.Errorf("JWK is a public key")
+		}
+		k.keys = append(k.keys, jwk.Key)
+		return nil
+	}
+
+	found := false
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return err
+			}
+			k.certs = append(k.certs, cert)
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return err
+			}
+			k.keys = append(k.keys, key)
+		case "RSA PRIVATE KEY":
+			key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+			if err != nil {
+				return err
+			}
+			k.keys = append(k.keys, key)
+		case "EC PRIVATE KEY":
+			key, err := x509.ParseECPrivateKey(block.Bytes)
+			if err != nil {
+				return err
+			}
+			k.keys = append(k.keys, key)
+		case "ENCRYPTED PRIVATE KEY":
+			return fmt.Errorf("encrypted private keys are not supported")
+		default:
+			continue
+		}
+		found = true
+	}
+	if !found {
+		return fmt.Errorf("no private keys or certificates found")
+	}
+	return nil
+}
+
+// Empty returns true if the key ring has no private keys
+func (k *KeyRing) Empty() bool {
+	return k == nil || len(k.keys) == 0
+}
+
+// publicKey returns the public half of a private key
+func publicKey(key crypto.PrivateKey) crypto.PublicKey {
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return &key.PublicKey
+	case *ecdsa.PrivateKey:
+		return &key.PublicKey
+	}
+	if signer, ok := key.(crypto.Signer); ok {
+		return signer.Public()
+	}
+	return nil
+}
+
+// splitAnnotation decodes a comma separated list of base64 values
+func splitAnnotation(value string) ([][]byte, error) {
+	var values [][]byte
+	for _, part := range strings.Split(value, ",") {
+		if len(part) == 0 {
+			continue
+		}
+		data, err := base64.StdEncoding.DecodeString(part)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, data)
+	}
+	return values, nil
+}
+
+func (k *KeyRing) unwrapJWE(data []byte) ([]byte, error) {
+	jwe, err := jose.ParseEncrypted(string(data))
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range k.keys {
+		if _, _, plain, err := jwe.DecryptMulti(key); err == nil {
+			return plain, nil
+		}
+	}
+	return nil, nil
+}
+
+func (k *KeyRing) unwrapPKCS7(data []byte) ([]byte, error) {
+	p7, err := pkcs7.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	for _, cert := range k.certs {
+		for _, key := range k.keys {
+			pub, ok := publicKey(key).(interface{ Equal(crypto.PublicKey) bool })
+			if !ok || !pub.Equal(cert.PublicKey) {
+				continue
+			}
+			if plain, err := p7.Decrypt(cert, key); err == nil {
+				return plain, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// LayerOptions unwraps the key of an encrypted layer from its annotations
+func (k *KeyRing) LayerOptions(annotations map[string]string) (*LayerOptions, error) {
+	var pub publicOptions
+	if data, ok := annotations[AnnotationPubOpts]; ok {
+		raw, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return nil, fmt.Errorf("bad %s annotation: %v", AnnotationPubOpts, err)
+		}
+		if err := json.Unmarshal(raw, &pub); err != nil {
+			return nil, fmt.Errorf("bad %s annotation: %v", AnnotationPubOpts, err)
+		}
+	}
+	if len(pub.Cipher) == 0 {
+		pub.Cipher = CipherAES256CTR
+	}
+	if pub.Cipher != CipherAES256CTR {
+		return nil, fmt.Errorf("unsupported layer cipher %s", pub.Cipher)
+	}
+
+	var wrapped []string
+	unwrappers := []struct {
+		annotation string
+		unwrap     func([]byte) ([]byte, error)
+	}{
+		{AnnotationJWE, k.unwrapJWE},
+		{AnnotationPKCS7, k.unwrapPKCS7},
+	}
+	for _, u := range unwrappers {
+		value, ok := annotations[u.annotation]
+		if !ok {
+			continue
+		}
+		wrapped = append(wrapped, strings.TrimPrefix(u.annotation, AnnotationPrefix))
+		entries, err := splitAnnotation(value)
+		if err != nil {
+			return nil, fmt.Errorf("bad %s annotation: %v", u.annotation, err)
+		}
+		for _, entry := range entries {
+			plain, err := u.unwrap(entry)
+			if err != nil {
+				return nil, fmt.Errorf("bad %s annotation: %v", u.annotation, err)
+			}
+			if plain == nil {
+				continue
+			}
+			var priv privateOptions
+			if err := json.Unmarshal(plain, &priv); err != nil {
+				return nil, fmt.Errorf("bad wrapped layer options: %v", err)
+			}
+			opts := &LayerOptions{
+				Cipher: pub.Cipher,
+				Key:    priv.SymmetricKey,
+				Nonce:  priv.CipherOptions["nonce"],
+				HMAC:   pub.HMAC,
+				Digest: priv.Digest,
+			}
+			if len(opts.Key) != 32 {
+				return nil, fmt.Errorf("bad layer key length %d", len(opts.Key))
+			}
+			if len(opts.Nonce) != aes.BlockSize {
+				return nil, fmt.Errorf("bad layer nonce length %d", len(opts.Nonce))
+			}
+			return opts, nil
+		}
+	}
+
+	if len(wrapped) == 0 {
+		return nil, fmt.Errorf("layer has no supported wrapped keys")
+	}
+	return nil, fmt.Errorf("none of the decryption keys can unwrap the layer key (wrapped with %s)", strings.Join(wrapped, ", "))
+}
+
+// decryptReader decrypts an AES-256-CTR layer and checks its HMAC at EOF
+type decryptReader struct {
+	r      io.Reader
+	stream cipher.Stream
+	mac    hash.Hash
+	want   []byte
+	// verified is set once the HMAC of the whole layer matched
+	verified bool
+}
+
+// NewReader returns a reader that decrypts the encrypted layer read from r.
+// The layer's HMAC is checked when r reaches EOF and a mismatch is returned
+// as an error instead of io.EOF, so consumers must not use the data until
+// the reader has been read to the end. Close returns an error if it wasn't
+// (i.e. a consumer stopped at the end of the tar), it does not close r.
+func NewReader(r io.Reader, opts *LayerOptions) (io.ReadCloser, error) {
+	block, err := aes.NewCipher(opts.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{
+		r:      r,
+		stream: cipher.NewCTR(block, opts.Nonce),
+		mac:    hmac.New(sha256.New, opts.Key),
+		want:   opts.HMAC,
+	}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.mac.Write(p[:n])
+	d.stream.XORKeyStream(p[:n], p[:n])
+	if err == io.EOF {
+		if !hmac.Equal(d.mac.Sum(nil), d.want) {
+			return n, errHMAC
+		}
+		d.verified = true
+	}
+	return n, err
+}
+
+// errHMAC is returned when the layer doesn't match its HMAC
+var errHMAC = errors.New("layer HMAC mismatch: the layer was tampered with or the wrong key was used")
+
+// Close returns an error unless the layer was read to the end and matched its HMAC
+func (d *decryptReader) Close() error {
+	if !d.verified {
+		return errors.New("layer was not read to the end so its HMAC was not checked")
+	}
+	return nil
+}
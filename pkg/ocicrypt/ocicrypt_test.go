@@ -0,0 +1,182 @@
+package ocicrypt
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readTestdata(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func annotations(t *testing.T, name string) map[string]string {
+	t.Helper()
+	var desc struct {
+		MediaType   string            `json:"mediaType"`
+		Annotations map[string]string `json:"annotations"`
+	}
+	if err := json.Unmarshal(readTestdata(t, name+".json"), &desc); err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncrypted(desc.MediaType) || DecryptedMediaType(desc.MediaType) != "application/vnd.oci.image.layer.v1.tar+gzip" {
+		t.Fatalf("unexpected media type %s", desc.MediaType)
+	}
+	return desc.Annotations
+}
+
+func keyRing(t *testing.T, files ...string) *KeyRing {
+	t.Helper()
+	var paths []string
+	for _, f := range files {
+		paths = append(paths, filepath.Join("testdata", f))
+	}
+	k, err := LoadKeyRing(paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func decrypt(opts *LayerOptions, encrypted []byte) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(encrypted), opts)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return data, r.Close()
+}
+
+func TestDecrypt(t *testing.T) {
+	plain := readTestdata(t, "layer.tar.gz")
+	tests := []struct {
+		layer string
+		keys  []string
+	}{
+		{"layer.jwe", []string{"jwe.key.pem"}},
+		{"layer.pkcs7", []string{"pkcs7.key.pem", "pkcs7.cert.pem"}},
+		// only the key that wrapped the layer key unwraps it
+		{"layer.jwe", []string{"pkcs7.key.pem", "pkcs7.cert.pem", "jwe.key.pem"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.layer, func(t *testing.T) {
+			opts, err := keyRing(t, tt.keys...).LayerOptions(annotations(t, tt.layer))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if opts.Cipher != CipherAES256CTR {
+				t.Fatalf("unexpected cipher %s", opts.Cipher)
+			}
+			if want := fmt.Sprintf("sha256:%x", sha256.Sum256(plain)); opts.Digest != want {
+				t.Fatalf("digest is %s, expected %s", opts.Digest, want)
+			}
+			data, err := decrypt(opts, readTestdata(t, tt.layer))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, plain) {
+				t.Fatal("decrypted layer differs from layer.tar.gz")
+			}
+		})
+	}
+}
+
+func TestDecryptTampered(t *testing.T) {
+	opts, err := keyRing(t, "jwe.key.pem").LayerOptions(annotations(t, "layer.jwe"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted := readTestdata(t, "layer.jwe")
+
+	tampered := append([]byte{}, encrypted...)
+	tampered[len(tampered)/2] ^= 1
+	if _, err := decrypt(opts, tampered); err != errHMAC {
+		t.Fatalf("expected an HMAC mismatch for a tampered layer, got %v", err)
+	}
+
+	bad := *opts
+	bad.HMAC = append([]byte{}, opts.HMAC...)
+	bad.HMAC[0] ^= 1
+	if _, err := decrypt(&bad, encrypted); err != errHMAC {
+		t.Fatalf("expected an HMAC mismatch for a tampered HMAC, got %v", err)
+	}
+
+	a := annotations(t, "layer.jwe")
+	pub, _ := base64.StdEncoding.DecodeString(a[AnnotationPubOpts])
+	var opt publicOptions
+	if err := json.Unmarshal(pub, &opt); err != nil {
+		t.Fatal(err)
+	}
+	opt.HMAC[0] ^= 1
+	pub, _ = json.Marshal(opt)
+	a[AnnotationPubOpts] = base64.StdEncoding.EncodeToString(pub)
+	opts, err = keyRing(t, "jwe.key.pem").LayerOptions(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decrypt(opts, encrypted); err != errHMAC {
+		t.Fatalf("expected an HMAC mismatch for a tampered pubopts annotation, got %v", err)
+	}
+}
+
+func TestDecryptNotReadToEnd(t *testing.T) {
+	opts, err := keyRing(t, "jwe.key.pem").LayerOptions(annotations(t, "layer.jwe"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReader(bytes.NewReader(readTestdata(t, "layer.jwe")), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(r, make([]byte, 16)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err == nil {
+		t.Fatal("expected an error closing a layer that wasn't authenticated")
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := new(KeyRing)
+	if err := k.add(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})); err != nil {
+		t.Fatal(err)
+	}
+	for _, layer := range []string{"layer.jwe", "layer.pkcs7"} {
+		if _, err := k.LayerOptions(annotations(t, layer)); err == nil || !strings.Contains(err.Error(), "none of the decryption keys") {
+			t.Fatalf("%s: expected no key to unwrap the layer key, got %v", layer, err)
+		}
+	}
+
+	// PKCS #7 needs the certificate along with the key
+	if _, err := keyRing(t, "pkcs7.key.pem").LayerOptions(annotations(t, "layer.pkcs7")); err == nil {
+		t.Fatal("expected the layer key not to be unwrapped without the certificate")
+	}
+}
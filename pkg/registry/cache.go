@@ -0,0 +1,133 @@
+package registry
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/apex/log"
+)
+
+// Cache is a content addressable blob cache that can be shared by concurrent pulls
+type Cache struct {
+	Dir string
+
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+// NewCache creates a new blob Cache in dir
+func NewCache(dir string) (*Cache, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0755); err != nil {
+		return nil, err
+	}
+	return &Cache{
+		Dir:   dir,
+		locks: make(map[string]*sync.Mutex),
+	}, nil
+}
+
+// Path returns the path of a blob in the cache
+func (c *Cache) Path(digest string) string {
+	return filepath.Join(c.Dir, "blobs", "sha256", strings.TrimPrefix(digest, "sha256:"))
+}
+
+func (c *Cache) lock(digest string) func() {
+	c.mu.Lock()
+	l, ok := c.locks[digest]
+	if !ok {
+		l = &sync.Mutex{}
+		c.locks[digest] = l
+	}
+	c.mu.Unlock()
+
+	l.Lock()
+	return l.Unlock
+}
+
+// Get returns the path of the cached blob, downloading it with fetch if it is missing.
+// Concurrent calls for the same digest only download the blob once.
+func (c *Cache) Get(digest string, size int64, fetch func() (io.ReadCloser, error)) (string, error) {
+	if !strings.HasPrefix(digest, "sha256:") {
+		return "", fmt.Errorf("unsupported digest algorithm: %s", digest)
+	}
+
+	unlock := c.lock(digest)
+	defer unlock()
+
+	path := c.Path(digest)
+	if fi, err := os.Stat(path); err == nil && fi.Size() == size {
+		log.WithField("digest", digest).Debug("blob cache hit")
+		return path, nil
+	}
+
+	body, err := fetch()
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".download-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", fmt.Errorf("downloading %s failed: %v", digest, err)
+	}
+	if n != size {
+		return "", fmt.Errorf("size mismatch for %s: got %d bytes, expected %d", digest, n, size)
+	}
+	if got := fmt.Sprintf("sha256:%x", h.Sum(nil)); got != digest {
+		return "", fmt.Errorf("digest mismatch: got %s, expected %s", got, digest)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+// Add stores the blob read from r in the cache and returns its digest and size.
+// When expected is set the blob must have that digest. Nothing is stored if
+// reading r fails, so r can verify the blob (i.e. a MAC) as it reaches EOF.
+func (c *Cache) Add(r io.Reader, expected string) (string, int64, error) {
+	tmp, err := ioutil.TempFile(filepath.Join(c.Dir, "blobs", "sha256"), ".add-")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	digest := fmt.Sprintf("sha256:%x", h.Sum(nil))
+	if len(expected) > 0 && digest != expected {
+		return "", 0, fmt.Errorf("digest mismatch: got %s, expected %s", digest, expected)
+	}
+
+	unlock := c.lock(digest)
+	defer unlock()
+
+	if err := os.Rename(tmp.Name(), c.Path(digest)); err != nil {
+		return "", 0, err
+	}
+	return digest, n, nil
+}
@@ -1,6 +1,7 @@
 package registry
 
 import (
+	"crypto/sha256"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
@@ -17,8 +18,67 @@ import (
 	pb "gopkg.in/cheggaaa/pb.v1"
 
 	"github.com/apex/log"
+	"github.com/blacktop/graboid/pkg/compress"
 )
 
+const (
+	// MediaTypeManifest is the docker v2 schema 2 image manifest media type
+	MediaTypeManifest = "application/vnd.docker.distribution.manifest.v2+json"
+	// MediaTypeManifestList is the docker manifest list media type
+	MediaTypeManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	// MediaTypeOCIManifest is the OCI image manifest media type
+	MediaTypeOCIManifest = "application/vnd.oci.image.manifest.v1+json"
+	// MediaTypeOCIIndex is the OCI image index media type
+	MediaTypeOCIIndex = "application/vnd.oci.image.index.v1+json"
+	// DefaultPlatform is the platform pulled from a manifest list when none is given
+	DefaultPlatform = "linux/amd64"
+)
+
+// layer media types
+const (
+	// MediaTypeLayer is the docker gzip compressed layer media type
+	MediaTypeLayer = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	// MediaTypeForeignLayer is the docker foreign (non-distributable) layer media type
+	MediaTypeForeignLayer = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+	// MediaTypeOCILayer is the OCI uncompressed layer media type
+	MediaTypeOCILayer = "application/vnd.oci.image.layer.v1.tar"
+	// MediaTypeOCILayerGzip is the OCI gzip compressed layer media type
+	MediaTypeOCILayerGzip = "application/vnd.oci.image.layer.v1.tar+gzip"
+	// MediaTypeOCILayerZstd is the OCI zstd compressed layer media type
+	MediaTypeOCILayerZstd = "application/vnd.oci.image.layer.v1.tar+zstd"
+	// MediaTypeOCINondistributableLayer is the prefix of the OCI non-distributable layer media types
+	MediaTypeOCINondistributableLayer = "application/vnd.oci.image.layer.nondistributable.v1.tar"
+)
+
+// LayerCompression returns the compression of a layer from its media type
+func LayerCompression(mediaType string) (compress.Algorithm, error) {
+	switch mediaType {
+	case MediaTypeLayer, MediaTypeForeignLayer,
+		MediaTypeOCILayerGzip, MediaTypeOCINondistributableLayer + "+gzip":
+		return compress.Gzip, nil
+	case MediaTypeOCILayerZstd, MediaTypeOCINondistributableLayer + "+zstd":
+		return compress.Zstd, nil
+	case MediaTypeOCILayer, MediaTypeOCINondistributableLayer:
+		return compress.None, nil
+	}
+	return "", fmt.Errorf("unsupported layer media type %s", mediaType)
+}
+
+// LayerMediaType returns the media type of a layer once it is (re)compressed with algo
+func LayerMediaType(mediaType string, algo compress.Algorithm) string {
+	base := MediaTypeOCILayer
+	if strings.HasPrefix(mediaType, MediaTypeOCINondistributableLayer) {
+		base = MediaTypeOCINondistributableLayer
+	}
+	switch {
+	case algo == compress.Gzip && strings.HasPrefix(mediaType, "application/vnd.docker."):
+		return mediaType
+	case algo == compress.None:
+		return base
+	}
+	return base + "+" + string(algo)
+}
+
 // Config registry config struct
 type Config struct {
 	Endpoint       string
@@ -55,10 +115,15 @@ type Tags struct {
 
 // Manifests is the image manifest struct
 type Manifests struct {
-	Config        manifestConfig  `json:"config,omitempty"`
-	Layers        []manifestLayer `json:"layers,omitempty"`
-	MediaType     string          `json:"mediaType,omitempty"`
-	SchemaVersion int             `json:"schemaVersion,omitempty"`
+	Config        manifestConfig    `json:"config,omitempty"`
+	Layers        []manifestLayer   `json:"layers,omitempty"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	SchemaVersion int               `json:"schemaVersion,omitempty"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+	// Digest is the content digest of the manifest
+	Digest string `json:"-"`
+	// Raw is the manifest as served by the registry
+	Raw []byte `json:"-"`
 }
 
 type manifestConfig struct {
@@ -68,9 +133,77 @@ type manifestConfig struct {
 }
 
 type manifestLayer struct {
-	Digest    string `json:"digest,omitempty"`
-	MediaType string `json:"mediaType,omitempty"`
-	Size      int    `json:"size,omitempty"`
+	Digest      string            `json:"digest,omitempty"`
+	MediaType   string            `json:"mediaType,omitempty"`
+	Size        int               `json:"size,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type manifestList struct {
+	MediaType     string                   `json:"mediaType,omitempty"`
+	SchemaVersion int                      `json:"schemaVersion,omitempty"`
+	Manifests     []manifestListDescriptor `json:"manifests,omitempty"`
+}
+
+type manifestListDescriptor struct {
+	Digest    string   `json:"digest,omitempty"`
+	MediaType string   `json:"mediaType,omitempty"`
+	Size      int      `json:"size,omitempty"`
+	Platform  Platform `json:"platform,omitempty"`
+}
+
+// Platform is an image's target platform
+type Platform struct {
+	Architecture string `json:"architecture,omitempty"`
+	OS           string `json:"os,omitempty"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// ParsePlatform parses an os/arch[/variant] platform string
+func ParsePlatform(platform string) (Platform, error) {
+	parts := strings.Split(platform, "/")
+	if len(parts) < 2 || len(parts) > 3 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return Platform{}, fmt.Errorf("invalid platform %q (must be os/arch[/variant])", platform)
+	}
+	p := Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+func (p Platform) String() string {
+	if len(p.Variant) > 0 {
+		return p.OS + "/" + p.Architecture + "/" + p.Variant
+	}
+	return p.OS + "/" + p.Architecture
+}
+
+// Match returns true if the platform satisfies the wanted platform
+func (p Platform) Match(want Platform) bool {
+	if p.OS != want.OS || p.Architecture != want.Architecture {
+		return false
+	}
+	if len(want.Variant) == 0 || p.Variant == want.Variant {
+		return true
+	}
+	// arm64 images usually omit the default v8 variant
+	return p.Architecture == "arm64" && len(p.Variant) == 0 && want.Variant == "v8"
+}
+
+func (l *manifestList) find(platform string) (*manifestListDescriptor, error) {
+	want, err := ParsePlatform(platform)
+	if err != nil {
+		return nil, err
+	}
+	var available []string
+	for i, m := range l.Manifests {
+		if m.Platform.Match(want) {
+			return &l.Manifests[i], nil
+		}
+		available = append(available, m.Platform.String())
+	}
+	return nil, fmt.Errorf("no image for platform %s (available: %s)", platform, strings.Join(available, ", "))
 }
 
 func getProxy(proxy string) func(*http.Request) (*url.URL, error) {
@@ -230,14 +363,63 @@ func (reg *Registry) ReposTags(reposName string) (*Tags, error) {
 
 // ReposManifests gets docker image manifest for name:tag
 func (reg *Registry) ReposManifests(reposName, repoTag string) (*Manifests, error) {
+	return reg.ReposManifestsForPlatform(reposName, repoTag, DefaultPlatform)
+}
+
+// ReposManifestsForPlatform gets docker image manifest for name:tag resolving
+// manifest lists to the image for the os/arch[/variant] platform
+func (reg *Registry) ReposManifestsForPlatform(reposName, repoTag, platform string) (*Manifests, error) {
+	rawJSON, digest, err := reg.getManifest(reposName, repoTag)
+	if err != nil {
+		return nil, err
+	}
+
+	list := new(manifestList)
+	if err := json.Unmarshal(rawJSON, &list); err != nil {
+		return nil, err
+	}
+	if list.MediaType == MediaTypeManifestList || list.MediaType == MediaTypeOCIIndex || len(list.Manifests) > 0 {
+		desc, err := list.find(platform)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%s: %v", reposName, repoTag, err)
+		}
+		log.WithFields(log.Fields{
+			"platform": platform,
+			"digest":   desc.Digest,
+		}).Debug("resolved manifest list")
+		rawJSON, digest, err = reg.getManifest(reposName, desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	m := new(Manifests)
+	if err := json.Unmarshal(rawJSON, &m); err != nil {
+		return nil, err
+	}
+	if m.SchemaVersion != 2 || len(m.Config.Digest) == 0 {
+		return nil, fmt.Errorf("unsupported manifest for %s:%s (schemaVersion=%d mediaType=%s)", reposName, repoTag, m.SchemaVersion, m.MediaType)
+	}
+	m.Digest = digest
+	m.Raw = rawJSON
+
+	return m, nil
+}
+
+func (reg *Registry) getManifest(reposName, reference string) ([]byte, string, error) {
 	headers := make(map[string]string)
-	url := fmt.Sprintf("%s/v2/%s/manifests/%s", reg.Host, reposName, repoTag)
-	headers["Accept"] = "application/vnd.docker.distribution.manifest.v2+json"
+	url := fmt.Sprintf("%s/v2/%s/manifests/%s", reg.Host, reposName, reference)
+	headers["Accept"] = strings.Join([]string{
+		MediaTypeManifest,
+		MediaTypeManifestList,
+		MediaTypeOCIManifest,
+		MediaTypeOCIIndex,
+	}, ", ")
 	log.WithFields(log.Fields{
 		"url":     url,
 		"headers": headers,
 		"image":   reposName,
-		"tag":     repoTag,
+		"ref":     reference,
 	}).Debug("get manifests")
 
 	if reg.TokenExpired() {
@@ -246,21 +428,47 @@ func (reg *Registry) ReposManifests(reposName, repoTag string) (*Manifests, erro
 
 	res, err := reg.doGet(url, headers)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	defer res.Body.Close()
 
 	rawJSON, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
-	m := new(Manifests)
-	if err := json.Unmarshal(rawJSON, &m); err != nil {
+	digest := res.Header.Get("Docker-Content-Digest")
+	if len(digest) == 0 {
+		digest = fmt.Sprintf("sha256:%x", sha256.Sum256(rawJSON))
+	}
+
+	return rawJSON, digest, nil
+}
+
+// RepoGetBlob returns a reader for the blob with the given digest
+func (reg *Registry) RepoGetBlob(reposName, digest, mediaType string) (io.ReadCloser, error) {
+	headers := make(map[string]string)
+	url := fmt.Sprintf("%s/v2/%s/blobs/%s", reg.Host, reposName, digest)
+	headers["Accept"] = mediaType
+	log.WithField("url", url).Debug("downloading blob")
+
+	if reg.TokenExpired() {
+		reg.GetToken()
+	}
+
+	res, err := reg.doGet(url, headers)
+	if err != nil {
 		return nil, err
 	}
+	return res.Body, nil
+}
 
-	return m, nil
+// NewProgressBar creates a progress bar for a blob download that writes to stderr
+func NewProgressBar(size int) *pb.ProgressBar {
+	bar := pb.New(size).SetUnits(pb.U_BYTES)
+	bar.SetWidth(90)
+	bar.Output = os.Stderr
+	return bar
 }
 
 // RepoGetConfig gets docker image config JSON
@@ -273,23 +481,14 @@ func (reg *Registry) RepoGetConfig(tempDir, reposName string, manifest *Manifest
 	}
 	defer out.Close()
 	// Download config
-	headers := make(map[string]string)
-	url := fmt.Sprintf("%s/v2/%s/blobs/%s", reg.Host, reposName, manifest.Config.Digest)
-	headers["Accept"] = manifest.Config.MediaType
-	log.WithField("url", url).Debug("downloading config")
-
-	if reg.TokenExpired() {
-		reg.GetToken()
-	}
-
-	res, err := reg.doGet(url, headers)
+	body, err := reg.RepoGetBlob(reposName, manifest.Config.Digest, manifest.Config.MediaType)
 	if err != nil {
 		return "", err
 	}
-	defer res.Body.Close()
+	defer body.Close()
 
 	// Write the body to file
-	_, err = io.Copy(out, res.Body)
+	_, err = io.Copy(out, body)
 	if err != nil {
 		log.WithError(err).Error("writing config file failed")
 	}
@@ -302,6 +501,9 @@ func (reg *Registry) RepoGetLayers(tempDir, reposName string, manifest *Manifest
 	var layerFiles []string
 
 	for _, layer := range manifest.Layers {
+		if _, err := LayerCompression(layer.MediaType); err != nil {
+			return nil, err
+		}
 		// Create the TAR file
 		tmpfn := filepath.Join(tempDir, fmt.Sprintf("%s.tar", strings.TrimPrefix(layer.Digest, "sha256:")))
 		layerFiles = append(layerFiles, filepath.Base(tmpfn))
@@ -312,25 +514,15 @@ func (reg *Registry) RepoGetLayers(tempDir, reposName string, manifest *Manifest
 		defer out.Close()
 
 		// Download layer
-		headers := make(map[string]string)
-		url := fmt.Sprintf("%s/v2/%s/blobs/%s", reg.Host, reposName, layer.Digest)
-		headers["Accept"] = layer.MediaType
-		log.WithField("url", url).Debug("downloading layer")
-
-		if reg.TokenExpired() {
-			reg.GetToken()
-		}
-
-		res, err := reg.doGet(url, headers)
+		body, err := reg.RepoGetBlob(reposName, layer.Digest, layer.MediaType)
 		if err != nil {
 			return nil, err
 		}
-		defer res.Body.Close()
+		defer body.Close()
 		// create progressbar
-		bar := pb.New(layer.Size).SetUnits(pb.U_BYTES)
-		bar.SetWidth(90)
+		bar := NewProgressBar(layer.Size)
 		bar.Start()
-		reader := bar.NewProxyReader(res.Body)
+		reader := bar.NewProxyReader(body)
 		// Write the body to file
 		_, err = io.Copy(out, reader)
 		if err != nil {